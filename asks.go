@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+	"github.com/libp2p/go-libp2p/core/peer"
+	jrpc "github.com/ybbus/jsonrpc/v2"
+)
+
+// queryAskResult is the result of querying the storage ask of one miner.
+type queryAskResult struct {
+	minerID string
+	peerID  peer.ID
+	ask     *spidresolver.StorageAsk
+	err     error
+	// duration is how long querying the ask took, including any retries.
+	duration time.Duration
+}
+
+// timedOut reports whether the query failed because it took too long.
+func (r queryAskResult) timedOut() bool {
+	if errors.Is(r.err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(r.err, &netErr) && netErr.Timeout()
+}
+
+// durationMillis formats d as a whole number of milliseconds.
+func durationMillis(d time.Duration) string {
+	return strconv.FormatInt(d.Milliseconds(), 10)
+}
+
+// askFilter selects the asks to output by price and piece size, and counts
+// how many asks were kept and filtered out. A zero askFilter keeps every ask.
+type askFilter struct {
+	// maxPrice and maxVerifiedPrice, if not nil, are the highest prices, in
+	// attoFIL, that are kept.
+	maxPrice         *big.Int
+	maxVerifiedPrice *big.Int
+	// minPieceSize, if not zero, filters out miners whose maximum piece size
+	// is smaller.
+	minPieceSize uint64
+	// maxPieceSize, if not zero, filters out miners whose minimum piece size
+	// is larger.
+	maxPieceSize uint64
+
+	kept     int
+	filtered int
+}
+
+// active reports whether the filter has any limits set.
+func (f *askFilter) active() bool {
+	return f.maxPrice != nil || f.maxVerifiedPrice != nil || f.minPieceSize != 0 || f.maxPieceSize != 0
+}
+
+// accept reports whether the ask is within the limits of the filter, and
+// counts it as kept or filtered out.
+func (f *askFilter) accept(ask *spidresolver.StorageAsk) bool {
+	ok := true
+	switch {
+	case f.maxPrice != nil && ask.Price.GreaterThan(*f.maxPrice):
+		ok = false
+	case f.maxVerifiedPrice != nil && ask.VerifiedPrice.GreaterThan(*f.maxVerifiedPrice):
+		ok = false
+	case f.minPieceSize != 0 && ask.MaxPieceSize < f.minPieceSize:
+		ok = false
+	case f.maxPieceSize != 0 && ask.MinPieceSize > f.maxPieceSize:
+		ok = false
+	}
+	if ok {
+		f.kept++
+	} else {
+		f.filtered++
+	}
+	return ok
+}
+
+// parsePrice parses a price in attoFIL. An empty string means no limit, and
+// returns nil.
+func parsePrice(s string) (*big.Int, error) {
+	return parseNonNegative("price", s)
+}
+
+// parseBytes parses a number of bytes, such as an amount of power. An empty
+// string means no limit, and returns nil.
+func parseBytes(s string) (*big.Int, error) {
+	return parseNonNegative("number of bytes", s)
+}
+
+func parseNonNegative(what, s string) (*big.Int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	n, err := big.FromString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %w", what, s, err)
+	}
+	if n.LessThan(big.Zero()) {
+		return nil, fmt.Errorf("invalid %s %q: must not be negative", what, s)
+	}
+	return &n, nil
+}
+
+// askWriter writes query-ask results in some output format.
+type askWriter interface {
+	write(result queryAskResult) error
+	flush() error
+}
+
+// newAskWriter returns the askWriter for the format. If timing is set, the
+// time taken by each query is also written.
+func newAskWriter(format string, w io.Writer, timing bool) (askWriter, error) {
+	switch format {
+	case "text":
+		return &textAskWriter{w: w, timing: timing}, nil
+	case "csv":
+		cw := &csvAskWriter{w: csv.NewWriter(w), timing: timing}
+		header := []string{"miner_id", "peer_id", "price", "verified_price", "min_piece_size", "max_piece_size"}
+		if timing {
+			header = append(header, "query_ms", "timed_out")
+		}
+		err := cw.w.Write(header)
+		if err != nil {
+			return nil, err
+		}
+		return cw, nil
+	case "table":
+		return newTableAskWriter(w, timing), nil
+	}
+	return nil, fmt.Errorf("unsupported output format %q", format)
+}
+
+// textAskWriter writes one line of text per result. Prices are written in
+// FIL, quoted since they contain a space.
+type textAskWriter struct {
+	w      io.Writer
+	timing bool
+}
+
+func (tw *textAskWriter) write(result queryAskResult) error {
+	var timing string
+	if tw.timing {
+		timing = " query_ms=" + durationMillis(result.duration)
+		if result.timedOut() {
+			timing += " timed_out=true"
+		}
+	}
+	var err error
+	switch {
+	case result.err != nil:
+		_, err = fmt.Fprintf(tw.w, "%s %s%s\n", result.minerID, result.err, timing)
+	case result.ask == nil:
+		_, err = fmt.Fprintf(tw.w, "%s has no query ask result%s\n", result.minerID, timing)
+	default:
+		ask := result.ask
+		_, err = fmt.Fprintf(tw.w, "%s  ->  miner=%s price=%q verified_price=%q min_piece_size=%d max_piece_size=%d timestamp=%d expiry=%d seq_no=%d%s\n",
+			result.minerID, ask.Miner, spidresolver.FormatFIL(ask.Price), spidresolver.FormatFIL(ask.VerifiedPrice), ask.MinPieceSize, ask.MaxPieceSize, ask.Timestamp, ask.Expiry, ask.SeqNo, timing)
+	}
+	return err
+}
+
+func (tw *textAskWriter) flush() error {
+	return nil
+}
+
+// csvAskWriter writes a CSV record for each result that has an ask. Failed
+// queries are reported on stderr so that they do not break the CSV. With
+// timing, queries that timed out also get a record, with no ask fields.
+type csvAskWriter struct {
+	w      *csv.Writer
+	timing bool
+}
+
+func (cw *csvAskWriter) write(result queryAskResult) error {
+	if cw.timing && result.timedOut() {
+		fmt.Fprintln(os.Stderr, result.minerID, result.err)
+		return cw.w.Write([]string{
+			result.minerID,
+			result.peerID.String(),
+			"", "", "", "",
+			durationMillis(result.duration),
+			"true",
+		})
+	}
+	if result.err != nil {
+		fmt.Fprintln(os.Stderr, result.minerID, result.err)
+		return nil
+	}
+	if result.ask == nil {
+		fmt.Fprintln(os.Stderr, result.minerID, "has no query ask result")
+		return nil
+	}
+	ask := result.ask
+	record := []string{
+		result.minerID,
+		result.peerID.String(),
+		ask.Price.String(),
+		ask.VerifiedPrice.String(),
+		strconv.FormatUint(ask.MinPieceSize, 10),
+		strconv.FormatUint(ask.MaxPieceSize, 10),
+	}
+	if cw.timing {
+		record = append(record, durationMillis(result.duration), "false")
+	}
+	return cw.w.Write(record)
+}
+
+func (cw *csvAskWriter) flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// errClientQueryAskUnsupported is returned by query-asks when the gateway does
+// not have the client deal methods, as is common for public gateways.
+var errClientQueryAskUnsupported = errors.New("the gateway does not support client deal methods such as Filecoin.ClientQueryAsk. " +
+	"Use --connect-and-identify to query the asks directly from the miners instead")
+
+// clientQueryAskSupported reports whether the gateway has the
+// Filecoin.ClientQueryAsk method. The method is called with an empty peer ID,
+// which a gateway that has the method rejects without contacting any miner.
+func clientQueryAskSupported(ctx context.Context, caller *rpcCaller) (bool, error) {
+	var ask *spidresolver.StorageAsk
+	err := caller.CallFor(ctx, &ask, "Filecoin.ClientQueryAsk", "", "f00")
+	if err == nil {
+		return true, nil
+	}
+	var rpcErr *jrpc.RPCError
+	if !errors.As(err, &rpcErr) {
+		return false, err
+	}
+	return !isMethodNotFound(rpcErr), nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+	"github.com/ipfs/go-cid"
+	jrpc "github.com/ybbus/jsonrpc/v2"
+)
+
+// errNoBatchClient is returned when no gateway client can make batch calls,
+// such as when all calls are made over WebSocket connections.
+var errNoBatchClient = errors.New("no gateway client supports batch calls")
+
+// errMissingResponse is the error for a request that has no response in the
+// response to a batch call.
+var errMissingResponse = errors.New("no response to request in batch")
+
+// minerInfoResult is the miner info of one miner, or the error getting it.
+type minerInfoResult struct {
+	minerInfo spidresolver.MinerInfo
+	err       error
+}
+
+// minerInfoBatch returns the miner info of each miner, in the order of
+// minerIds, as of the tipset identified by tsk, or as of the chain head if tsk
+// is nil. Miners that are not in the cache are looked up with one batch call.
+// A miner whose lookup in the batch failed with an error returned by the
+// gateway for it, such as for an actor that does not exist, has that error.
+// Every other miner that was not looked up, because the batch call failed or
+// had no response for it, is looked up again with its own call, which is
+// retried as usual.
+func (c *rpcCaller) minerInfoBatch(ctx context.Context, minerIds []string, tsk []cid.Cid) []minerInfoResult {
+	results := make([]minerInfoResult, len(minerIds))
+	var requests jrpc.RPCRequests
+	// pending is the index, in minerIds, of the miner of each request.
+	var pending []int
+	// spAddresses is the parsed address of each miner, which is validated
+	// before the cache is used.
+	spAddresses := make([]address.Address, len(minerIds))
+	method := c.methodName(spidresolver.MethodStateMinerInfo)
+	for i, minerId := range minerIds {
+		spAddress, err := spidresolver.ParseAddress(minerId, c.network)
+		if err != nil {
+			results[i].err = err
+			continue
+		}
+		spAddresses[i] = spAddress
+		if c.cache != nil {
+			if minerInfo, ok := c.cache.get(spAddress, tsk); ok {
+				results[i].minerInfo = minerInfo
+				continue
+			}
+		}
+		requests = append(requests, jrpc.NewRequest(method, spAddress, tsk))
+		pending = append(pending, i)
+	}
+	if len(requests) == 0 {
+		return results
+	}
+
+	responses, err := c.callBatch(ctx, requests)
+	var byID map[int]*jrpc.RPCResponse
+	if err == nil {
+		byID = responses.AsMap()
+	}
+	var retried int
+	for id, i := range pending {
+		var callErr error
+		if err != nil {
+			callErr = err
+		} else {
+			resp, ok := byID[id]
+			switch {
+			case !ok || resp == nil:
+				callErr = errMissingResponse
+			case resp.Error != nil:
+				results[i].err = &callError{err: resp.Error}
+				continue
+			default:
+				if decodeErr := resp.GetObject(&results[i].minerInfo); decodeErr != nil {
+					results[i].err = &callError{err: &spidresolver.DecodeError{Method: method, Err: decodeErr}}
+					continue
+				}
+			}
+		}
+		if callErr != nil {
+			if ctx.Err() != nil {
+				results[i].err = &callError{err: callErr}
+				continue
+			}
+			// Retry just this miner.
+			retried++
+			results[i].minerInfo, results[i].err = c.minerInfo(ctx, minerIds[i], tsk)
+			continue
+		}
+		if c.cache != nil {
+			if err := c.cache.put(spAddresses[i], tsk, results[i].minerInfo); err != nil {
+				c.log.infof("cannot cache miner info: %s", err)
+			}
+		}
+	}
+	if retried != 0 {
+		c.log.debugf("retried %d of %d miners from a batch call separately", retried, len(requests))
+	}
+	return results
+}
+
+// callBatch sends the requests in one batch call to the first gateway whose
+// client can make batch calls. Like each call made by CallFor, the batch call
+// waits for the gateway to not be throttled and for the rate limiter, and is
+// limited by the timeout. It is not retried, since the caller retries the
+// requests that failed.
+func (c *rpcCaller) callBatch(ctx context.Context, requests jrpc.RPCRequests) (jrpc.RPCResponses, error) {
+	for _, gc := range c.clients {
+		client, ok := gc.client.(spidresolver.BatchClient)
+		if !ok {
+			continue
+		}
+		if err := gc.throttle.wait(ctx); err != nil {
+			return nil, err
+		}
+		if err := c.limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+		if c.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+		}
+		start := time.Now()
+		responses, err := spidresolver.CallBatch(ctx, client, requests)
+		if err != nil {
+			c.log.debugf("batch of %d calls failed on %s after %s: %s", len(requests), gc.gateway, time.Since(start), err)
+			return nil, err
+		}
+		c.log.debugf("batch of %d calls succeeded on %s in %s", len(requests), gc.gateway, time.Since(start))
+		return responses, nil
+	}
+	return nil, errNoBatchClient
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+	jrpc "github.com/ybbus/jsonrpc/v2"
+)
+
+// batchClient is a client that looks up miner info in infos, in batch calls
+// and in single calls, and records the miners looked up by single calls.
+type batchClient struct {
+	infos map[string]spidresolver.MinerInfo
+	// rpcErrors are the miners whose response in a batch is an RPC error.
+	rpcErrors map[string]bool
+	// missing are the miners that have no response in a batch.
+	missing map[string]bool
+	// batchErr, if not nil, fails every batch call.
+	batchErr error
+	// called are the miners looked up by single calls.
+	called []string
+}
+
+// batchMinerID returns the mainnet ID of the miner address param, whatever the
+// current network is.
+func batchMinerID(param interface{}) string {
+	id, err := address.IDFromAddress(param.(address.Address))
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("f0%d", id)
+}
+
+func (c *batchClient) CallFor(out interface{}, method string, params ...interface{}) error {
+	minerId := batchMinerID(params[0])
+	c.called = append(c.called, minerId)
+	info, ok := c.infos[minerId]
+	if !ok {
+		return &jrpc.RPCError{Code: 1, Message: "actor not found"}
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (c *batchClient) CallBatch(requests jrpc.RPCRequests) (jrpc.RPCResponses, error) {
+	if c.batchErr != nil {
+		return nil, c.batchErr
+	}
+	var responses jrpc.RPCResponses
+	// As the jsonrpc client does, the requests are numbered from zero.
+	for id, req := range requests {
+		minerId := batchMinerID(req.Params.([]interface{})[0])
+		switch {
+		case c.missing[minerId]:
+		case c.rpcErrors[minerId]:
+			responses = append(responses, &jrpc.RPCResponse{ID: id, Error: &jrpc.RPCError{Code: 1, Message: "actor not found"}})
+		default:
+			responses = append(responses, &jrpc.RPCResponse{ID: id, Result: c.infos[minerId]})
+		}
+	}
+	return responses, nil
+}
+
+func TestMinerInfoBatch(t *testing.T) {
+	minerIds := []string{"f01000", "f01001", "f01002", "bad"}
+	infos := map[string]spidresolver.MinerInfo{
+		"f01000": {SectorSize: 1000},
+		"f01001": {SectorSize: 1001},
+		"f01002": {SectorSize: 1002},
+	}
+
+	tests := []struct {
+		name   string
+		client *batchClient
+		// want is the sector size of the miner info returned for each miner,
+		// or zero if there is an error.
+		want       []uint64
+		wantCalled []string
+	}{
+		{
+			name:       "all in batch",
+			client:     &batchClient{infos: infos},
+			want:       []uint64{1000, 1001, 1002, 0},
+			wantCalled: nil,
+		},
+		{
+			name: "some failed",
+			client: &batchClient{
+				infos:     infos,
+				rpcErrors: map[string]bool{"f01001": true},
+				missing:   map[string]bool{"f01002": true},
+			},
+			want:       []uint64{1000, 0, 1002, 0},
+			wantCalled: []string{"f01002"},
+		},
+		{
+			name:       "batch failed",
+			client:     &batchClient{infos: infos, batchErr: errors.New("connection reset")},
+			want:       []uint64{1000, 1001, 1002, 0},
+			wantCalled: []string{"f01000", "f01001", "f01002"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caller := newTestCaller(tt.client)
+			results := caller.minerInfoBatch(context.Background(), minerIds, nil)
+			if len(results) != len(minerIds) {
+				t.Fatalf("got %d results, want %d", len(results), len(minerIds))
+			}
+			for i, result := range results {
+				if tt.want[i] == 0 {
+					if result.err == nil {
+						t.Errorf("%s: no error", minerIds[i])
+					}
+					continue
+				}
+				if result.err != nil {
+					t.Errorf("%s: %v", minerIds[i], result.err)
+				} else if result.minerInfo.SectorSize != tt.want[i] {
+					t.Errorf("%s: got sector size %d, want %d", minerIds[i], result.minerInfo.SectorSize, tt.want[i])
+				}
+			}
+			if !errors.Is(results[3].err, spidresolver.ErrInvalidAddress) {
+				t.Errorf("bad: err = %v, want ErrInvalidAddress", results[3].err)
+			}
+			if !reflect.DeepEqual(tt.client.called, tt.wantCalled) {
+				t.Errorf("miners looked up separately: got %v, want %v", tt.client.called, tt.wantCalled)
+			}
+		})
+	}
+}
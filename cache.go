@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+	"github.com/ipfs/go-cid"
+)
+
+const defaultCacheTTL = time.Hour
+
+// cacheFlags holds the flags that configure the miner info cache.
+type cacheFlags struct {
+	dir   *string
+	ttl   *time.Duration
+	stale *bool
+}
+
+func addCacheFlags(fs *flag.FlagSet) cacheFlags {
+	return cacheFlags{
+		dir:   fs.String("cache", "", "Directory in which to cache miner info. Caching is disabled if not set"),
+		ttl:   fs.Duration("cache-ttl", defaultCacheTTL, "How long cached miner info is used"),
+		stale: fs.Bool("cache-stale", false, "Use cached miner info even if the chain head has changed"),
+	}
+}
+
+// newCache returns the cache configured by the flags, or nil if caching is
+// not enabled.
+func (f cacheFlags) newCache() (*minerInfoCache, error) {
+	if *f.dir == "" {
+		return nil, nil
+	}
+	return newMinerInfoCache(*f.dir, *f.ttl, *f.stale)
+}
+
+// minerInfoCache stores miner info in files, in a directory for each miner
+// with one file for each tipset that its miner info was looked up at. An entry
+// is only used for its tipset, unless stale entries are allowed, in which case
+// the newest entry for the miner is used.
+type minerInfoCache struct {
+	dir   string
+	ttl   time.Duration
+	stale bool
+
+	// mu serializes access to the cache files.
+	mu sync.Mutex
+}
+
+type cacheEntry struct {
+	TipSet    string
+	Stored    time.Time
+	MinerInfo spidresolver.MinerInfo
+}
+
+func newMinerInfoCache(dir string, ttl time.Duration, stale bool) (*minerInfoCache, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &minerInfoCache{
+		dir:   dir,
+		ttl:   ttl,
+		stale: stale,
+	}, nil
+}
+
+// get returns the cached miner info for the miner as of the tipset, if
+// present and not expired.
+func (c *minerInfoCache) get(spAddress address.Address, tsk []cid.Cid) (spidresolver.MinerInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.stale {
+		entry, ok := c.read(c.path(spAddress, tsk))
+		if !ok || entry.TipSet != tipSetKey(tsk) {
+			return spidresolver.MinerInfo{}, false
+		}
+		return entry.MinerInfo, true
+	}
+
+	paths, err := filepath.Glob(filepath.Join(c.minerDir(spAddress), "*.json"))
+	if err != nil {
+		return spidresolver.MinerInfo{}, false
+	}
+	var newest cacheEntry
+	var found bool
+	for _, path := range paths {
+		entry, ok := c.read(path)
+		if ok && (!found || entry.Stored.After(newest.Stored)) {
+			newest = entry
+			found = true
+		}
+	}
+	return newest.MinerInfo, found
+}
+
+// read returns the entry in the file at path, if it can be read and has not
+// expired.
+func (c *minerInfoCache) read(path string) (cacheEntry, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cacheEntry{}, false
+	}
+	var entry cacheEntry
+	if err = json.Unmarshal(data, &entry); err != nil {
+		return cacheEntry{}, false
+	}
+	if time.Since(entry.Stored) > c.ttl {
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+// put stores the miner info for the miner as of the tipset. The miner's
+// entries that have expired are removed.
+func (c *minerInfoCache) put(spAddress address.Address, tsk []cid.Cid, minerInfo spidresolver.MinerInfo) error {
+	data, err := json.Marshal(cacheEntry{
+		TipSet:    tipSetKey(tsk),
+		Stored:    time.Now(),
+		MinerInfo: minerInfo,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dir := c.minerDir(spAddress)
+	if err = os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	c.removeExpired(dir)
+
+	// Write to a temporary file and rename it so that a reader never sees a
+	// partially written entry.
+	tmp, err := os.CreateTemp(dir, "*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(spAddress, tsk))
+}
+
+// removeExpired removes the entries in dir that were written more than the
+// TTL ago. Entries that cannot be removed are left to be tried again.
+func (c *minerInfoCache) removeExpired(dir string) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err == nil && time.Since(info.ModTime()) > c.ttl {
+			os.Remove(path)
+		}
+	}
+}
+
+// minerDir returns the directory of the miner's entries. The address is
+// already validated, so its string form is safe to use as a file name.
+func (c *minerInfoCache) minerDir(spAddress address.Address) string {
+	return filepath.Join(c.dir, spAddress.String())
+}
+
+// path returns the file of the miner's entry for the tipset, named by a hash
+// of the tipset key.
+func (c *minerInfoCache) path(spAddress address.Address, tsk []cid.Cid) string {
+	sum := sha256.Sum256([]byte(tipSetKey(tsk)))
+	return filepath.Join(c.minerDir(spAddress), hex.EncodeToString(sum[:])+".json")
+}
+
+// tipSetKey returns a string that identifies the tipset.
+func tipSetKey(tsk []cid.Cid) string {
+	keys := make([]string, len(tsk))
+	for i, c := range tsk {
+		keys[i] = c.String()
+	}
+	return strings.Join(keys, ",")
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+func testTipSet(t *testing.T, block string) []cid.Cid {
+	t.Helper()
+	h, err := multihash.Sum([]byte(block), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []cid.Cid{cid.NewCidV1(cid.DagCBOR, h)}
+}
+
+func TestMinerInfoCacheTipSets(t *testing.T) {
+	spAddress, err := spidresolver.ParseAddress("f01234", address.Mainnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := testTipSet(t, "first")
+	second := testTipSet(t, "second")
+
+	cache, err := newMinerInfoCache(t.TempDir(), time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cache.put(spAddress, first, spidresolver.MinerInfo{SectorSize: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err = cache.put(spAddress, second, spidresolver.MinerInfo{SectorSize: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each tipset has its own entry.
+	for want, tsk := range map[uint64][]cid.Cid{1: first, 2: second} {
+		minerInfo, ok := cache.get(spAddress, tsk)
+		if !ok || minerInfo.SectorSize != want {
+			t.Errorf("got (%d, %t), want the entry with sector size %d", minerInfo.SectorSize, ok, want)
+		}
+	}
+	if _, ok := cache.get(spAddress, testTipSet(t, "other")); ok {
+		t.Error("got an entry for a tipset that was not cached")
+	}
+
+	// Stale entries of any tipset are used, the newest first.
+	cache.stale = true
+	minerInfo, ok := cache.get(spAddress, testTipSet(t, "other"))
+	if !ok || minerInfo.SectorSize != 2 {
+		t.Errorf("got (%d, %t), want the newest entry", minerInfo.SectorSize, ok)
+	}
+}
+
+func TestMinerInfoCacheExpired(t *testing.T) {
+	spAddress, err := spidresolver.ParseAddress("f01234", address.Mainnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := testTipSet(t, "first")
+
+	cache, err := newMinerInfoCache(t.TempDir(), time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cache.put(spAddress, first, spidresolver.MinerInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err = os.Chtimes(cache.path(spAddress, first), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// An expired entry is removed when another is stored for the miner.
+	if err = cache.put(spAddress, testTipSet(t, "second"), spidresolver.MinerInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(cache.path(spAddress, first)); !os.IsNotExist(err) {
+		t.Errorf("expired entry not removed: %v", err)
+	}
+}
+
+func TestMinerInfoInvalidAddress(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := newMinerInfoCache(filepath.Join(dir, "cache"), time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(dir, "x.json")
+	if err = os.WriteFile(outside, []byte(`{"Stored":"2100-01-01T00:00:00Z"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The ID is rejected before it can name a cache file.
+	caller := &rpcCaller{cache: cache}
+	_, err = caller.minerInfo(context.Background(), "../x", nil)
+	if err == nil {
+		t.Fatal("expected error for an invalid storage provider ID")
+	}
+}
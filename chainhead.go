@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+)
+
+// chainHeadFlags holds the flags of the chain-head subcommand.
+type chainHeadFlags struct {
+	rpc    rpcFlags
+	output *string
+}
+
+func addChainHeadFlags(fs *flag.FlagSet) *chainHeadFlags {
+	return &chainHeadFlags{
+		rpc:    addRPCFlags(fs),
+		output: fs.String("output", "text", "Output format: text or json"),
+	}
+}
+
+// runChainHead runs the chain-head subcommand.
+func runChainHead(ctx context.Context, f *chainHeadFlags, args []string) error {
+	caller, err := f.rpc.newCaller()
+	if err != nil {
+		return err
+	}
+	defer caller.close()
+	return printChainHead(ctx, caller, *f.output)
+}
+
+// printChainHead gets the gateway's chain head and prints its height and
+// tipset CIDs, as text or as JSON.
+func printChainHead(ctx context.Context, caller *rpcCaller, output string) error {
+	if output != "text" && output != "json" {
+		return fmt.Errorf("unsupported output format %q", output)
+	}
+	ets, err := spidresolver.ChainHead(ctx, caller)
+	if err != nil {
+		return err
+	}
+
+	out := spidresolver.ChainHeadResult{
+		Height: ets.Height,
+		Cids:   make([]string, len(ets.Cids)),
+	}
+	for i, c := range ets.Cids {
+		out.Cids[i] = c.String()
+	}
+
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(spidresolver.NewOutput(out))
+	}
+	fmt.Println("Height:", out.Height)
+	fmt.Println("Tipset:")
+	for _, c := range out.Cids {
+		fmt.Println("  ", c)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+)
+
+const (
+	// mainnetGenesis is the time of the Filecoin mainnet genesis block.
+	mainnetGenesis = 1598306400
+	// epochDuration is the time between Filecoin epochs.
+	epochDuration = 30 * time.Second
+	// defaultMaxLag is the number of epochs that a gateway may be behind the
+	// expected height before the check fails.
+	defaultMaxLag = 10
+)
+
+// checkFlags holds the flags of the check subcommand.
+type checkFlags struct {
+	rpc     rpcFlags
+	maxLag  *int64
+	genesis *int64
+}
+
+func addCheckFlags(fs *flag.FlagSet) *checkFlags {
+	return &checkFlags{
+		rpc:     addRPCFlags(fs),
+		maxLag:  fs.Int64("max-lag", defaultMaxLag, "Fail if a gateway is more than this many epochs behind the expected height"),
+		genesis: fs.Int64("genesis", mainnetGenesis, "Genesis time of the network, in Unix seconds, from which the expected height is computed"),
+	}
+}
+
+// runCheck runs the check subcommand.
+func runCheck(ctx context.Context, f *checkFlags, args []string) error {
+	caller, err := f.rpc.newCaller()
+	if err != nil {
+		return err
+	}
+	defer caller.close()
+	return checkGateways(ctx, caller, time.Unix(*f.genesis, 0), *f.maxLag)
+}
+
+// checkGateways checks that each gateway responds with a valid chain head, and
+// that the chain head is at most maxLag epochs behind the height expected
+// from the genesis time. An error is returned if any gateway fails the check.
+func checkGateways(ctx context.Context, caller *rpcCaller, genesis time.Time, maxLag int64) error {
+	var failed int
+	for _, gc := range caller.clients {
+		// Check each gateway on its own, without falling back to the others.
+		gwCaller := *caller
+		gwCaller.clients = []gatewayClient{gc}
+		if err := checkGateway(ctx, &gwCaller, genesis, maxLag); err != nil {
+			fmt.Printf("%s: FAIL: %s\n", gc.gateway, err)
+			failed++
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d gateways failed the check", failed, len(caller.clients))
+	}
+	return nil
+}
+
+func checkGateway(ctx context.Context, caller *rpcCaller, genesis time.Time, maxLag int64) error {
+	start := time.Now()
+	ets, err := spidresolver.ChainHead(ctx, caller)
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+
+	expected := int64(time.Since(genesis) / epochDuration)
+	lag := expected - ets.Height
+	fmt.Printf("%s: height %d, expected %d, %d epochs behind, responded in %s\n",
+		caller.clients[0].gateway, ets.Height, expected, lag, elapsed.Round(time.Millisecond))
+	if lag > maxLag {
+		return fmt.Errorf("more than %d epochs behind", maxLag)
+	}
+	return nil
+}
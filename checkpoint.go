@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+)
+
+// checkpointInterval is the least time between writes of a checkpoint file
+// while miners are being looked up.
+const checkpointInterval = 5 * time.Second
+
+// checkpoint records the miners that a populate run has finished with, so
+// that a later run can skip them. The file has one miner ID per line.
+type checkpoint struct {
+	path string
+	// done holds the miners recorded by a previous run. It is not changed
+	// after the checkpoint is loaded.
+	done map[string]struct{}
+	// added holds the miners finished by this run.
+	added   map[string]struct{}
+	saved   time.Time
+	skipped int
+}
+
+// loadCheckpoint reads the checkpoint file at path. A file that does not exist
+// is an empty checkpoint, which is created when first saved.
+func loadCheckpoint(path string) (*checkpoint, error) {
+	c := &checkpoint{
+		path:  path,
+		done:  make(map[string]struct{}),
+		added: make(map[string]struct{}),
+		saved: time.Now(),
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return c, nil
+		}
+		return nil, fmt.Errorf("cannot read checkpoint: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		minerID := strings.TrimSpace(scanner.Text())
+		if minerID != "" {
+			c.done[minerID] = struct{}{}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read checkpoint: %w", err)
+	}
+	return c, nil
+}
+
+// skip returns true if the miner was recorded by a previous run, and counts
+// it as skipped. A nil checkpoint skips nothing.
+func (c *checkpoint) skip(minerID string) bool {
+	if c == nil {
+		return false
+	}
+	if _, ok := c.done[minerID]; !ok {
+		return false
+	}
+	c.skipped++
+	return true
+}
+
+// skipDone removes the miners recorded by a previous run from minerList.
+func (c *checkpoint) skipDone(minerList map[string]spidresolver.MarketBalance) {
+	for minerID := range minerList {
+		if c.skip(minerID) {
+			delete(minerList, minerID)
+		}
+	}
+}
+
+// add records that this run has finished with the miner. The checkpoint file
+// is saved if it has not been for checkpointInterval.
+func (c *checkpoint) add(minerID string) error {
+	c.added[minerID] = struct{}{}
+	if time.Since(c.saved) < checkpointInterval {
+		return nil
+	}
+	return c.save()
+}
+
+// save writes every miner recorded, by this run or a previous one, to the
+// checkpoint file. It is written to a temporary file that then replaces it,
+// so that a run that stops while writing leaves the previous checkpoint.
+func (c *checkpoint) save() error {
+	minerIDs := make([]string, 0, len(c.done)+len(c.added))
+	for minerID := range c.done {
+		minerIDs = append(minerIDs, minerID)
+	}
+	for minerID := range c.added {
+		if _, ok := c.done[minerID]; !ok {
+			minerIDs = append(minerIDs, minerID)
+		}
+	}
+	sort.Slice(minerIDs, func(i, j int) bool {
+		return lessMinerID(minerIDs[i], minerIDs[j])
+	})
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("cannot write checkpoint: %w", err)
+	}
+	w := bufio.NewWriter(tmp)
+	for _, minerID := range minerIDs {
+		w.WriteString(minerID)
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	if err == nil {
+		// Written to disk before the rename, so that a crash does not leave
+		// an empty checkpoint in place of the previous one.
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("cannot write checkpoint: %w", err)
+	}
+	c.saved = time.Now()
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+)
+
+func TestCheckpointResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "populate.checkpoint")
+
+	// A run that finishes some miners and saves its checkpoint.
+	c, err := loadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, minerID := range []string{"f010", "f02"} {
+		if err = c.add(minerID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = c.save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "f02\nf010\n" {
+		t.Errorf("checkpoint file has %q, want the miners in ID order", data)
+	}
+
+	// A run that stopped while saving left a partly written temporary file.
+	torn := filepath.Join(filepath.Dir(path), filepath.Base(path)+".123.tmp")
+	if err = os.WriteFile(torn, []byte("f03\nf0"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next run skips the finished miners, and only those.
+	c, err = loadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	minerList := map[string]spidresolver.MarketBalance{
+		"f02":  {},
+		"f03":  {},
+		"f010": {},
+	}
+	c.skipDone(minerList)
+	if len(minerList) != 1 {
+		t.Errorf("got miners %v, want only f03", minerList)
+	}
+	if _, ok := minerList["f03"]; !ok {
+		t.Errorf("unfinished miner f03 skipped")
+	}
+	if c.skipped != 2 {
+		t.Errorf("skipped %d miners, want 2", c.skipped)
+	}
+
+	// Saving keeps the miners of the previous run with those of this one.
+	if err = c.add("f03"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.save(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "f02\nf03\nf010\n" {
+		t.Errorf("checkpoint file has %q, want every finished miner", data)
+	}
+}
+
+func TestCheckpointMissing(t *testing.T) {
+	c, err := loadCheckpoint(filepath.Join(t.TempDir(), "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.skip("f01234") {
+		t.Error("empty checkpoint skipped a miner")
+	}
+
+	var nilCheckpoint *checkpoint
+	if nilCheckpoint.skip("f01234") {
+		t.Error("nil checkpoint skipped a miner")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// populateFilter selects the lookup results that populate writes. The miners
+// skipped for having too little power or no addresses are counted, to be
+// reported at the end of the run.
+type populateFilter struct {
+	// minPower, if not nil, is the raw byte power below which miners are
+	// skipped. Getting the power takes an additional RPC call per miner.
+	minPower *big.Int
+	// onlyWithAddrs skips miners that have no valid multiaddrs.
+	onlyWithAddrs bool
+	// includeNoPeerID keeps miners that have no peer ID, to be written
+	// marked as such. Otherwise, they are only counted in the summary.
+	includeNoPeerID bool
+
+	lowPower int
+	noAddrs  int
+}
+
+// keep reports whether the result is written.
+func (f *populateFilter) keep(result peerIDResult, log *logger) bool {
+	switch {
+	case result.belowMinPower:
+		f.lowPower++
+		return false
+	case result.err == nil && f.onlyWithAddrs && len(result.addrInfo.Addrs) == 0:
+		log.debugf("%s has no addresses, skipped", result.minerID)
+		f.noAddrs++
+		return false
+	case errors.Is(result.err, spidresolver.ErrNoPeerID) && !f.includeNoPeerID:
+		log.debugf("%s has no peer ID, omitted", result.minerID)
+		return false
+	}
+	return true
+}
+
+// report writes the number of miners skipped for each reason.
+func (f *populateFilter) report(w io.Writer) {
+	if f.noAddrs != 0 {
+		fmt.Fprintln(w, "Skipped", f.noAddrs, "miners that have no addresses")
+	}
+	if f.minPower != nil {
+		fmt.Fprintln(w, "Filtered out", f.lowPower, "miners with less than the minimum power")
+	}
+}
+
+// populateSink receives each miner that populate resolved and wrote.
+type populateSink interface {
+	put(spInfo SPInfo) error
+	// flush writes the miners that have been put, if they are buffered.
+	flush() error
+}
+
+// peerstoreSink writes the address info of each miner to a peerstore file.
+type peerstoreSink struct {
+	*peerstoreWriter
+}
+
+func (s peerstoreSink) put(spInfo SPInfo) error {
+	return s.add(peer.AddrInfo{ID: spInfo.PeerID, Addrs: spInfo.Addrs})
+}
+
+// flush does nothing, since the end of the file is written when it is closed.
+func (s peerstoreSink) flush() error {
+	return nil
+}
+
+// storeSink saves each miner in the datastore.
+type storeSink struct {
+	store datastore.Datastore
+	// stored is the number of miners saved.
+	stored int
+}
+
+func (s *storeSink) put(spInfo SPInfo) error {
+	if err := storeSPInfo(s.store, spInfo); err != nil {
+		return err
+	}
+	s.stored++
+	return nil
+}
+
+func (s *storeSink) flush() error {
+	if err := s.store.Sync(context.Background(), datastore.NewKey("")); err != nil {
+		return fmt.Errorf("cannot sync provider info: %s", err)
+	}
+	return nil
+}
+
+// spInfoMap holds every resolved miner by peer ID, for writing once all are
+// looked up.
+type spInfoMap map[peer.ID]SPInfo
+
+func (m spInfoMap) put(spInfo SPInfo) error {
+	m[spInfo.PeerID] = spInfo
+	return nil
+}
+
+func (m spInfoMap) flush() error {
+	return nil
+}
+
+// populateCollector handles the result of each miner looked up by populate,
+// in stages: it records the result, skips it unless the filter keeps it,
+// writes it with the writer, if not nil, and puts each resolved miner in the
+// sinks. After a write error, results are still recorded, so that the lookups
+// can finish, but no more are written.
+type populateCollector struct {
+	filter       *populateFilter
+	writer       resultWriter
+	sinks        []populateSink
+	diff         *populateDiff
+	resume       *checkpoint
+	lookupErrors *errorCollector
+	prog         *progress
+	stats        *summary
+	log          *logger
+
+	processed int64
+	// failed is the number of miners that could not be looked up, not
+	// counting those that have no peer ID.
+	failed int
+	// done is the miner of the previous result, if it has been looked up.
+	// It is recorded in the checkpoint once its result has been handled,
+	// unless writing failed.
+	done string
+	err  error
+}
+
+func newPopulateCollector(cfg populateConfig, log *logger, prog *progress, stats *summary) *populateCollector {
+	return &populateCollector{
+		filter:       cfg.filter,
+		writer:       cfg.writer,
+		sinks:        cfg.sinks,
+		diff:         cfg.diff,
+		resume:       cfg.resume,
+		lookupErrors: cfg.lookupErrors,
+		prog:         prog,
+		stats:        stats,
+		log:          log,
+	}
+}
+
+func (c *populateCollector) collect(result peerIDResult) {
+	if c.resume != nil && c.done != "" && c.err == nil {
+		c.err = c.resume.add(c.done)
+	}
+	c.done = ""
+	if result.err == nil || errors.Is(result.err, spidresolver.ErrNoPeerID) {
+		c.done = result.minerID
+	}
+	c.record(result)
+	if !c.filter.keep(result, c.log) || c.err != nil {
+		return
+	}
+	c.err = c.write(result)
+}
+
+// record counts the result, and compares it with the previous run. Every
+// lookup is recorded, including those that are not written.
+func (c *populateCollector) record(result peerIDResult) {
+	c.processed++
+	c.prog.record(result.err)
+	c.stats.record(result.err)
+	if result.err != nil {
+		c.lookupErrors.add(result.err)
+		// A miner that has no peer ID was looked up.
+		if !errors.Is(result.err, spidresolver.ErrNoPeerID) {
+			c.failed++
+		}
+	}
+	if c.diff != nil {
+		c.diff.record(result)
+	}
+}
+
+// write writes the result, and puts the miner in each sink if it was
+// resolved.
+func (c *populateCollector) write(result peerIDResult) error {
+	if c.writer != nil {
+		if err := c.writer.write(result); err != nil {
+			return err
+		}
+	}
+	if result.err != nil {
+		return nil
+	}
+	spInfo := SPInfo{
+		PeerID: result.addrInfo.ID,
+		SPID:   result.minerID,
+		Addrs:  result.addrInfo.Addrs,
+	}
+	for _, sink := range c.sinks {
+		if err := sink.put(spInfo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish records the last miner in the checkpoint and saves it, and then
+// flushes the writer and the sinks. It returns the first error from writing
+// the results.
+func (c *populateCollector) finish() error {
+	if c.resume != nil {
+		if c.done != "" && c.err == nil {
+			c.err = c.resume.add(c.done)
+		}
+		// Saved even after a write error, with the miners written before it.
+		if err := c.resume.save(); c.err == nil {
+			c.err = err
+		}
+	}
+	if c.err != nil {
+		return c.err
+	}
+	if c.writer != nil {
+		if err := c.writer.flush(); err != nil {
+			return err
+		}
+	}
+	for _, sink := range c.sinks {
+		if err := sink.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// failSink is a sink whose puts fail.
+type failSink struct {
+	err error
+}
+
+func (s failSink) put(spInfo SPInfo) error {
+	return s.err
+}
+
+func (s failSink) flush() error {
+	return nil
+}
+
+func TestPopulateFilter(t *testing.T) {
+	addr := multiaddr.StringCast("/ip4/1.2.3.4/tcp/1234")
+	resolved := peerIDResult{minerID: "f01000", addrInfo: peer.AddrInfo{ID: testPeerID(t, "a"), Addrs: []multiaddr.Multiaddr{addr}}}
+	noAddrs := peerIDResult{minerID: "f01001", addrInfo: peer.AddrInfo{ID: testPeerID(t, "b")}}
+	noPeerID := peerIDResult{minerID: "f01002", err: spidresolver.ErrNoPeerID}
+	lowPower := peerIDResult{minerID: "f01003", belowMinPower: true}
+	failed := peerIDResult{minerID: "f01004", err: errors.New("lookup failed")}
+
+	tests := []struct {
+		name   string
+		filter populateFilter
+		want   []bool
+	}{
+		{"default", populateFilter{}, []bool{true, true, false, false, true}},
+		{"only with addrs", populateFilter{onlyWithAddrs: true}, []bool{true, false, false, false, true}},
+		{"include no peer ID", populateFilter{includeNoPeerID: true}, []bool{true, true, true, false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, result := range []peerIDResult{resolved, noAddrs, noPeerID, lowPower, failed} {
+				if got := tt.filter.keep(result, nil); got != tt.want[i] {
+					t.Errorf("keep(%s) = %t, want %t", result.minerID, got, tt.want[i])
+				}
+			}
+			if tt.filter.lowPower != 1 {
+				t.Errorf("counted %d miners with low power, want 1", tt.filter.lowPower)
+			}
+		})
+	}
+}
+
+func TestPopulateCollector(t *testing.T) {
+	resume, err := loadCheckpoint(filepath.Join(t.TempDir(), "checkpoint"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	minPower := big.NewInt(1)
+	collected := make(spInfoMap)
+	cfg := populateConfig{
+		filter: &populateFilter{minPower: &minPower},
+		sinks:  []populateSink{collected},
+		resume: resume,
+	}
+	stats := &summary{}
+	c := newPopulateCollector(cfg, nil, nil, stats)
+	peerA := testPeerID(t, "a")
+	c.collect(peerIDResult{minerID: "f01000", addrInfo: peer.AddrInfo{ID: peerA}})
+	c.collect(peerIDResult{minerID: "f01001", belowMinPower: true})
+	c.collect(peerIDResult{minerID: "f01002", err: spidresolver.ErrNoPeerID})
+	c.collect(peerIDResult{minerID: "f01003", err: errors.New("lookup failed")})
+	if err = c.finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.processed != 4 || c.failed != 1 {
+		t.Errorf("processed %d and failed %d, want 4 and 1", c.processed, c.failed)
+	}
+	if len(collected) != 1 || collected[peerA].SPID != "f01000" {
+		t.Errorf("collected %v, want only f01000", collected)
+	}
+	if c.filter.lowPower != 1 {
+		t.Errorf("filtered %d miners with low power, want 1", c.filter.lowPower)
+	}
+	for _, minerID := range []string{"f01000", "f01001", "f01002"} {
+		if _, ok := resume.added[minerID]; !ok {
+			t.Errorf("%s not in checkpoint", minerID)
+		}
+	}
+	if _, ok := resume.added["f01003"]; ok {
+		t.Error("failed miner in checkpoint")
+	}
+}
+
+func TestPopulateCollectorWriteError(t *testing.T) {
+	resume, err := loadCheckpoint(filepath.Join(t.TempDir(), "checkpoint"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	putErr := errors.New("put failed")
+	cfg := populateConfig{
+		filter: &populateFilter{},
+		sinks:  []populateSink{failSink{err: putErr}},
+		resume: resume,
+	}
+	c := newPopulateCollector(cfg, nil, nil, &summary{})
+	c.collect(peerIDResult{minerID: "f01000", addrInfo: peer.AddrInfo{ID: testPeerID(t, "a")}})
+	c.collect(peerIDResult{minerID: "f01001", addrInfo: peer.AddrInfo{ID: testPeerID(t, "b")}})
+	if err = c.finish(); !errors.Is(err, putErr) {
+		t.Errorf("err = %v, want put error", err)
+	}
+	// Lookups are still recorded after a write error.
+	if c.processed != 2 {
+		t.Errorf("processed %d, want 2", c.processed)
+	}
+	if len(resume.added) != 0 {
+		t.Errorf("checkpoint has %d miners, want none after the write error", len(resume.added))
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// configFlag is the name of the flag that gives the config file.
+const configFlag = "config"
+
+// The config file supplies default values for the flags of the subcommands.
+// It is in TOML: each key is a flag name and the value is a string, number,
+// boolean, or array of strings. Keys before any [section] header apply to
+// every subcommand that has the flag. Keys in a [section] named for a
+// subcommand, such as [find], apply only to that subcommand. For example:
+//
+//	gateway = "api.node.glif.io"
+//	timeout = "1m"
+//
+//	[populate]
+//	concurrency = 50
+//
+// A flag value is taken from the first of these that sets it:
+//
+//  1. The command line flag.
+//  2. The FULLNODE_API_INFO environment variable, for --gateway and --token.
+//  3. The config file.
+//  4. The built-in default.
+
+// parseArgs parses the command line arguments of a subcommand, after setting
+// flag defaults from the config file. The config file is given by the
+// --config flag, or is in the default location if that exists.
+func parseArgs(flags *flag.FlagSet, args []string) error {
+	addConfigFlag(flags)
+
+	path, explicit := configPathFromArgs(flags, args)
+	if !explicit {
+		path = defaultConfigPath()
+	}
+	if path != "" {
+		err := applyConfig(flags, path)
+		if err != nil && (explicit || !errors.Is(err, fs.ErrNotExist)) {
+			return err
+		}
+	}
+	return flags.Parse(args)
+}
+
+// addConfigFlag adds the --config flag, which is parsed by parseArgs, to
+// flags.
+func addConfigFlag(flags *flag.FlagSet) {
+	flags.String(configFlag, "", "Config file that supplies flag defaults. Defaults to $XDG_CONFIG_HOME/spidtoaddrinfo/config.toml")
+}
+
+// configPathFromArgs finds the value of the --config flag in args, which have
+// not been parsed yet. The values of other flags in args are skipped, so that
+// --config may come after them.
+func configPathFromArgs(flags *flag.FlagSet, args []string) (string, bool) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if name == configFlag {
+			if hasValue {
+				return value, true
+			}
+			if i+1 < len(args) {
+				return args[i+1], true
+			}
+			return "", false
+		}
+		if hasValue {
+			continue
+		}
+		// A flag that is not boolean takes the next argument as its value.
+		if f := flags.Lookup(name); f != nil && !isBoolFlag(f) {
+			i++
+		}
+	}
+	return "", false
+}
+
+// isBoolFlag returns true if the flag does not take a value argument.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// defaultConfigPath returns the config file path in the user's config
+// directory, or "" if there is no config directory.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "spidtoaddrinfo", "config.toml")
+}
+
+// applyConfig sets the flags to the values in the config file.
+func applyConfig(flags *flag.FlagSet, path string) error {
+	var config map[string]interface{}
+	if _, err := toml.DecodeFile(path, &config); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	// Keys outside a section are shared by subcommands that may not all have
+	// the flag, so keys without a flag are ignored.
+	shared := make(map[string]interface{}, len(config))
+	for key, value := range config {
+		if _, isSection := value.(map[string]interface{}); !isSection {
+			shared[key] = value
+		}
+	}
+	if err := setConfigFlags(flags, path, "", shared); err != nil {
+		return err
+	}
+	section, _ := config[flags.Name()].(map[string]interface{})
+	return setConfigFlags(flags, path, flags.Name(), section)
+}
+
+// setConfigFlags sets the flags to the values of one section of the config
+// file, or of the keys outside any section if section is "".
+func setConfigFlags(flags *flag.FlagSet, path, section string, values map[string]interface{}) error {
+	// FULLNODE_API_INFO takes precedence over the config file.
+	envToken, envGateway, _ := parseAPIInfo(os.Getenv(apiInfoEnv))
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if key == configFlag || (key == "token" && envToken != "") || (key == "gateway" && envGateway != "") {
+			continue
+		}
+		if flags.Lookup(key) == nil {
+			if section == "" {
+				continue
+			}
+			return fmt.Errorf("%s: %s has no flag %q", path, section, key)
+		}
+		value, err := configValueString(values[key])
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+		if err = flags.Set(key, value); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+		if list, ok := flags.Lookup(key).Value.(*stringList); ok {
+			list.fromConfig = true
+		}
+	}
+	return nil
+}
+
+// configValueString converts a decoded config value into the form accepted by
+// a flag. An array is returned as a comma-separated list.
+func configValueString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case []interface{}:
+		elems := make([]string, 0, len(v))
+		for _, elem := range v {
+			s, err := configValueString(elem)
+			if err != nil {
+				return "", err
+			}
+			elems = append(elems, s)
+		}
+		return strings.Join(elems, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value type %T", value)
+}
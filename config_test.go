@@ -0,0 +1,179 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testConfig = `# Shared by all subcommands.
+gateway = "config.example.com"
+timeout = "1m" # trailing comment
+unknown = true
+
+[find]
+concurrency = 50
+json = true
+protocol = ["/a/1", "/b/1"]
+
+[populate]
+concurrency = 5
+`
+
+type testFlags struct {
+	set         *flag.FlagSet
+	gateway     *string
+	timeout     *string
+	concurrency *int
+	json        *bool
+	protocols   *stringList
+}
+
+func newTestFlags(name string) *testFlags {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	f := &testFlags{
+		set:         fs,
+		gateway:     fs.String("gateway", "default.example.com", ""),
+		timeout:     fs.String("timeout", "30s", ""),
+		concurrency: fs.Int("concurrency", 1, ""),
+		json:        fs.Bool("json", false, ""),
+		protocols:   &stringList{},
+	}
+	fs.Var(f.protocols, "protocol", "")
+	return f
+}
+
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigPathFromArgs(t *testing.T) {
+	fs := newTestFlags("find").set
+	fs.String(configFlag, "", "")
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"first", []string{"--config", "a.toml", "--json"}, "a.toml"},
+		{"with equals", []string{"-config=a.toml"}, "a.toml"},
+		{"after bool flag", []string{"--json", "--config", "a.toml"}, "a.toml"},
+		{"after flag value", []string{"--concurrency", "5", "--config", "a.toml"}, "a.toml"},
+		{"after flag with equals", []string{"--timeout=1m", "--config", "a.toml"}, "a.toml"},
+		{"after unknown flag", []string{"--other", "--config", "a.toml"}, "a.toml"},
+		{"value named config", []string{"--gateway", "--config", "--json"}, ""},
+		{"after argument", []string{"--json", "f01234", "--config", "a.toml"}, ""},
+		{"after terminator", []string{"--", "--config", "a.toml"}, ""},
+		{"missing value", []string{"--config"}, ""},
+		{"none", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, explicit := configPathFromArgs(fs, tt.args)
+			if got != tt.want || explicit != (tt.want != "") {
+				t.Errorf("got (%q, %t), want %q", got, explicit, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseArgsConfig(t *testing.T) {
+	t.Setenv(apiInfoEnv, "")
+	path := writeTestConfig(t, testConfig)
+
+	f := newTestFlags("find")
+	err := parseArgs(f.set, []string{"--concurrency", "2", "--config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *f.gateway != "config.example.com" {
+		t.Errorf("gateway = %q, want value from config", *f.gateway)
+	}
+	if *f.timeout != "1m" {
+		t.Errorf("timeout = %q, want value from config", *f.timeout)
+	}
+	if *f.concurrency != 2 {
+		t.Errorf("concurrency = %d, want command line value 2", *f.concurrency)
+	}
+	if !*f.json {
+		t.Error("json not set from config")
+	}
+	if got := f.protocols.String(); got != "/a/1,/b/1" {
+		t.Errorf("protocol = %q, want value from config", got)
+	}
+
+	// A section applies only to its subcommand.
+	f = newTestFlags("populate")
+	if err = parseArgs(f.set, []string{"--config=" + path}); err != nil {
+		t.Fatal(err)
+	}
+	if *f.concurrency != 5 || *f.json {
+		t.Errorf("got concurrency %d and json %t, want populate section values", *f.concurrency, *f.json)
+	}
+}
+
+func TestParseArgsConfigPrecedence(t *testing.T) {
+	path := writeTestConfig(t, testConfig)
+
+	t.Setenv(apiInfoEnv, "")
+	f := newTestFlags("find")
+	err := parseArgs(f.set, []string{"--config", path, "--gateway", "flag.example.com", "--protocol", "/c/1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *f.gateway != "flag.example.com" {
+		t.Errorf("gateway = %q, want command line value", *f.gateway)
+	}
+	if got := f.protocols.String(); got != "/c/1" {
+		t.Errorf("protocol = %q, want command line value to replace config", got)
+	}
+
+	t.Setenv(apiInfoEnv, "token:/dns/env.example.com/tcp/1234/http")
+	f = newTestFlags("find")
+	if err = parseArgs(f.set, []string{"--config", path}); err != nil {
+		t.Fatal(err)
+	}
+	if *f.gateway != "default.example.com" {
+		t.Errorf("gateway = %q, want config value ignored when %s is set", *f.gateway, apiInfoEnv)
+	}
+}
+
+func TestParseArgsConfigErrors(t *testing.T) {
+	t.Setenv(apiInfoEnv, "")
+
+	tests := []struct {
+		name    string
+		content string
+		errText string
+	}{
+		{"syntax", "gateway = \n", "line 2"},
+		{"unterminated string", "gateway = \"x\n", "line 1"},
+		{"unknown flag in section", "[find]\nnope = 1\n", `find has no flag "nope"`},
+		{"invalid flag value", "[find]\nconcurrency = \"many\"\n", "concurrency"},
+		{"unsupported type", "[find]\ntimeout = 1979-05-27\n", "unsupported value type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestConfig(t, tt.content)
+			err := parseArgs(newTestFlags("find").set, []string{"--config", path})
+			if err == nil || !strings.Contains(err.Error(), tt.errText) {
+				t.Errorf("err = %v, want error containing %q", err, tt.errText)
+			}
+		})
+	}
+
+	err := parseArgs(newTestFlags("find").set, []string{"--config", filepath.Join(t.TempDir(), "missing.toml")})
+	if err == nil {
+		t.Error("expected error for missing explicit config file")
+	}
+}
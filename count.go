@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// runCount runs the count subcommand, which has only the RPC flags.
+func runCount(ctx context.Context, f rpcFlags, args []string) error {
+	caller, err := f.newCaller()
+	if err != nil {
+		return err
+	}
+	defer caller.close()
+	return printParticipantCount(ctx, caller)
+}
+
+// printParticipantCount gets the storage market participants from the gateway
+// and prints only how many there are, so that it can be read by monitoring
+// scripts. The miners are not looked up.
+func printParticipantCount(ctx context.Context, caller *rpcCaller) error {
+	minerList, err := caller.marketParticipants(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Println(len(minerList))
+	return nil
+}
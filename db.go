@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// dbBatchSize is the number of records written per transaction.
+const dbBatchSize = 500
+
+const dbSchema = `CREATE TABLE IF NOT EXISTS miners (
+	miner_id   TEXT PRIMARY KEY,
+	peer_id    TEXT NOT NULL,
+	multiaddrs TEXT NOT NULL,
+	updated    TEXT NOT NULL
+)`
+
+const dbUpsert = `INSERT INTO miners (miner_id, peer_id, multiaddrs, updated)
+VALUES (?, ?, ?, ?)
+ON CONFLICT (miner_id) DO UPDATE SET
+	peer_id = excluded.peer_id,
+	multiaddrs = excluded.multiaddrs,
+	updated = excluded.updated`
+
+// resultDB stores populate results in a SQLite database, with one row per
+// miner. Records are buffered, and written in batches of dbBatchSize, each in
+// its own transaction.
+type resultDB struct {
+	db *sql.DB
+	// updated is the time recorded in every row written, so that the rows
+	// from one run form a snapshot.
+	updated string
+	batch   []SPInfo
+	// written is the number of records written to the database.
+	written int
+}
+
+// openResultDB opens the SQLite database at path, creating it and its schema
+// if they do not exist.
+func openResultDB(path string) (*resultDB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open database %s: %w", path, err)
+	}
+	if _, err = db.Exec(dbSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot create schema in database %s: %w", path, err)
+	}
+	return &resultDB{
+		db:      db,
+		updated: time.Now().UTC().Format(time.RFC3339),
+		batch:   make([]SPInfo, 0, dbBatchSize),
+	}, nil
+}
+
+// put adds spInfo to the current batch, and writes the batch if it is full.
+func (r *resultDB) put(spInfo SPInfo) error {
+	r.batch = append(r.batch, spInfo)
+	if len(r.batch) < dbBatchSize {
+		return nil
+	}
+	return r.flush()
+}
+
+// flush writes the current batch. The batch is written even if the run was
+// interrupted, so it does not take a context.
+func (r *resultDB) flush() error {
+	if len(r.batch) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, dbUpsert)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, spInfo := range r.batch {
+		addrs := make([]string, len(spInfo.Addrs))
+		for i, a := range spInfo.Addrs {
+			addrs[i] = a.String()
+		}
+		addrsJSON, err := json.Marshal(addrs)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err = stmt.ExecContext(ctx, spInfo.SPID, spInfo.PeerID.String(), string(addrsJSON), r.updated); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("cannot write miner %s to database: %w", spInfo.SPID, err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	r.written += len(r.batch)
+	r.batch = r.batch[:0]
+	return nil
+}
+
+func (r *resultDB) close() error {
+	return r.db.Close()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/multiformats/go-multiaddr"
+)
+
+func countMiners(t *testing.T, r *resultDB) int {
+	t.Helper()
+	var n int
+	if err := r.db.QueryRow("SELECT COUNT(*) FROM miners").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestResultDBBatch(t *testing.T) {
+	r, err := openResultDB(filepath.Join(t.TempDir(), "miners.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+
+	peerID := testPeerID(t, "a")
+	for i := 0; i < dbBatchSize-1; i++ {
+		if err = r.put(SPInfo{SPID: fmt.Sprintf("f0%d", 1000+i), PeerID: peerID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := countMiners(t, r); n != 0 || r.written != 0 {
+		t.Fatalf("got %d rows and %d written before the batch is full, want none", n, r.written)
+	}
+
+	// The record that fills the batch writes it.
+	if err = r.put(SPInfo{SPID: "f09999", PeerID: peerID}); err != nil {
+		t.Fatal(err)
+	}
+	if n := countMiners(t, r); n != dbBatchSize || r.written != dbBatchSize {
+		t.Fatalf("got %d rows and %d written, want %d", n, r.written, dbBatchSize)
+	}
+	if len(r.batch) != 0 {
+		t.Errorf("%d records left in batch after writing it", len(r.batch))
+	}
+
+	if err = r.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if r.written != dbBatchSize {
+		t.Errorf("flushing an empty batch changed written to %d", r.written)
+	}
+}
+
+func TestResultDBUpsert(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "miners.db")
+	addr, err := multiaddr.NewMultiaddr("/ip4/10.0.0.1/tcp/1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPeer := testPeerID(t, "old")
+	newPeer := testPeerID(t, "new")
+
+	tests := []struct {
+		name  string
+		infos []SPInfo
+	}{
+		{"insert", []SPInfo{
+			{SPID: "f01000", PeerID: oldPeer},
+			{SPID: "f01001", PeerID: oldPeer},
+		}},
+		{"update", []SPInfo{
+			{SPID: "f01000", PeerID: newPeer, Addrs: []multiaddr.Multiaddr{addr}},
+		}},
+	}
+	// Each run reopens the database, as a later populate run does.
+	for _, tt := range tests {
+		r, err := openResultDB(path)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for _, info := range tt.infos {
+			if err = r.put(info); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		if err = r.flush(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err = r.close(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+	}
+
+	r, err := openResultDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+	want := map[string][2]string{
+		"f01000": {newPeer.String(), `["/ip4/10.0.0.1/tcp/1234"]`},
+		"f01001": {oldPeer.String(), `[]`},
+	}
+	rows, err := r.db.Query("SELECT miner_id, peer_id, multiaddrs FROM miners")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := make(map[string][2]string)
+	for rows.Next() {
+		var minerID, peerID, addrs string
+		if err = rows.Scan(&minerID, &peerID, &addrs); err != nil {
+			t.Fatal(err)
+		}
+		got[minerID] = [2]string{peerID, addrs}
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(got), len(want))
+	}
+	for minerID, w := range want {
+		if got[minerID] != w {
+			t.Errorf("miner %s: got %v, want %v", minerID, got[minerID], w)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// dialFlags holds the flags of the dial subcommand.
+type dialFlags struct {
+	rpc     rpcFlags
+	spId    *string
+	timeout *time.Duration
+}
+
+func addDialFlags(fs *flag.FlagSet) *dialFlags {
+	return &dialFlags{
+		spId:    fs.String("storage_provider_id", "", "storage provider ID to dial (Required)"),
+		rpc:     addRPCFlags(fs),
+		timeout: fs.Duration("dial-timeout", defaultProbeTimeout, "Time allowed for connecting to the storage provider"),
+	}
+}
+
+// runDial runs the dial subcommand, dialing the storage provider given by
+// flag or as the only argument.
+func runDial(ctx context.Context, f *dialFlags, args []string) error {
+	spid := *f.spId
+	if spid == "" && len(args) == 1 {
+		spid = args[0]
+	}
+	if spid == "" {
+		return errUsage
+	}
+	caller, err := f.rpc.newCaller()
+	if err != nil {
+		return err
+	}
+	defer caller.close()
+	return dialProvider(ctx, caller, spid, *f.timeout)
+}
+
+// dialProvider looks up the addresses of the storage provider, and connects
+// to it with a libp2p host. It reports the address that was connected to,
+// and the agent version and protocols that the peer sent in the identify
+// exchange.
+func dialProvider(ctx context.Context, caller *rpcCaller, spid string, timeout time.Duration) error {
+	addrInfo, err := lookupMinerAddrInfo(ctx, spid, caller, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Println("PeerID:", addrInfo.ID)
+
+	h, err := newP2PHost(timeout)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	start := time.Now()
+	err = h.connect(ctx, addrInfo, func(context.Context) error {
+		elapsed := time.Since(start).Round(time.Millisecond)
+		for _, conn := range h.host.Network().ConnsToPeer(addrInfo.ID) {
+			fmt.Println("Connected:", conn.RemoteMultiaddr(), "in", elapsed)
+		}
+
+		if agent := h.agent(addrInfo.ID); agent.agentVersion != "" {
+			fmt.Println("Agent Version:", agent.agentVersion)
+		}
+		protocols, err := h.host.Peerstore().GetProtocols(addrInfo.ID)
+		if err != nil {
+			return err
+		}
+		sort.Slice(protocols, func(i, j int) bool {
+			return protocols[i] < protocols[j]
+		})
+		fmt.Println("Protocols:")
+		for _, p := range protocols {
+			fmt.Println("  ", p)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot connect to storage provider %s: %w", spid, err)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// populateDiff compares the peer IDs found by populate with those in a
+// snapshot written by a previous run of populate --format ndjson.
+type populateDiff struct {
+	// snapshot is the path of the previous results.
+	snapshot string
+	// previous has the peer ID of each miner in the snapshot that had one.
+	previous map[string]peer.ID
+	// current has the peer ID of each miner found by this run.
+	current map[string]peer.ID
+	// failed has the miners whose lookup failed in this run. They are not
+	// reported as removed, since their peer ID is not known.
+	failed map[string]struct{}
+	// out is where the changes are written, as JSON if asJSON is set.
+	out    io.Writer
+	asJSON bool
+}
+
+// newPopulateDiff reads the snapshot of previous populate results, so that
+// an unreadable snapshot is reported before any miners are looked up.
+func newPopulateDiff(snapshot string) (*populateDiff, error) {
+	previous, err := readPopulateSnapshot(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return &populateDiff{
+		snapshot: snapshot,
+		previous: previous,
+		current:  make(map[string]peer.ID),
+		failed:   make(map[string]struct{}),
+	}, nil
+}
+
+// readPopulateSnapshot reads the peer ID of each miner from a file written by
+// populate --format ndjson. Miners that had no peer ID, or whose lookup
+// failed, are skipped.
+func readPopulateSnapshot(path string) (map[string]peer.ID, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	peers := make(map[string]peer.ID)
+	scanner := bufio.NewScanner(f)
+	// A record with many addresses can be longer than the default limit.
+	scanner.Buffer(nil, 1<<20)
+	var line int
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec peerIDRecord
+		if err = json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		if rec.Miner == "" {
+			return nil, fmt.Errorf("%s line %d: missing miner ID", path, line)
+		}
+		if rec.PeerID == "" {
+			continue
+		}
+		peerID, err := peer.Decode(rec.PeerID)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid peer ID: %w", path, line, err)
+		}
+		peers[rec.Miner] = peerID
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// record adds the result of looking up one miner in this run.
+func (d *populateDiff) record(result peerIDResult) {
+	switch {
+	case result.err == nil:
+		d.current[result.minerID] = result.addrInfo.ID
+	case !errors.Is(result.err, spidresolver.ErrNoPeerID):
+		d.failed[result.minerID] = struct{}{}
+	}
+}
+
+// peerChange is a miner whose peer ID was added, removed, or changed. Old is
+// empty for an added miner, and New for a removed one.
+type peerChange struct {
+	Miner string `json:"miner"`
+	Old   string `json:"oldPeerId,omitempty"`
+	New   string `json:"newPeerId,omitempty"`
+}
+
+// peerChanges is the JSON form of the differences between two populate runs.
+type peerChanges struct {
+	Added   []peerChange `json:"added"`
+	Removed []peerChange `json:"removed"`
+	Changed []peerChange `json:"changed"`
+}
+
+// changes returns the miners that have a peer ID now but did not in the
+// snapshot, that had one in the snapshot but do not now, and whose peer ID is
+// different, each ordered by miner ID.
+func (d *populateDiff) changes(formatPeerID peerIDFormat) peerChanges {
+	out := peerChanges{
+		Added:   []peerChange{},
+		Removed: []peerChange{},
+		Changed: []peerChange{},
+	}
+	for minerID, peerID := range d.current {
+		old, ok := d.previous[minerID]
+		switch {
+		case !ok:
+			out.Added = append(out.Added, peerChange{Miner: minerID, New: formatPeerID(peerID)})
+		case old != peerID:
+			out.Changed = append(out.Changed, peerChange{Miner: minerID, Old: formatPeerID(old), New: formatPeerID(peerID)})
+		}
+	}
+	for minerID, old := range d.previous {
+		if _, ok := d.current[minerID]; ok {
+			continue
+		}
+		if _, ok := d.failed[minerID]; ok {
+			continue
+		}
+		out.Removed = append(out.Removed, peerChange{Miner: minerID, Old: formatPeerID(old)})
+	}
+	for _, list := range [][]peerChange{out.Added, out.Removed, out.Changed} {
+		sort.Slice(list, func(i, j int) bool {
+			return lessMinerID(list[i].Miner, list[j].Miner)
+		})
+	}
+	return out
+}
+
+// write writes the changes since the snapshot to d.out, as text grouped into
+// added, removed, and changed miners, or, if d.asJSON is set, as one JSON
+// object.
+func (d *populateDiff) write(formatPeerID peerIDFormat) error {
+	changes := d.changes(formatPeerID)
+	if d.asJSON {
+		return json.NewEncoder(d.out).Encode(&changes)
+	}
+
+	bw := bufio.NewWriter(d.out)
+	fmt.Fprintln(bw, "Changes since", d.snapshot+":")
+	fmt.Fprintln(bw, "Added:", len(changes.Added))
+	for _, c := range changes.Added {
+		fmt.Fprintln(bw, " ", c.Miner, c.New)
+	}
+	fmt.Fprintln(bw, "Removed:", len(changes.Removed))
+	for _, c := range changes.Removed {
+		fmt.Fprintln(bw, " ", c.Miner, c.Old)
+	}
+	fmt.Fprintln(bw, "Changed:", len(changes.Changed))
+	for _, c := range changes.Changed {
+		fmt.Fprintln(bw, " ", c.Miner, c.Old, "->", c.New)
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+func testPeerID(t *testing.T, name string) peer.ID {
+	t.Helper()
+	h, err := multihash.Sum([]byte(name), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return peer.ID(h)
+}
+
+func TestPopulateDiff(t *testing.T) {
+	peerA := testPeerID(t, "a")
+	peerB := testPeerID(t, "b")
+	found := func(minerID string, peerID peer.ID) peerIDResult {
+		return peerIDResult{minerID: minerID, addrInfo: peer.AddrInfo{ID: peerID}}
+	}
+	failed := func(minerID string, err error) peerIDResult {
+		return peerIDResult{minerID: minerID, err: err}
+	}
+	snapshotLine := func(minerID string, peerID peer.ID) string {
+		return `{"miner":"` + minerID + `","peerId":"` + peerID.String() + `"}`
+	}
+
+	tests := []struct {
+		name     string
+		snapshot []string
+		results  []peerIDResult
+		want     peerChanges
+	}{
+		{
+			name:     "added",
+			snapshot: []string{`{"miner":"f01000","noPeerId":true}`},
+			results:  []peerIDResult{found("f01000", peerA), found("f0900", peerB)},
+			want: peerChanges{
+				Added: []peerChange{
+					{Miner: "f0900", New: peerB.String()},
+					{Miner: "f01000", New: peerA.String()},
+				},
+			},
+		},
+		{
+			name:     "removed",
+			snapshot: []string{snapshotLine("f01000", peerA), snapshotLine("f01001", peerB)},
+			results:  []peerIDResult{failed("f01000", spidresolver.ErrNoPeerID)},
+			want: peerChanges{
+				Removed: []peerChange{
+					{Miner: "f01000", Old: peerA.String()},
+					{Miner: "f01001", Old: peerB.String()},
+				},
+			},
+		},
+		{
+			name:     "changed",
+			snapshot: []string{snapshotLine("f01000", peerA), snapshotLine("f01001", peerB)},
+			results:  []peerIDResult{found("f01000", peerB), found("f01001", peerB)},
+			want: peerChanges{
+				Changed: []peerChange{{Miner: "f01000", Old: peerA.String(), New: peerB.String()}},
+			},
+		},
+		{
+			name:     "failed lookup not removed",
+			snapshot: []string{snapshotLine("f01000", peerA), ""},
+			results:  []peerIDResult{failed("f01000", errors.New("timeout"))},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "snapshot.ndjson")
+			if err := os.WriteFile(path, []byte(strings.Join(tt.snapshot, "\n")+"\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			d, err := newPopulateDiff(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, result := range tt.results {
+				d.record(result)
+			}
+
+			got := d.changes(peer.ID.String)
+			for _, list := range []*[]peerChange{&tt.want.Added, &tt.want.Removed, &tt.want.Changed} {
+				if *list == nil {
+					*list = []peerChange{}
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadPopulateSnapshotErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		errText string
+	}{
+		{"not json", "{\n", "line 1"},
+		{"missing miner", `{"peerId":"x"}`, "missing miner ID"},
+		{"bad peer ID", `{"miner":"f01000","peerId":"x"}`, "invalid peer ID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "snapshot.ndjson")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := newPopulateDiff(path)
+			if err == nil || !strings.Contains(err.Error(), tt.errText) {
+				t.Errorf("err = %v, want error containing %q", err, tt.errText)
+			}
+		})
+	}
+}
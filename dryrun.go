@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+)
+
+// dryRunFlags holds the flags that make populate and query-asks only report
+// the miners they would query, without making any per-miner calls.
+type dryRunFlags struct {
+	enabled *bool
+	listIDs *bool
+}
+
+func addDryRunFlags(fs *flag.FlagSet) dryRunFlags {
+	return dryRunFlags{
+		enabled: fs.Bool("dry-run", false, "Only get the list of miners and print how many would be queried, without querying any of them"),
+		listIDs: fs.Bool("list-ids", false, "With --dry-run, also print the ID of each miner that would be queried, in order"),
+	}
+}
+
+func (f dryRunFlags) validate() error {
+	if *f.listIDs && !*f.enabled {
+		return errors.New("list-ids can only be used with dry-run")
+	}
+	return nil
+}
+
+// writeDryRun writes the number of miners in minerList to w, followed by
+// their IDs, one per line, if listIDs is set.
+func writeDryRun(w io.Writer, minerList map[string]spidresolver.MarketBalance, listIDs bool) error {
+	if _, err := fmt.Fprintln(w, "Miners to query:", len(minerList)); err != nil {
+		return err
+	}
+	if !listIDs {
+		return nil
+	}
+	minerIds := make([]string, 0, len(minerList))
+	for minerId := range minerList {
+		minerIds = append(minerIds, minerId)
+	}
+	sort.Slice(minerIds, func(i, j int) bool {
+		return lessMinerID(minerIds[i], minerIds[j])
+	})
+	for _, minerId := range minerIds {
+		if _, err := fmt.Fprintln(w, minerId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
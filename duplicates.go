@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// peerMiners groups the IDs of resolved miners by their peer ID, to find the
+// peers that serve more than one miner actor.
+type peerMiners map[peer.ID][]string
+
+func (pm peerMiners) add(peerID peer.ID, minerID string) {
+	pm[peerID] = append(pm[peerID], minerID)
+}
+
+// put adds the miner to the miners of its peer, so that peerMiners can be a
+// populateSink.
+func (pm peerMiners) put(spInfo SPInfo) error {
+	pm.add(spInfo.PeerID, spInfo.SPID)
+	return nil
+}
+
+func (pm peerMiners) flush() error {
+	return nil
+}
+
+// write writes each peer ID that is shared by more than one miner, followed
+// by the IDs of its miners. Peers with the most miners are written first.
+func (pm peerMiners) write(w io.Writer, formatPeerID peerIDFormat) error {
+	var shared []peer.ID
+	for peerID, minerIDs := range pm {
+		if len(minerIDs) < 2 {
+			continue
+		}
+		sort.Slice(minerIDs, func(i, j int) bool {
+			return lessMinerID(minerIDs[i], minerIDs[j])
+		})
+		shared = append(shared, peerID)
+	}
+	sort.Slice(shared, func(i, j int) bool {
+		a, b := pm[shared[i]], pm[shared[j]]
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return lessMinerID(a[0], b[0])
+	})
+
+	if _, err := fmt.Fprintln(w, "Peers shared by more than one miner:", len(shared)); err != nil {
+		return err
+	}
+	for _, peerID := range shared {
+		if _, err := fmt.Fprintf(w, "  %s -> %v\n", formatPeerID(peerID), pm[peerID]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+	jrpc "github.com/ybbus/jsonrpc/v2"
+)
+
+// Categories of the errors counted by errorCollector.
+const (
+	errCategoryNetwork  = "network"
+	errCategoryNoPeerID = "no-peer-id"
+	errCategoryRPC      = "rpc-actor-error"
+	errCategoryOther    = "other"
+)
+
+// maxErrorSamples is the number of errors of each category that are kept to
+// show in the error summary.
+const maxErrorSamples = 3
+
+// errorCategory returns the category of an error from looking up a miner. An
+// error returned by the gateway for the call, such as for an actor that does
+// not exist, is an RPC error. A network or server error, or a timed out call,
+// is a network error.
+func errorCategory(err error) string {
+	var rpcErr *jrpc.RPCError
+	var callErr *callError
+	switch {
+	case errors.Is(err, spidresolver.ErrNoPeerID):
+		return errCategoryNoPeerID
+	case errors.As(err, &rpcErr):
+		return errCategoryRPC
+	case errors.As(err, &callErr) && isTransient(err):
+		return errCategoryNetwork
+	}
+	return errCategoryOther
+}
+
+// errorCategoryCount is the number of errors in one category, and the first
+// few of them.
+type errorCategoryCount struct {
+	count   int
+	samples []string
+}
+
+// errorCollector counts the errors from looking up miners by category, and
+// keeps a sample of each, so that they can be summarized at the end of a run
+// instead of being printed as they happen. It is safe for concurrent use. A
+// nil errorCollector ignores errors.
+type errorCollector struct {
+	// verbose also prints every error, other than a miner having no peer
+	// ID, to stderr when it is added.
+	verbose bool
+
+	mu         sync.Mutex
+	categories map[string]*errorCategoryCount
+}
+
+func newErrorCollector(verbose bool) *errorCollector {
+	return &errorCollector{
+		verbose:    verbose,
+		categories: make(map[string]*errorCategoryCount),
+	}
+}
+
+// add counts the error in its category.
+func (c *errorCollector) add(err error) {
+	if c == nil {
+		return
+	}
+	category := errorCategory(err)
+	if c.verbose && category != errCategoryNoPeerID {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cc, ok := c.categories[category]
+	if !ok {
+		cc = &errorCategoryCount{}
+		c.categories[category] = cc
+	}
+	cc.count++
+	if len(cc.samples) < maxErrorSamples {
+		cc.samples = append(cc.samples, err.Error())
+	}
+}
+
+// write writes the number of errors in each category, most frequent first,
+// with the sample of each. Nothing is written if there were no errors.
+func (c *errorCollector) write(w io.Writer) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.categories) == 0 {
+		return
+	}
+	names := make([]string, 0, len(c.categories))
+	for name := range c.categories {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ci, cj := c.categories[names[i]], c.categories[names[j]]
+		if ci.count != cj.count {
+			return ci.count > cj.count
+		}
+		return names[i] < names[j]
+	})
+
+	fmt.Fprintln(w, "Errors by category:")
+	for _, name := range names {
+		cc := c.categories[name]
+		fmt.Fprintf(w, "  %s: %d\n", name, cc.count)
+		for _, sample := range cc.samples {
+			fmt.Fprintln(w, "    ", sample)
+		}
+	}
+	if !c.verbose {
+		fmt.Fprintln(w, "Use --verbose to print every error")
+	}
+}
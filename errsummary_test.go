@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+	jrpc "github.com/ybbus/jsonrpc/v2"
+)
+
+func TestErrorCategory(t *testing.T) {
+	rpcErr := &jrpc.RPCError{Code: 1, Message: "actor not found"}
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"no peer ID", fmt.Errorf("f01000: %w", spidresolver.ErrNoPeerID), errCategoryNoPeerID},
+		{"rpc error", &callError{err: rpcErr}, errCategoryRPC},
+		{"network error", &callError{err: errors.New("connection reset")}, errCategoryNetwork},
+		{"not from a call", errors.New("connection reset"), errCategoryOther},
+		{"decode error", &callError{err: &spidresolver.DecodeError{}}, errCategoryOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorCategory(tt.err); got != tt.want {
+				t.Errorf("errorCategory(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorCollector(t *testing.T) {
+	c := newErrorCollector(false)
+	for i := 0; i < 5; i++ {
+		c.add(fmt.Errorf("f0%d: %w", 1000+i, spidresolver.ErrNoPeerID))
+	}
+	for i := 0; i < 2; i++ {
+		c.add(&callError{err: fmt.Errorf("timeout %d", i)})
+	}
+	c.add(&callError{err: &jrpc.RPCError{Message: "actor not found"}})
+	c.add(errors.New("b"))
+
+	want := map[string]int{
+		errCategoryNoPeerID: 5,
+		errCategoryNetwork:  2,
+		errCategoryRPC:      1,
+		errCategoryOther:    1,
+	}
+	for name, count := range want {
+		cc := c.categories[name]
+		if cc == nil {
+			t.Errorf("no %s errors counted", name)
+			continue
+		}
+		if cc.count != count {
+			t.Errorf("%s: got count %d, want %d", name, cc.count, count)
+		}
+		if wantSamples := min(count, maxErrorSamples); len(cc.samples) != wantSamples {
+			t.Errorf("%s: got %d samples, want %d", name, len(cc.samples), wantSamples)
+		}
+	}
+
+	// Categories are most frequent first, and then by name.
+	var buf bytes.Buffer
+	c.write(&buf)
+	last := -1
+	for _, name := range []string{errCategoryNoPeerID, errCategoryNetwork, errCategoryOther, errCategoryRPC} {
+		i := strings.Index(buf.String(), fmt.Sprintf("\n  %s: %d\n", name, want[name]))
+		if i <= last {
+			t.Fatalf("%s count missing or out of order in summary:\n%s", name, buf.String())
+		}
+		last = i
+	}
+	if !strings.Contains(buf.String(), "--verbose") {
+		t.Error("summary does not mention --verbose")
+	}
+
+	var nilCollector *errorCollector
+	nilCollector.add(errors.New("ignored"))
+	buf.Reset()
+	nilCollector.write(&buf)
+	newErrorCollector(false).write(&buf)
+	if buf.Len() != 0 {
+		t.Errorf("got summary %q with no errors, want none", buf.String())
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+)
+
+// Exit codes returned by the find subcommand, so that scripts can tell the
+// kinds of failure apart:
+//
+//	0  success
+//	1  any other failure
+//	2  invalid input, such as a malformed storage provider ID or flag, or an
+//	   address that is not a storage miner
+//	3  RPC or network failure talking to the gateway
+//	4  the storage provider was looked up, but has no peer ID or addresses
+const (
+	exitFailure      = 1
+	exitInvalidInput = 2
+	exitRPCFailure   = 3
+	exitNotResolved  = 4
+)
+
+// findExitCodes describes the exit codes in the find usage message.
+const findExitCodes = `Exit codes:
+  0  success
+  1  any other failure
+  2  invalid input, such as a malformed storage provider ID or flag, or an
+     address that is not a storage miner
+  3  RPC or network failure talking to the gateway
+  4  the storage provider has no peer ID or addresses
+`
+
+// errNoAddrs is the error for a storage provider that has a peer ID but no
+// addresses.
+var errNoAddrs = errors.New("has no addresses")
+
+// exitError is an error that has a specific exit code.
+type exitError struct {
+	code int
+	err  error
+	// reported is set if the error has already been written, such as as a
+	// JSON error object, so that it is not written again.
+	reported bool
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// exitCode returns the exit code for err.
+func exitCode(err error) int {
+	var exitErr *exitError
+	var callErr *callError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitErr):
+		return exitErr.code
+	case errors.Is(err, spidresolver.ErrInvalidAddress), errors.Is(err, spidresolver.ErrNotMiner):
+		return exitInvalidInput
+	case errors.Is(err, spidresolver.ErrNoPeerID), errors.Is(err, errNoAddrs):
+		return exitNotResolved
+	case errors.Is(err, context.Canceled):
+		return exitFailure
+	case errors.As(err, &callErr), errors.Is(err, spidresolver.ErrEmptyTipSet), errors.Is(err, spidresolver.ErrNoTipSetAtHeight):
+		return exitRPCFailure
+	}
+	return exitFailure
+}
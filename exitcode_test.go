@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"success", nil, 0},
+		{"other", errors.New("failed"), exitFailure},
+		{"canceled", fmt.Errorf("lookup: %w", context.Canceled), exitFailure},
+		{"invalid address", fmt.Errorf("f0x: %w", spidresolver.ErrInvalidAddress), exitInvalidInput},
+		{"not a miner", spidresolver.ErrNotMiner, exitInvalidInput},
+		{"call failed", &callError{err: errors.New("connection refused")}, exitRPCFailure},
+		{"empty tipset", spidresolver.ErrEmptyTipSet, exitRPCFailure},
+		{"no tipset at height", spidresolver.ErrNoTipSetAtHeight, exitRPCFailure},
+		{"no peer ID", fmt.Errorf("f01000: %w", spidresolver.ErrNoPeerID), exitNotResolved},
+		{"no addresses", errNoAddrs, exitNotResolved},
+		{"exit error", &exitError{code: exitRPCFailure, err: spidresolver.ErrNoPeerID}, exitRPCFailure},
+		{"wrapped exit error", fmt.Errorf("find: %w", &exitError{code: exitInvalidInput, err: errors.New("bad")}), exitInvalidInput},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
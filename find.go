@@ -0,0 +1,1091 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"golang.org/x/sync/errgroup"
+)
+
+// findConfig holds the settings for the find subcommand.
+type findConfig struct {
+	// filters select which multiaddrs are shown.
+	filters []spidresolver.AddrFilter
+	// power enables looking up the storage provider's power.
+	power bool
+	// balance enables looking up the storage provider's available balance
+	// and storage market funds.
+	balance bool
+	// ipFilter, if not nil, is also in filters, and is applied again to the
+	// addresses found by resolving DNS multiaddrs.
+	ipFilter spidresolver.AddrFilter
+	// resolveDNS enables resolving DNS multiaddrs to IP addresses.
+	resolveDNS bool
+	// excludePrivate is set if spidresolver.NoPrivateAddr is in filters, so
+	// that it is also applied to the addresses found by resolving DNS
+	// multiaddrs.
+	excludePrivate bool
+	// atHeight, if not negative, is the epoch as of which the storage
+	// providers are looked up, instead of the chain head.
+	atHeight int64
+	// followHead is set if each storage provider is looked up as of the
+	// chain head returned by the caller when it is looked up, instead of as
+	// of the tipset given to findProvider.
+	followHead bool
+	// reportSkipped enables reporting the multiaddrs that could not be parsed.
+	reportSkipped bool
+	// raw enables printing the full miner info as JSON.
+	raw bool
+	// resolveAccounts enables looking up the ID and key address forms of the
+	// owner, worker, and control addresses.
+	resolveAccounts bool
+	// formatPeerID converts peer IDs to strings for output.
+	formatPeerID peerIDFormat
+	// marketParticipants enables getting the number of storage market
+	// participants, which is a large and slow RPC call.
+	marketParticipants bool
+	// peerstore, if not nil, receives the address info of each storage
+	// provider found.
+	peerstore *peerstoreWriter
+	// json enables writing each result as a line of JSON, instead of as text.
+	json bool
+	// fields, if not empty, are the only fields written in JSON output.
+	fields []string
+	// table, if not nil, receives each result as a row of a table, instead
+	// of as text.
+	table *tabwriter.Writer
+	// checkActor enables checking that each storage provider ID is the
+	// address of a storage miner actor before getting its miner info.
+	checkActor bool
+	// actorNames names the actor code CIDs when checking actors.
+	actorNames spidresolver.ActorNames
+	// concurrency is the number of storage providers to look up
+	// concurrently, when more than one is given.
+	concurrency int
+	// withP2P enables appending the /p2p component with the peer ID to each
+	// multiaddr shown.
+	withP2P bool
+	// groupByTransport enables including the multiaddrs grouped by transport
+	// in the JSON output.
+	groupByTransport bool
+	// geoip, if not nil, is used to annotate each multiaddr with the
+	// country of its IP address.
+	geoip *geoIPDB
+	// agent, if not nil, connects to each storage provider to get the agent
+	// and protocol versions of its peer.
+	agent *prober
+	// summary, if not nil, collects the outcome of each lookup, to write
+	// a summary of all of them after the results.
+	summary *findSummary
+}
+
+// findResult is what was found about one storage provider.
+type findResult struct {
+	spid     string
+	line     int
+	addrInfo peer.AddrInfo
+	power    *spidresolver.MinerPower
+	balance  *minerBalance
+	// hasAddrs is true if the storage provider has addresses, even if none
+	// of them are accepted by the filters.
+	hasAddrs bool
+	// relayOnly is true if all of the storage provider's addresses, before
+	// filtering, are p2p-circuit relay addresses.
+	relayOnly bool
+	// skipped describes the multiaddrs that could not be parsed, if reported.
+	skipped []error
+	// minerInfo is the full miner info, if requested.
+	minerInfo *spidresolver.MinerInfo
+	accounts  []spidresolver.Account
+	// countries has the country of each multiaddr, by multiaddr, if looked
+	// up.
+	countries map[string]string
+	// agent is what the peer reported in the identify exchange, if
+	// requested. It is nil if the peer was unreachable.
+	agent *peerAgent
+	err   error
+}
+
+// minerBalance is the balance of a storage provider, in attoFIL.
+type minerBalance struct {
+	// available is the balance of the miner actor that can be withdrawn.
+	available big.Int
+	// market is the escrow and locked funds in the storage market.
+	market spidresolver.MarketBalance
+}
+
+// rawMinerInfo is the JSON form of MinerInfo printed by find --raw. The
+// multiaddrs are shown as strings instead of base64 encoded bytes.
+type rawMinerInfo struct {
+	spidresolver.MinerInfo
+	Multiaddrs []string
+}
+
+func newRawMinerInfo(minerInfo spidresolver.MinerInfo) rawMinerInfo {
+	raw := rawMinerInfo{
+		MinerInfo:  minerInfo,
+		Multiaddrs: make([]string, len(minerInfo.Multiaddrs)),
+	}
+	for i, a := range minerInfo.Multiaddrs {
+		maddr, err := multiaddr.NewMultiaddrBytes(a)
+		if err != nil {
+			raw.Multiaddrs[i] = (&spidresolver.InvalidMultiaddrError{Raw: a, Err: err}).Error()
+			continue
+		}
+		raw.Multiaddrs[i] = maddr.String()
+	}
+	return raw
+}
+
+// lookupErr returns the lookup error prefixed with the storage provider ID,
+// and with the input line if the ID was read from a file.
+func (r findResult) lookupErr() error {
+	if r.line != 0 {
+		return fmt.Errorf("line %d: %s: %w", r.line, r.spid, r.err)
+	}
+	return fmt.Errorf("%s: %w", r.spid, r.err)
+}
+
+// singleErr returns the lookup error when only one storage provider is looked
+// up. The storage provider ID and line number are only added if the ID was
+// read from a file.
+func (r findResult) singleErr() error {
+	if r.line != 0 {
+		return r.lookupErr()
+	}
+	return r.err
+}
+
+// stringList is a flag.Value that collects the values of a repeated flag.
+type stringList struct {
+	values []string
+	// fromConfig is true if the values were set by the config file, and are
+	// replaced by any values given on the command line.
+	fromConfig bool
+}
+
+func (s *stringList) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(s.values, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	if s.fromConfig {
+		s.values = nil
+		s.fromConfig = false
+	}
+	s.values = append(s.values, value)
+	return nil
+}
+
+// splitList splits a comma-separated flag value into its elements, with
+// surrounding whitespace removed and empty elements skipped.
+func splitList(value string) []string {
+	var elems []string
+	for _, elem := range strings.Split(value, ",") {
+		elem = strings.TrimSpace(elem)
+		if elem != "" {
+			elems = append(elems, elem)
+		}
+	}
+	return elems
+}
+
+// providerID is a storage provider ID to look up, and the line of the input
+// file it was read from, or zero if it was not read from a file.
+type providerID struct {
+	spid string
+	line int
+}
+
+// readProviderIDs reads storage provider IDs, one per line, from the file at
+// path, or from stdin if path is "-". Blank lines and lines starting with "#"
+// are skipped.
+func readProviderIDs(path string) ([]providerID, error) {
+	var r io.Reader
+	if path == "-" {
+		r = os.Stdin
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var ids []providerID
+	scanner := bufio.NewScanner(r)
+	var line int
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		ids = append(ids, providerID{
+			spid: text,
+			line: line,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// findFlags holds the flags of the find subcommand.
+type findFlags struct {
+	rpc                 rpcFlags
+	cache               cacheFlags
+	spIds               *stringList
+	fromFile            *string
+	peerstore           *string
+	force               *bool
+	power               *bool
+	balance             *bool
+	resolveDNS          *bool
+	ipv4Only            *bool
+	ipv6Only            *bool
+	peerIDFormat        *string
+	marketParticipants  *bool
+	atHeight            *int64
+	excludePrivateAddrs *bool
+	noRelay             *bool
+	protocols           *string
+	reportSkipped       *bool
+	raw                 *bool
+	resolveAccounts     *bool
+	skipActorCheck      *bool
+	concurrency         *int
+	groupByTransport    *bool
+	geoIP               *string
+	agent               *bool
+	agentTimeout        *time.Duration
+	summary             *bool
+	withP2P             *bool
+	watch               *bool
+	watchInterval       *time.Duration
+	fields              *string
+	output              *string
+}
+
+func addFindFlags(fs *flag.FlagSet) *findFlags {
+	var spIds stringList
+	fs.Var(&spIds, "storage_provider_id", "Storage Provider ID (Required). May be repeated or comma-separated, or IDs may be given as arguments")
+	return &findFlags{
+		spIds:               &spIds,
+		fromFile:            fs.String("from-file", "", "Read storage provider IDs, one per line, from this file, or from stdin if \"-\""),
+		rpc:                 addRPCFlags(fs),
+		peerstore:           fs.String("peerstore", "", "Also write the resolved storage providers to this file, as a JSON array of libp2p peer address info"),
+		force:               fs.Bool("force", false, "Overwrite the --peerstore file if it already exists"),
+		power:               fs.Bool("power", false, "Show the raw byte power and quality-adjusted power of the storage provider"),
+		balance:             fs.Bool("balance", false, "Show the storage market escrow and locked funds, and the available balance, of the storage provider, in FIL"),
+		resolveDNS:          fs.Bool("resolve-dns", false, "Resolve DNS multiaddrs and show the resulting IP addresses along with the originals"),
+		ipv4Only:            fs.Bool("ipv4-only", false, "Only show IPv4 addresses, and addresses, such as /dns, that are not specific to an IP version"),
+		ipv6Only:            fs.Bool("ipv6-only", false, "Only show IPv6 addresses, and addresses, such as /dns, that are not specific to an IP version"),
+		peerIDFormat:        fs.String("peerid-format", "base58", "Peer ID output format: base58 or cidv1"),
+		marketParticipants:  fs.Bool("market-participants", false, "Also show the number of storage market participants. This is a large and slow RPC call"),
+		atHeight:            fs.Int64("at-height", -1, "Look up the storage providers as of this epoch, instead of the chain head. Not used if negative"),
+		excludePrivateAddrs: fs.Bool("exclude-private-addrs", false, "Do not show private, loopback, and link-local IP addresses, which cannot be reached from other networks, including those resolved from DNS addresses"),
+		noRelay:             fs.Bool("no-relay", false, "Do not show p2p-circuit relay addresses"),
+		protocols:           fs.String("protocols", "", "Comma-separated list of protocols, e.g. tcp,quic. Only addresses with one of these are shown"),
+		reportSkipped:       fs.Bool("report-skipped", false, "Report the storage provider's addresses that could not be parsed, in hex"),
+		raw:                 fs.Bool("raw", false, "Also print the full miner info as JSON, with multiaddrs decoded"),
+		resolveAccounts:     fs.Bool("resolve-accounts", false, "Show the ID and key addresses of the owner, worker, and control addresses"),
+		skipActorCheck:      fs.Bool("skip-actor-check", false, "Do not check that each storage provider ID is the address of a storage miner actor. This saves an RPC call per storage provider"),
+		concurrency:         fs.Int("concurrency", defaultConcurrency, "Number of storage providers to look up concurrently, when more than one is given. The results are printed in the order given"),
+		groupByTransport:    fs.Bool("group-by-transport", false, "Also write the addresses grouped by transport, as tcp, quic, websocket, webtransport, or other, in the addrsByTransport field. Only used with json output"),
+		geoIP: fs.String("geoip", "", "Show the country of each address, looked up in this MaxMind GeoIP2 or GeoLite2 country database file. "+
+			"DNS addresses are resolved first. Addresses whose country cannot be found are shown without one"),
+		agent: fs.Bool("agent", false, "Connect to the storage provider's peer with libp2p, and show the agent and protocol versions it reports in the identify exchange. "+
+			"A peer that cannot be connected to is shown as unreachable"),
+		agentTimeout: fs.Duration("agent-timeout", defaultProbeTimeout, "Time allowed for connecting to the peer and identifying it, with --agent"),
+		summary: fs.Bool("summary", false, "After the results, print a table of the storage providers, with whether each was resolved, its number of addresses, and, with --agent, whether its peer was reachable. "+
+			"Written as a line of JSON with json output"),
+		withP2P: fs.Bool("with-p2p", false, "Append /p2p/<peerID> to each address shown, unless it already ends with a p2p component. Not written to the peerstore file"),
+		watch: fs.Bool("watch", false, "Keep polling the chain head, and print a timestamped line for each change to the storage provider's miner info, such as a new peer ID or worker. "+
+			"Stops on interrupt. Only one storage provider can be watched"),
+		watchInterval: fs.Duration("watch-interval", defaultWatchInterval, "Time between polls of the chain head, with --watch"),
+		fields: fs.String("fields", "", "Comma-separated list of fields, e.g. peerId,addrs,sectorSize, that are the only ones written with json output. "+
+			"Selecting power, balance, accounts, agent, or skipped also looks them up"),
+		output: fs.String("output", "text", "Output format: text, json, or table. With json, each storage provider found is written as a line of JSON, and lookup errors are written to stdout as JSON error objects. "+
+			"With table, the storage provider, peer ID, and number of addresses are aligned in columns"),
+		cache: addCacheFlags(fs),
+	}
+}
+
+// invalidInput returns an error, formatted like fmt.Errorf, that makes find
+// exit with exitInvalidInput.
+func invalidInput(format string, a ...interface{}) error {
+	return &exitError{code: exitInvalidInput, err: fmt.Errorf(format, a...)}
+}
+
+// runFind runs the find subcommand, looking up the storage providers given by
+// flag, as args, or in a file. The error returned has the exit code for it.
+func runFind(ctx context.Context, f *findFlags, args []string) (err error) {
+	var cfg findConfig
+	var ids []providerID
+	defer func() {
+		var exitErr *exitError
+		if err == nil || errors.As(err, &exitErr) {
+			return
+		}
+		exitErr = &exitError{code: exitCode(err), err: err}
+		if cfg.json {
+			// Report the error as JSON, so that all of the output can be
+			// parsed.
+			out := spidresolver.ErrorResult{Error: err.Error()}
+			if len(ids) == 1 {
+				out.SPID = ids[0].spid
+			}
+			writeJSONError(out)
+			exitErr.reported = true
+		}
+		err = exitErr
+	}()
+
+	// Storage provider IDs can be given by flag, as arguments, or in a file.
+	for _, value := range append(f.spIds.values, args...) {
+		for _, spid := range splitList(value) {
+			ids = append(ids, providerID{spid: spid})
+		}
+	}
+	if *f.fromFile != "" {
+		fileIds, err := readProviderIDs(*f.fromFile)
+		if err != nil {
+			return &exitError{code: exitInvalidInput, err: err}
+		}
+		ids = append(ids, fileIds...)
+	}
+	if len(ids) == 0 {
+		return &exitError{code: exitInvalidInput, err: errUsage}
+	}
+	cfg, err = f.config(len(ids))
+	if err != nil {
+		return err
+	}
+
+	caller, err := f.rpc.newCaller()
+	if err != nil {
+		// The gateway flags are not valid.
+		return &exitError{code: exitInvalidInput, err: err}
+	}
+	defer caller.close()
+	if *f.watch {
+		return watchProvider(ctx, caller, ids[0].spid, *f.watchInterval, cfg.formatPeerID)
+	}
+
+	if *f.peerstore != "" {
+		cfg.peerstore, err = newPeerstoreWriter(*f.peerstore, *f.force)
+		if err != nil {
+			return &exitError{code: exitFailure, err: err}
+		}
+		defer func() {
+			if cerr := cfg.peerstore.close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}()
+	}
+	if *f.geoIP != "" {
+		cfg.geoip, err = openGeoIPDB(*f.geoIP)
+		if err != nil {
+			return &exitError{code: exitFailure, err: err}
+		}
+		defer cfg.geoip.close()
+	}
+	if *f.summary {
+		cfg.summary = &findSummary{agent: *f.agent}
+	}
+	if *f.agent {
+		cfg.agent, err = newProber(*f.agentTimeout)
+		if err != nil {
+			return &exitError{code: exitFailure, err: err}
+		}
+		defer cfg.agent.close()
+	}
+	caller.cache, err = f.cache.newCache()
+	if err != nil {
+		return err
+	}
+	return findProviders(ctx, caller, ids, cfg)
+}
+
+// config returns the find settings given by the flags, for looking up numIds
+// storage providers.
+func (f *findFlags) config(numIds int) (findConfig, error) {
+	formatPeerID, err := parsePeerIDFormat(*f.peerIDFormat)
+	if err != nil {
+		return findConfig{}, &exitError{code: exitInvalidInput, err: err}
+	}
+	cfg := findConfig{
+		formatPeerID:       formatPeerID,
+		power:              *f.power,
+		balance:            *f.balance,
+		resolveDNS:         *f.resolveDNS,
+		atHeight:           *f.atHeight,
+		marketParticipants: *f.marketParticipants,
+		reportSkipped:      *f.reportSkipped,
+		raw:                *f.raw,
+		resolveAccounts:    *f.resolveAccounts,
+		checkActor:         !*f.skipActorCheck,
+		concurrency:        *f.concurrency,
+		withP2P:            *f.withP2P,
+		groupByTransport:   *f.groupByTransport,
+	}
+	if cfg.concurrency < 1 {
+		return findConfig{}, invalidInput("concurrency must be at least 1")
+	}
+	switch *f.output {
+	case "text":
+	case "json":
+		if cfg.raw {
+			return findConfig{}, invalidInput("raw cannot be used with json output")
+		}
+		if cfg.marketParticipants {
+			return findConfig{}, invalidInput("market-participants cannot be used with json output")
+		}
+		cfg.json = true
+	case "table":
+		if cfg.raw {
+			return findConfig{}, invalidInput("raw cannot be used with table output")
+		}
+		if *f.agent {
+			return findConfig{}, invalidInput("agent cannot be used with table output")
+		}
+		cfg.table = newTableWriter(os.Stdout)
+	default:
+		return findConfig{}, invalidInput("unsupported output format %q", *f.output)
+	}
+	if cfg.groupByTransport && !cfg.json {
+		return findConfig{}, invalidInput("group-by-transport can only be used with json output")
+	}
+	if *f.fields != "" {
+		if !cfg.json {
+			return findConfig{}, invalidInput("fields can only be used with json output")
+		}
+		cfg.fields, err = parseFindFields(*f.fields)
+		if err != nil {
+			return findConfig{}, &exitError{code: exitInvalidInput, err: err}
+		}
+		// Look up the selected information that is not looked up by default.
+		for _, name := range cfg.fields {
+			switch name {
+			case "power":
+				cfg.power = true
+			case "balance":
+				cfg.balance = true
+			case "accounts":
+				cfg.resolveAccounts = true
+			case "addrsByTransport":
+				cfg.groupByTransport = true
+			case "skipped":
+				cfg.reportSkipped = true
+			case "agent":
+				*f.agent = true
+			}
+		}
+	}
+	if protocols := splitList(*f.protocols); len(protocols) != 0 {
+		filter, err := spidresolver.HasProtocol(protocols...)
+		if err != nil {
+			return findConfig{}, &exitError{code: exitInvalidInput, err: err}
+		}
+		cfg.filters = append(cfg.filters, filter)
+	}
+	if *f.noRelay {
+		cfg.filters = append(cfg.filters, spidresolver.NoRelay)
+	}
+	if *f.excludePrivateAddrs {
+		cfg.excludePrivate = true
+		cfg.filters = append(cfg.filters, spidresolver.NoPrivateAddr)
+	}
+	if cfg.atHeight >= 0 && *f.cache.stale {
+		// Stale cache entries may be from any height.
+		return findConfig{}, invalidInput("cache-stale cannot be used with at-height")
+	}
+	if *f.ipv4Only && *f.ipv6Only {
+		return findConfig{}, invalidInput("ipv4-only and ipv6-only cannot both be set")
+	}
+	if *f.ipv4Only || *f.ipv6Only {
+		version := 4
+		if *f.ipv6Only {
+			version = 6
+		}
+		cfg.ipFilter, _ = spidresolver.IPVersion(version)
+		cfg.filters = append(cfg.filters, cfg.ipFilter)
+	}
+
+	if *f.watch {
+		switch {
+		case numIds != 1:
+			return findConfig{}, invalidInput("watch can only be used with one storage provider")
+		case *f.output != "text":
+			return findConfig{}, invalidInput("watch can only be used with text output")
+		case cfg.atHeight >= 0:
+			return findConfig{}, invalidInput("watch cannot be used with at-height")
+		case *f.watchInterval <= 0:
+			return findConfig{}, invalidInput("watch-interval must be positive")
+		}
+	}
+	return cfg, nil
+}
+
+// findProviders looks up each storage provider as of the chain head, which is
+// reused for the head TTL of the caller unless it is given --fresh-head, and
+// prints the results in the order of ids. A failure to look up one storage
+// provider does not stop the others from being looked up, but does cause an
+// error to be returned.
+func findProviders(ctx context.Context, caller *rpcCaller, ids []providerID, cfg findConfig) error {
+	// Report an invalid storage provider ID before contacting the gateway.
+	if len(ids) == 1 {
+		if _, err := spidresolver.ParseAddress(ids[0].spid, caller.network); err != nil {
+			result := findResult{spid: ids[0].spid, line: ids[0].line, err: err}
+			return result.singleErr()
+		}
+	}
+
+	// The chain head is not needed if stale cache entries can be used,
+	// unless it is needed to get the power or balance, or to check the height.
+	var ets spidresolver.ExpTipSet
+	if caller.cache == nil || !caller.cache.stale || cfg.power || cfg.balance || cfg.atHeight >= 0 {
+		var err error
+		ets, err = caller.chainHead(ctx)
+		if err != nil {
+			return err
+		}
+		// A single storage provider is looked up as of the head just fetched.
+		cfg.followHead = cfg.atHeight < 0 && len(ids) > 1
+	}
+	if cfg.atHeight >= 0 {
+		if cfg.atHeight > ets.Height {
+			return &exitError{
+				code: exitInvalidInput,
+				err:  fmt.Errorf("height %d is after the chain head at height %d", cfg.atHeight, ets.Height),
+			}
+		}
+		var err error
+		ets, err = spidresolver.ChainGetTipSetByHeight(ctx, caller, cfg.atHeight, ets.Cids)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.checkActor {
+		var err error
+		cfg.actorNames, err = spidresolver.GetActorNames(ctx, caller, ets.Cids)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The market participants do not depend on the lookups, so get them at
+	// the same time, if requested. The first of them to fail cancels the
+	// other, and its error is returned.
+	g, gctx := errgroup.WithContext(ctx)
+	var minerList map[string]spidresolver.MarketBalance
+	if cfg.marketParticipants {
+		g.Go(func() error {
+			var err error
+			minerList, err = caller.marketParticipants(gctx)
+			return err
+		})
+	}
+	// lookupErr reports the storage providers that were not found, once the
+	// market participants are printed.
+	var lookupErr error
+	g.Go(func() error {
+		if cfg.table != nil {
+			writeFindTableHeader(cfg.table)
+		}
+		if len(ids) == 1 {
+			result := findProvider(gctx, caller, ids[0], ets, cfg)
+			if cfg.summary != nil {
+				cfg.summary.add(result)
+			}
+			if result.err != nil {
+				if cfg.summary != nil {
+					if err := cfg.summary.write(os.Stdout, cfg.json); err != nil {
+						return err
+					}
+				}
+				return result.singleErr()
+			}
+			printFindResult(result, cfg)
+			// A storage provider whose addresses were all filtered out is
+			// found, with no addresses.
+			if !result.hasAddrs {
+				lookupErr = fmt.Errorf("storage provider %s %w", result.spid, errNoAddrs)
+			}
+			if cfg.peerstore != nil {
+				if err := cfg.peerstore.add(result.addrInfo); err != nil {
+					return err
+				}
+			}
+		} else {
+			failures, err := findProvidersConcurrently(gctx, caller, ids, ets, cfg)
+			if err != nil {
+				return err
+			}
+			if failures.count != 0 {
+				lookupErr = &exitError{
+					code: exitCode(failures.err),
+					err:  fmt.Errorf("lookup failed for %d of %d storage providers", failures.count, len(ids)),
+				}
+			}
+		}
+
+		if cfg.table != nil {
+			if err := cfg.table.Flush(); err != nil {
+				return err
+			}
+		}
+		if cfg.summary != nil {
+			if !cfg.json {
+				fmt.Println()
+			}
+			if err := cfg.summary.write(os.Stdout, cfg.json); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if cfg.marketParticipants {
+		fmt.Println("Miner List Size: ", len(minerList))
+	}
+
+	return lookupErr
+}
+
+// findFailures counts the storage providers that could not be looked up or
+// that have no addresses. err is, of their errors, the one with the lowest
+// exit code.
+type findFailures struct {
+	count int
+	err   error
+}
+
+// findProvidersConcurrently looks up the storage providers using a pool of
+// cfg.concurrency workers, and prints the results in the order of ids. A
+// result that arrives before those of earlier storage providers is held until
+// they are printed. Returns the storage providers that were not found, and any
+// error writing to cfg.peerstore.
+func findProvidersConcurrently(ctx context.Context, caller *rpcCaller, ids []providerID, ets spidresolver.ExpTipSet, cfg findConfig) (findFailures, error) {
+	// Workers are given the index of each storage provider in ids, and
+	// return it with the result, so that the results can be put in order.
+	type indexedResult struct {
+		index int
+		findResult
+	}
+	indexChan := make(chan int)
+	resultChan := make(chan indexedResult)
+	workers := workerCount(cfg.concurrency, len(ids))
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for index := range indexChan {
+				resultChan <- indexedResult{
+					index:      index,
+					findResult: findProvider(ctx, caller, ids[index], ets, cfg),
+				}
+			}
+			wg.Done()
+		}()
+	}
+	var failures findFailures
+	fail := func(err error) {
+		failures.count++
+		if failures.err == nil || exitCode(err) < exitCode(failures.err) {
+			failures.err = err
+		}
+	}
+	var writeErr error
+	done := make(chan struct{})
+	go func() {
+		var printed int
+		printResult := func(result findResult) {
+			if cfg.summary != nil {
+				cfg.summary.add(result)
+			}
+			if result.err != nil {
+				printFindError(result, cfg)
+				fail(result.err)
+				return
+			}
+			if !cfg.json && cfg.table == nil {
+				if printed != 0 {
+					fmt.Println()
+				}
+				fmt.Println("Storage Provider:", result.spid)
+			}
+			printFindResult(result, cfg)
+			printed++
+			if !result.hasAddrs {
+				fail(errNoAddrs)
+			}
+			if cfg.peerstore != nil && writeErr == nil {
+				writeErr = cfg.peerstore.add(result.addrInfo)
+			}
+		}
+		// held has the results that arrived before the result at next.
+		held := make(map[int]findResult)
+		var next int
+		for result := range resultChan {
+			held[result.index] = result.findResult
+			for {
+				r, ok := held[next]
+				if !ok {
+					break
+				}
+				delete(held, next)
+				printResult(r)
+				next++
+			}
+		}
+		close(done)
+	}()
+	// No more storage providers are looked up once ctx is done. Those already
+	// given to workers are still printed.
+feed:
+	for index := range ids {
+		select {
+		case indexChan <- index:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexChan)
+	wg.Wait()
+	close(resultChan)
+	<-done
+
+	return failures, writeErr
+}
+
+// findProvider looks up one storage provider as of the tipset ets, or as of
+// the caller's chain head if cfg.followHead is set.
+func findProvider(ctx context.Context, caller *rpcCaller, id providerID, ets spidresolver.ExpTipSet, cfg findConfig) findResult {
+	spid := id.spid
+	result := findResult{
+		spid: spid,
+		line: id.line,
+	}
+
+	if _, err := spidresolver.ParseAddress(spid, caller.network); err != nil {
+		result.err = err
+		return result
+	}
+
+	if cfg.followHead {
+		var err error
+		ets, err = caller.chainHead(ctx)
+		if err != nil {
+			result.err = err
+			return result
+		}
+	}
+
+	if cfg.checkActor {
+		err := spidresolver.CheckMinerActor(ctx, caller, spid, ets.Cids, cfg.actorNames)
+		if err != nil {
+			result.err = err
+			return result
+		}
+	}
+
+	minerInfo, err := caller.minerInfo(ctx, spid, ets.Cids)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	result.addrInfo, err = spidresolver.MinerInfoToAddrInfo(minerInfo, cfg.filters...)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	parsed, invalid := spidresolver.ParseMultiaddrs(minerInfo.Multiaddrs)
+	for _, err := range invalid {
+		caller.log.debugf("%s: %s", spid, err)
+	}
+	result.hasAddrs = len(parsed) != 0
+	result.relayOnly = spidresolver.RelayOnly(parsed)
+	if cfg.reportSkipped {
+		result.skipped = invalid
+	}
+	if cfg.raw || len(cfg.fields) != 0 {
+		result.minerInfo = &minerInfo
+	}
+	if cfg.power {
+		// Use the same tipset as for the miner info, so that the data is consistent.
+		minerPower, err := spidresolver.StateMinerPower(ctx, caller, spid, ets.Cids)
+		if err != nil {
+			result.err = err
+			return result
+		}
+		result.power = &minerPower
+	}
+	if cfg.balance {
+		available, err := spidresolver.StateMinerAvailableBalance(ctx, caller, spid, ets.Cids)
+		if err != nil {
+			result.err = err
+			return result
+		}
+		market, err := spidresolver.StateMarketBalance(ctx, caller, spid, ets.Cids)
+		if err != nil {
+			result.err = err
+			return result
+		}
+		result.balance = &minerBalance{
+			available: available,
+			market:    market,
+		}
+	}
+	if cfg.resolveAccounts {
+		result.accounts = spidresolver.ResolveAccounts(ctx, caller, minerInfo, ets.Cids)
+		for _, acct := range result.accounts {
+			if !acct.Resolved() {
+				caller.log.debugf("%s: cannot resolve %s address %s: %s", spid, acct.Role, acct.Addr, acct.Err)
+			}
+		}
+	}
+	if cfg.resolveDNS {
+		result.addrInfo.Addrs, err = spidresolver.ResolveDNS(ctx, result.addrInfo.Addrs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if cfg.ipFilter != nil {
+			result.addrInfo.Addrs = spidresolver.FilterAddrs(result.addrInfo.Addrs, cfg.ipFilter)
+		}
+		if cfg.excludePrivate {
+			result.addrInfo.Addrs = spidresolver.FilterAddrs(result.addrInfo.Addrs, spidresolver.NoPrivateAddr)
+		}
+	}
+	if cfg.geoip != nil {
+		result.countries = addrCountries(ctx, cfg.geoip, result.addrInfo.Addrs, caller.log)
+	}
+	if cfg.agent != nil {
+		// An unreachable peer is reported, and is not a lookup error.
+		agent, err := cfg.agent.identify(ctx, result.addrInfo)
+		if err != nil {
+			caller.log.debugf("%s: cannot connect to peer: %s", spid, err)
+		} else {
+			result.agent = &agent
+		}
+	}
+	return result
+}
+
+// printFindResult prints the result of looking up one storage provider.
+func printFindResult(result findResult, cfg findConfig) {
+	if cfg.table != nil {
+		writeFindTableRow(cfg.table, result, cfg.formatPeerID)
+		return
+	}
+	if cfg.json && len(cfg.fields) != 0 {
+		projected := projectFindResult(newFindResultJSON(result, cfg), *result.minerInfo, cfg.fields)
+		data, err := json.Marshal(spidresolver.NewOutput(projected))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "cannot encode find result:", err)
+			return
+		}
+		fmt.Println(string(data))
+		return
+	}
+	if cfg.json {
+		data, err := json.Marshal(spidresolver.NewOutput(newFindResultJSON(result, cfg)))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "cannot encode find result:", err)
+			return
+		}
+		fmt.Println(string(data))
+		return
+	}
+	if result.minerInfo != nil {
+		data, err := json.MarshalIndent(newRawMinerInfo(*result.minerInfo), "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "cannot encode miner info:", err)
+		} else {
+			fmt.Println(string(data))
+		}
+	}
+	addrInfo := result.addrInfo
+	fmt.Println("PeerID:", cfg.formatPeerID(addrInfo.ID))
+	if result.relayOnly {
+		fmt.Println("Relay-only: true")
+	}
+	if result.power != nil {
+		fmt.Println("Raw Byte Power:", result.power.MinerPower.RawBytePower)
+		fmt.Println("Quality-Adjusted Power:", result.power.MinerPower.QualityAdjPower)
+	}
+	if result.balance != nil {
+		fmt.Println("Market Escrow:", spidresolver.FormatFIL(result.balance.market.Escrow))
+		fmt.Println("Market Locked:", spidresolver.FormatFIL(result.balance.market.Locked))
+		fmt.Println("Available Balance:", spidresolver.FormatFIL(result.balance.available))
+	}
+	for _, acct := range result.accounts {
+		switch {
+		case acct.Resolved():
+			fmt.Printf("%s: %s %s\n", acct.Role, acct.ID, acct.Key)
+		case acct.ID != address.Undef:
+			// Not an account actor, for example a multisig.
+			fmt.Printf("%s: %s (multisig/unresolved)\n", acct.Role, acct.ID)
+		default:
+			fmt.Printf("%s: %s (multisig/unresolved)\n", acct.Role, acct.Addr)
+		}
+	}
+	if cfg.agent != nil {
+		if result.agent != nil {
+			fmt.Println("Agent Version:", result.agent.agentVersion)
+			fmt.Println("Protocol Version:", result.agent.protocolVersion)
+		} else {
+			fmt.Println("Agent: unreachable")
+		}
+	}
+	if len(addrInfo.Addrs) != 0 {
+		fmt.Println("Addrs:")
+		for i, a := range shownAddrs(addrInfo, cfg) {
+			if country, ok := result.countries[addrInfo.Addrs[i].String()]; ok {
+				fmt.Println("  ", a, "("+country+")")
+				continue
+			}
+			fmt.Println("  ", a)
+		}
+	} else if result.hasAddrs && len(cfg.filters) != 0 {
+		fmt.Println("Addrs: 0 addresses matched the address filters")
+	}
+	if len(result.skipped) != 0 {
+		fmt.Println("Skipped", len(result.skipped), "addresses that could not be parsed:")
+		for _, err := range result.skipped {
+			fmt.Println("  ", err)
+		}
+	}
+}
+
+// printFindError reports the failed lookup of one storage provider. With JSON
+// output, the error is written to stdout as a JSON error object, so that it
+// can be read along with the results. Otherwise it is written to stderr.
+func printFindError(result findResult, cfg findConfig) {
+	if !cfg.json {
+		fmt.Fprintln(os.Stderr, result.lookupErr())
+		return
+	}
+	writeJSONError(spidresolver.ErrorResult{
+		Error: result.err.Error(),
+		SPID:  result.spid,
+		Line:  result.line,
+	})
+}
+
+// writeJSONError writes the error object to stdout as a line of JSON.
+func writeJSONError(out spidresolver.ErrorResult) {
+	data, err := json.Marshal(out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cannot encode error:", err)
+		fmt.Fprintln(os.Stderr, out.Error)
+		return
+	}
+	fmt.Println(string(data))
+}
+
+// shownAddrs returns the multiaddrs of the storage provider as they are shown,
+// with the /p2p component appended if cfg.withP2P is set. The multiaddrs are
+// shown unchanged if the peer ID cannot be appended.
+func shownAddrs(addrInfo peer.AddrInfo, cfg findConfig) []multiaddr.Multiaddr {
+	if !cfg.withP2P {
+		return addrInfo.Addrs
+	}
+	addrs, err := spidresolver.WithP2P(addrInfo.Addrs, addrInfo.ID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cannot append peer ID to addresses:", err)
+		return addrInfo.Addrs
+	}
+	return addrs
+}
+
+// newFindResultJSON converts the result of looking up one storage provider to
+// its JSON output form.
+func newFindResultJSON(result findResult, cfg findConfig) spidresolver.FindResult {
+	out := spidresolver.FindResult{
+		StorageProvider: result.spid,
+		PeerID:          cfg.formatPeerID(result.addrInfo.ID),
+		Addrs:           make([]string, len(result.addrInfo.Addrs)),
+		RelayOnly:       result.relayOnly,
+	}
+	addrs := shownAddrs(result.addrInfo, cfg)
+	for i, a := range addrs {
+		out.Addrs[i] = a.String()
+		if country, ok := result.countries[result.addrInfo.Addrs[i].String()]; ok {
+			if out.Countries == nil {
+				out.Countries = make(map[string]string, len(result.countries))
+			}
+			out.Countries[out.Addrs[i]] = country
+		}
+	}
+	if cfg.groupByTransport {
+		out.AddrsByTransport = spidresolver.GroupByTransport(addrs)
+	}
+	if result.power != nil {
+		out.Power = &spidresolver.PowerResult{
+			RawBytePower:    result.power.MinerPower.RawBytePower.String(),
+			QualityAdjPower: result.power.MinerPower.QualityAdjPower.String(),
+		}
+	}
+	if result.balance != nil {
+		out.Balance = &spidresolver.BalanceResult{
+			Escrow:    result.balance.market.Escrow.String(),
+			Locked:    result.balance.market.Locked.String(),
+			Available: result.balance.available.String(),
+		}
+	}
+	for _, acct := range result.accounts {
+		acctOut := spidresolver.AccountResult{
+			Role: acct.Role,
+			Addr: acct.Addr.String(),
+		}
+		if acct.ID != address.Undef {
+			acctOut.ID = acct.ID.String()
+		}
+		if acct.Key != address.Undef {
+			acctOut.Key = acct.Key.String()
+		}
+		if acct.Err != nil {
+			acctOut.Error = acct.Err.Error()
+		}
+		out.Accounts = append(out.Accounts, acctOut)
+	}
+	if cfg.agent != nil {
+		out.Agent = &spidresolver.AgentResult{Status: "unreachable"}
+		if result.agent != nil {
+			out.Agent = &spidresolver.AgentResult{
+				Status:          "reachable",
+				AgentVersion:    result.agent.agentVersion,
+				ProtocolVersion: result.agent.protocolVersion,
+			}
+		}
+	}
+	for _, err := range result.skipped {
+		out.Skipped = append(out.Skipped, err.Error())
+	}
+	return out
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+)
+
+// resultClient is a client that returns a fixed result for each method.
+type resultClient struct {
+	results map[string]interface{}
+}
+
+func (c resultClient) CallFor(out interface{}, method string, params ...interface{}) error {
+	result, ok := c.results[method]
+	if !ok {
+		return fmt.Errorf("unexpected call to %s", method)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+func newTestCaller(client spidresolver.Client) *rpcCaller {
+	return &rpcCaller{
+		clients: []gatewayClient{{gateway: "test", client: client}},
+		limiter: newRateLimiter(0),
+		log:     newLogger(io.Discard, false),
+	}
+}
+
+func TestFindProviderFilteredOut(t *testing.T) {
+	h, err := multihash.Sum([]byte("test-peer"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerID := peer.ID(h)
+	tcpAddr, err := multiaddr.NewMultiaddr("/ip4/203.0.113.1/tcp/1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	quic, err := spidresolver.HasProtocol("quic-v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ets := spidresolver.ExpTipSet{Cids: []cid.Cid{testTipSet(t, "head")[0]}, Height: 100}
+
+	tests := []struct {
+		name       string
+		multiaddrs [][]byte
+		wantAddrs  bool
+		wantErr    error
+	}{
+		{"filtered out", [][]byte{tcpAddr.Bytes()}, true, nil},
+		{"no addresses", nil, false, errNoAddrs},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caller := newTestCaller(resultClient{results: map[string]interface{}{
+				"Filecoin.ChainHead":              ets,
+				spidresolver.MethodStateMinerInfo: spidresolver.MinerInfo{PeerId: &peerID, Multiaddrs: tt.multiaddrs},
+			}})
+			cfg := findConfig{
+				filters:      []spidresolver.AddrFilter{quic},
+				atHeight:     -1,
+				formatPeerID: peer.ID.String,
+			}
+			result := findProvider(context.Background(), caller, providerID{spid: "f01234"}, ets, cfg)
+			if result.err != nil {
+				t.Fatal(result.err)
+			}
+			if result.addrInfo.ID != peerID {
+				t.Errorf("got peer ID %s, want %s", result.addrInfo.ID, peerID)
+			}
+			if len(result.addrInfo.Addrs) != 0 {
+				t.Errorf("got addresses %v, want none to pass the filter", result.addrInfo.Addrs)
+			}
+			if result.hasAddrs != tt.wantAddrs {
+				t.Errorf("hasAddrs = %t, want %t", result.hasAddrs, tt.wantAddrs)
+			}
+
+			// Only a storage provider with no addresses at all fails.
+			err := findProviders(context.Background(), caller, []providerID{{spid: "f01234"}}, cfg)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
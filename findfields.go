@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+)
+
+// findFieldSource is what the fields of the find JSON output for one
+// storage provider are taken from.
+type findFieldSource struct {
+	out       spidresolver.FindResult
+	minerInfo spidresolver.MinerInfo
+}
+
+// findFields are the fields that can be selected with find --fields, by
+// name. They are the fields of spidresolver.FindResult, and the fields of
+// the miner info that are not already in it.
+var findFields = map[string]func(src findFieldSource) interface{}{
+	"storageProvider":  func(src findFieldSource) interface{} { return src.out.StorageProvider },
+	"peerId":           func(src findFieldSource) interface{} { return src.out.PeerID },
+	"addrs":            func(src findFieldSource) interface{} { return src.out.Addrs },
+	"addrsByTransport": func(src findFieldSource) interface{} { return src.out.AddrsByTransport },
+	"countries":        func(src findFieldSource) interface{} { return src.out.Countries },
+	"relayOnly":        func(src findFieldSource) interface{} { return src.out.RelayOnly },
+	"power":            func(src findFieldSource) interface{} { return src.out.Power },
+	"balance":          func(src findFieldSource) interface{} { return src.out.Balance },
+	"accounts":         func(src findFieldSource) interface{} { return src.out.Accounts },
+	"agent":            func(src findFieldSource) interface{} { return src.out.Agent },
+	"skipped":          func(src findFieldSource) interface{} { return src.out.Skipped },
+
+	"owner":                      func(src findFieldSource) interface{} { return src.minerInfo.Owner },
+	"worker":                     func(src findFieldSource) interface{} { return src.minerInfo.Worker },
+	"newWorker":                  func(src findFieldSource) interface{} { return src.minerInfo.NewWorker },
+	"controlAddresses":           func(src findFieldSource) interface{} { return src.minerInfo.ControlAddresses },
+	"workerChangeEpoch":          func(src findFieldSource) interface{} { return src.minerInfo.WorkerChangeEpoch },
+	"windowPoStProofType":        func(src findFieldSource) interface{} { return src.minerInfo.WindowPoStProofType },
+	"sectorSize":                 func(src findFieldSource) interface{} { return src.minerInfo.SectorSize },
+	"windowPoStPartitionSectors": func(src findFieldSource) interface{} { return src.minerInfo.WindowPoStPartitionSectors },
+	"consensusFaultElapsed":      func(src findFieldSource) interface{} { return src.minerInfo.ConsensusFaultElapsed },
+	"beneficiary":                func(src findFieldSource) interface{} { return src.minerInfo.Beneficiary },
+	"beneficiaryTerm":            func(src findFieldSource) interface{} { return src.minerInfo.BeneficiaryTerm },
+	"pendingBeneficiaryTerm":     func(src findFieldSource) interface{} { return src.minerInfo.PendingBeneficiaryTerm },
+}
+
+// parseFindFields parses the comma-separated list of field names given to
+// find --fields. An error listing the known fields is returned if any name is
+// not known.
+func parseFindFields(value string) ([]string, error) {
+	fields := splitList(value)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no fields given, known fields are: %s", knownFindFields())
+	}
+	for _, name := range fields {
+		if _, ok := findFields[name]; !ok {
+			return nil, fmt.Errorf("unknown field %q, known fields are: %s", name, knownFindFields())
+		}
+	}
+	return fields, nil
+}
+
+// knownFindFields returns the names of the fields that can be selected, in
+// alphabetical order.
+func knownFindFields() string {
+	names := make([]string, 0, len(findFields))
+	for name := range findFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// projectFindResult returns only the selected fields of the find output for
+// one storage provider. Every selected field is included, even if it is empty.
+func projectFindResult(out spidresolver.FindResult, minerInfo spidresolver.MinerInfo, fields []string) map[string]interface{} {
+	src := findFieldSource{out: out, minerInfo: minerInfo}
+	projected := make(map[string]interface{}, len(fields))
+	for _, name := range fields {
+		projected[name] = findFields[name](src)
+	}
+	return projected
+}
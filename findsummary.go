@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+)
+
+// findSummary collects the outcome of looking up each storage provider, to
+// write a summary of all of them after their results.
+type findSummary struct {
+	providers []spidresolver.ProviderSummary
+	// agent is true if the peers were connected to, so that whether they are
+	// reachable is known.
+	agent bool
+}
+
+// add records the result of looking up one storage provider.
+func (s *findSummary) add(result findResult) {
+	p := spidresolver.ProviderSummary{
+		StorageProvider: result.spid,
+		Resolved:        result.err == nil,
+	}
+	if result.err != nil {
+		p.Error = result.err.Error()
+	} else {
+		p.Addrs = len(result.addrInfo.Addrs)
+		if s.agent {
+			reachable := result.agent != nil
+			p.Reachable = &reachable
+		}
+	}
+	s.providers = append(s.providers, p)
+}
+
+// write writes the summary to w, as a line of JSON if asJSON is set, and
+// otherwise as a table.
+func (s *findSummary) write(w io.Writer, asJSON bool) error {
+	if asJSON {
+		data, err := json.Marshal(spidresolver.NewOutput(spidresolver.FindSummary{Providers: s.providers}))
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	}
+
+	tw := newTableWriter(w)
+	header := "STORAGE PROVIDER\tRESOLVED\tADDRS"
+	if s.agent {
+		header += "\tREACHABLE"
+	}
+	fmt.Fprintln(tw, header)
+	for _, p := range s.providers {
+		row := fmt.Sprintf("%s\t%s\t%d", p.StorageProvider, yesNo(p.Resolved), p.Addrs)
+		if s.agent {
+			reachable := "-"
+			if p.Reachable != nil {
+				reachable = yesNo(*p.Reachable)
+			}
+			row += "\t" + reachable
+		}
+		fmt.Fprintln(tw, row)
+	}
+	return tw.Flush()
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoIPDB looks up the country of IP addresses in a MaxMind GeoIP2 or
+// GeoLite2 country or city database.
+type geoIPDB struct {
+	reader *maxminddb.Reader
+}
+
+// geoIPRecord is the part of a MaxMind database record that is used.
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+func openGeoIPDB(path string) (*geoIPDB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open geoip database: %w", err)
+	}
+	return &geoIPDB{reader: reader}, nil
+}
+
+func (g *geoIPDB) close() error {
+	return g.reader.Close()
+}
+
+// country returns the ISO 3166-1 country code of the IP address, or an empty
+// string if the database has no country for it.
+func (g *geoIPDB) country(ip net.IP) (string, error) {
+	var record geoIPRecord
+	if err := g.reader.Lookup(ip, &record); err != nil {
+		return "", err
+	}
+	return record.Country.ISOCode, nil
+}
+
+// addrCountries returns the country of each of the multiaddrs, keyed by the
+// multiaddr as a string. DNS multiaddrs are resolved, and have the country of
+// the first address they resolve to. Multiaddrs whose country cannot be found
+// are left out, and the reason is logged.
+func addrCountries(ctx context.Context, g *geoIPDB, addrs []multiaddr.Multiaddr, log *logger) map[string]string {
+	countries := make(map[string]string, len(addrs))
+	for _, maddr := range addrs {
+		ip, err := spidresolver.AddrIP(ctx, maddr)
+		if err != nil {
+			log.debugf("geoip: %s: %s", maddr, err)
+			continue
+		}
+		country, err := g.country(ip)
+		if err != nil {
+			log.debugf("geoip: %s: %s", maddr, err)
+			continue
+		}
+		if country == "" {
+			log.debugf("geoip: %s: no country for %s", maddr, ip)
+			continue
+		}
+		countries[maddr.String()] = country
+	}
+	return countries
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"log"
+)
+
+// logLevel is the minimum importance of the messages that are logged.
+type logLevel int
+
+const (
+	levelInfo logLevel = iota
+	levelDebug
+)
+
+// logger writes leveled log messages. Debug messages are only written when
+// the level is levelDebug. A nil logger discards all messages.
+type logger struct {
+	level logLevel
+	l     *log.Logger
+}
+
+func newLogger(w io.Writer, verbose bool) *logger {
+	level := levelInfo
+	if verbose {
+		level = levelDebug
+	}
+	return &logger{
+		level: level,
+		l:     log.New(w, "", log.LstdFlags|log.Lmicroseconds),
+	}
+}
+
+func (lg *logger) infof(format string, args ...interface{}) {
+	if lg == nil {
+		return
+	}
+	lg.l.Printf(format, args...)
+}
+
+func (lg *logger) debugf(format string, args ...interface{}) {
+	if lg == nil || lg.level < levelDebug {
+		return
+	}
+	lg.l.Printf(format, args...)
+}
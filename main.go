@@ -1,24 +1,30 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"sync"
-
-	"net/url"
+	"io"
+	"io/fs"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-state-types/big"
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	leveldb "github.com/ipfs/go-ds-leveldb"
-	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
-	jrpc "github.com/ybbus/jsonrpc/v2"
 )
 
 type SPInfo struct {
@@ -27,361 +33,1486 @@ type SPInfo struct {
 	Price        float64
 	MinPieceSize int
 	MaxPieceSize int
+	Addrs        []multiaddr.Multiaddr `json:"-"`
 }
 
-type ExpTipSet struct {
-	Cids []cid.Cid
-	//Blocks []*BlockHeader
-	//Height abi.ChainEpoch
-	Blocks []interface{}
-	Height int64
+// format returns the same text as formatting s with %+v, but with the peer ID
+// converted to a string by formatPeerID.
+func (s SPInfo) format(formatPeerID peerIDFormat) string {
+	return fmt.Sprintf("{PeerID:%s SPID:%s Price:%v MinPieceSize:%d MaxPieceSize:%d Addrs:%v}",
+		formatPeerID(s.PeerID), s.SPID, s.Price, s.MinPieceSize, s.MaxPieceSize, s.Addrs)
 }
 
-type MinerInfo struct {
-	Owner                      address.Address
-	Worker                     address.Address
-	NewWorker                  address.Address
-	ControlAddresses           []address.Address
-	WorkerChangeEpoch          int64
-	PeerId                     *peer.ID
-	Multiaddrs                 [][]byte
-	WindowPoStProofType        int64
-	SectorSize                 uint64
-	WindowPoStPartitionSectors uint64
-	ConsensusFaultElapsed      int64
+// populateConfig holds the settings for the populate subcommand.
+type populateConfig struct {
+	// concurrency is the number of miners to query concurrently.
+	concurrency int
+	// out, if not nil, is where the miner to peer ID map is written.
+	out io.Writer
+	// probe enables checking whether each peer is reachable.
+	probe bool
+	// probeTimeout is the dial timeout used when probing.
+	probeTimeout time.Duration
+	// limit, if greater than zero, is the maximum number of miners to process.
+	limit int
+	// sort makes the subset of miners selected by limit deterministic.
+	sort bool
+	// sorted makes the output ordered by miner ID. Results are buffered until
+	// all miners are looked up.
+	sorted bool
+	// participants selects where the market participants are read from.
+	participants participantsFlags
+	// formatPeerID converts peer IDs to strings for output.
+	formatPeerID peerIDFormat
+	// filter selects the lookup results that are written.
+	filter *populateFilter
+	// writer, if not nil, receives each lookup result as it arrives. When
+	// probing, results are printed after all miners are probed instead.
+	writer resultWriter
+	// sinks receive each resolved miner that is written. Memory use does not
+	// grow with the number of miners unless a sink holds them.
+	sinks []populateSink
+	// progress enables periodic progress reports on stderr.
+	progress bool
+	// duplicates, if not nil, collects the miner IDs of each peer ID, to
+	// report the peers shared by more than one miner.
+	duplicates peerMiners
+	// batchSize, if more than one, is the number of miners whose miner info
+	// is looked up with each batch call.
+	batchSize int
+	// deadline, if not zero, is when no more miners are looked up. The
+	// lookups in progress are finished, and the results so far written.
+	deadline time.Time
+	// filters select which multiaddrs of each miner are kept.
+	filters []spidresolver.AddrFilter
+	// streamParticipants enables looking up the miners as the market
+	// participants are read from the gateway, instead of after all are read.
+	streamParticipants bool
+	// resume, if not nil, records the miners whose results have been written,
+	// and has the miners to skip.
+	resume *checkpoint
+	// workerIdleTimeout, if not zero, is the longest time a worker spends
+	// looking up one miner, including retries, before abandoning it.
+	workerIdleTimeout time.Duration
+	// diff, if not nil, collects the peer ID of each miner, to report the
+	// changes since a previous run.
+	diff *populateDiff
+	// lookupErrors counts the lookup errors by category, to summarize them
+	// at the end of the run.
+	lookupErrors *errorCollector
 }
 
-type MarketBalance struct {
-	Escrow big.Int
-	Locked big.Int
+// queryAsksConfig holds the settings for the query-asks subcommand.
+type queryAsksConfig struct {
+	// concurrency is the number of miners to query concurrently.
+	concurrency int
+	// progress enables periodic progress reports on stderr.
+	progress bool
+	// fromPopulate, if set, is a file written by populate --out from which
+	// the miners and their peer IDs are read.
+	fromPopulate string
+	// filter selects the asks that are output.
+	filter askFilter
+	// participants selects where the market participants are read from, if
+	// fromPopulate is not set.
+	participants participantsFlags
+	// connect enables querying asks with the storage ask protocol over a
+	// direct libp2p connection, with the RPC method as the fallback.
+	connect bool
+	// dialTimeout is the time allowed for each direct ask query.
+	dialTimeout time.Duration
 }
 
 const defaultGateway = "api.node.glif.io"
-const maxRoutines = 20
+const defaultConcurrency = 20
+
+// defaultWorkerIdleTimeout is long enough for a lookup that makes all of its
+// retries, each taking up to the default RPC timeout.
+const defaultWorkerIdleTimeout = 5 * time.Minute
 const dataStorePath = "datastore"
 
 func main() {
-	// Subcommands
-	populateCommand := flag.NewFlagSet("populate", flag.ExitOnError)
-	findCommand := flag.NewFlagSet("find", flag.ExitOnError)
-	queryAsksCommand := flag.NewFlagSet("query-asks", flag.ExitOnError)
-
-	// Populate subcommand flag pointers
-	populateGatewayPtr := populateCommand.String("gateway", defaultGateway, "Gateway URL")
-	// find subcommand flag pointers
-	findSpIdPtr := findCommand.String("storage_provider_id", "", "Storage Provider ID (Required)")
-	findGatewayPtr := findCommand.String("gateway", defaultGateway, "Gateway URL")
-	// Query asks subcommand flag pointers
-	queryAsksGatewayPtr := queryAsksCommand.String("gateway", defaultGateway, "Gateway URL")
+	// Cancel the context on SIGINT or SIGTERM so that work in progress can stop
+	// and partial results can be saved.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Verify that a subcommand has been provided
 	// os.Arg[0] is the main command
 	// os.Arg[1] will be the subcommand
 	if len(os.Args) < 2 {
-		fmt.Println("populate, find, query-asks subcommand is required")
+		fmt.Fprintln(os.Stderr, "A subcommand is required")
+		writeUsage(os.Stderr)
 		os.Exit(1)
 	}
+	if os.Args[1] == "help" || os.Args[1] == "-h" || os.Args[1] == "--help" {
+		if !printHelp(os.Args[2:]) {
+			fmt.Fprintf(os.Stderr, "Unknown subcommand %q\n", os.Args[2])
+			writeUsage(os.Stderr)
+			os.Exit(1)
+		}
+		return
+	}
 
-	// Switch on the subcommand
-	// Parse the flags for appropriate FlagSet
-	switch os.Args[1] {
-	case "find":
-		findCommand.Parse(os.Args[2:])
-	case "populate":
-		populateCommand.Parse(os.Args[2:])
-	case "query-asks":
-		queryAsksCommand.Parse(os.Args[2:])
-	default:
-		flag.PrintDefaults()
+	// Parse the flags for the subcommand
+	sub, ok := subcommands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown subcommand %q\n", os.Args[1])
+		writeUsage(os.Stderr)
+		os.Exit(1)
+	}
+	flags := newFlagSet(os.Args[1])
+	run := sub(flags)
+	if err := parseArgs(flags, os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
-	// Check which subcommand was Parsed using the FlagSet.Parsed() function. Handle each case accordingly.
-	// FlagSet.Parse() will evaluate to false if no flags were parsed (i.e. the user did not provide any flags)
-	if findCommand.Parsed() {
-		// Required Flags
-		if *findSpIdPtr == "" {
-			findCommand.PrintDefaults()
-			os.Exit(1)
+	if err := run(ctx, flags.Args()); err != nil {
+		code := exitFailure
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			code = exitErr.code
 		}
-		spid := *findSpIdPtr
-		gateway := *findGatewayPtr
-
-		addrInfo, minerList, err := spidToAddrInfo(context.Background(), gateway, spid)
-		if err != nil {
+		switch {
+		case errors.Is(err, errUsage):
+			flags.Usage()
+		case exitErr == nil || !exitErr.reported:
 			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
 		}
+		stop()
+		os.Exit(code)
+	}
+}
 
-		fmt.Println("PeerID:", addrInfo.ID)
-		if len(addrInfo.Addrs) != 0 {
-			fmt.Println("Addrs:")
-			for _, a := range addrInfo.Addrs {
-				fmt.Println("  ", a)
-			}
+// subcommand adds the flags of a subcommand to its flag set, and returns the
+// function that runs the subcommand, with the arguments that follow the
+// flags, once they are parsed.
+type subcommand func(fs *flag.FlagSet) func(ctx context.Context, args []string) error
+
+// newSubcommand returns the subcommand whose flags are added by addFlags, and
+// that is run by run.
+func newSubcommand[F any](addFlags func(fs *flag.FlagSet) F, run func(ctx context.Context, f F, args []string) error) subcommand {
+	return func(fs *flag.FlagSet) func(context.Context, []string) error {
+		f := addFlags(fs)
+		return func(ctx context.Context, args []string) error {
+			return run(ctx, f, args)
 		}
+	}
+}
 
-		fmt.Println("Miner List Size: ", len(minerList))
+// subcommands are the subcommands by name. A subcommand exits with
+// exitFailure if it fails, unless its error is an *exitError.
+var subcommands = map[string]subcommand{
+	"find":       newSubcommand(addFindFlags, runFind),
+	"populate":   newSubcommand(addPopulateFlags, runPopulate),
+	"query-asks": newSubcommand(addQueryAsksFlags, runQueryAsks),
+	"chain-head": newSubcommand(addChainHeadFlags, runChainHead),
+	"dial":       newSubcommand(addDialFlags, runDial),
+	"check":      newSubcommand(addCheckFlags, runCheck),
+	"count":      newSubcommand(addRPCFlags, runCount),
+	"scan":       newSubcommand(addScanFlags, runScan),
+}
+
+// populateFlags holds the flags of the populate subcommand.
+type populateFlags struct {
+	rpc                 rpcFlags
+	cache               cacheFlags
+	participants        participantsFlags
+	dryRun              dryRunFlags
+	concurrency         *int
+	out                 *string
+	force               *bool
+	peerstore           *string
+	probe               *bool
+	probeTimeout        *time.Duration
+	limit               *int
+	peerIDFormat        *string
+	minPower            *string
+	onlyWithAddrs       *bool
+	includeNoPeerID     *bool
+	sorted              *bool
+	sort                *bool
+	format              *string
+	groupByTransport    *bool
+	maxRuntime          *time.Duration
+	excludePrivateAddrs *bool
+	streamParticipants  *bool
+	batchSize           *int
+	workerIdleTimeout   *time.Duration
+	showDuplicates      *bool
+	diff                *string
+	diffOut             *string
+	diffFormat          *string
+	peersOnly           *bool
+	noProgress          *bool
+	db                  *string
+	resume              *string
+}
+
+func addPopulateFlags(fs *flag.FlagSet) *populateFlags {
+	return &populateFlags{
+		rpc:              addRPCFlags(fs),
+		concurrency:      fs.Int("concurrency", defaultConcurrency, "Number of miners to query concurrently"),
+		out:              fs.String("out", "", "Write the miner to peer ID map to this file, as \"minerID peerID [status] [addrs...]\" lines"),
+		force:            fs.Bool("force", false, "Overwrite the --out and --peerstore files if they already exist"),
+		peerstore:        fs.String("peerstore", "", "Also write the resolved miners to this file, as a JSON array of libp2p peer address info"),
+		probe:            fs.Bool("probe", false, "Connect to each peer and report whether it is reachable"),
+		probeTimeout:     fs.Duration("probe-timeout", defaultProbeTimeout, "Dial timeout used when probing peers"),
+		limit:            fs.Int("limit", 0, "Only process this many miners. Mainly for debugging"),
+		peerIDFormat:     fs.String("peerid-format", "base58", "Peer ID output format: base58 or cidv1"),
+		minPower:         fs.String("min-power", "", "Skip miners with less than this raw byte power, in bytes. This makes an additional RPC call per miner"),
+		onlyWithAddrs:    fs.Bool("only-with-addrs", false, "Skip miners that have no valid multiaddrs"),
+		includeNoPeerID:  fs.Bool("include-no-peerid", false, "Also output miners that have no peer ID, marked as such. Otherwise they are only counted in the summary"),
+		sorted:           fs.Bool("sorted", false, "Buffer the output and order it by miner ID, so that runs can be compared"),
+		sort:             fs.Bool("sort", false, "Sort miner IDs before applying --limit, so that the same miners are selected each run"),
+		format:           fs.String("format", "text", "Output format: text, ndjson to stream a JSON object per miner, or table to align the miner ID, peer ID, and number of addresses in columns"),
+		groupByTransport: fs.Bool("group-by-transport", false, "Also write the addresses of each miner grouped by transport, as tcp, quic, websocket, webtransport, or other, in the addrsByTransport field. Only used with --format ndjson"),
+		maxRuntime: fs.Duration("max-runtime", 0, "Stop looking up miners after this long, let the lookups in progress finish, and write the results so far. "+
+			"Stopping is not an error, and miners not looked up are reported. No limit if 0"),
+		excludePrivateAddrs: fs.Bool("exclude-private-addrs", false, "Drop private, loopback, and link-local IP addresses, which cannot be reached from other networks"),
+		streamParticipants: fs.Bool("stream-participants", false, "Start looking up miners as the market participants are read from the gateway, without holding all of them in memory. "+
+			"The total number of miners is not known until all are read. Cannot be used with --sort, --participants-file, or --dry-run"),
+		batchSize: fs.Int("batch-size", 0, "Look up the miner info of this many miners with each batched RPC call, instead of making a call per miner. "+
+			"Miners whose lookup in a batch fails are retried with their own call. Not used if less than 2. Cannot be used with --transport ws"),
+		workerIdleTimeout: fs.Duration("workers-idle-timeout", defaultWorkerIdleTimeout, "Abandon the lookup of a miner, and record it as failed, if it takes longer than this, including retries. "+
+			"This frees a worker held by a call that never returns. No limit if 0"),
+		showDuplicates: fs.Bool("show-duplicates", false, "Report the peer IDs shared by more than one miner, and their miner IDs, on stderr. This holds the miner IDs of every peer in memory"),
+		diff:           fs.String("diff", "", "Report the miners added, removed, or with a changed peer ID since the previous run that wrote this file with --format ndjson"),
+		diffOut:        fs.String("diff-out", "", "Write the --diff report to this file instead of stderr"),
+		diffFormat:     fs.String("diff-format", "text", "Format of the --diff report: text, or json to write one JSON object"),
+		peersOnly:      fs.Bool("peers-only", false, "Only write the peer ID of each miner, one per line, with each peer ID written once"),
+		noProgress:     fs.Bool("no-progress", false, "Do not report progress on stderr"),
+		db:             fs.String("db", "", "Also write the miner records to this SQLite database, replacing the existing record of each miner"),
+		cache:          addCacheFlags(fs),
+		participants:   addParticipantsFlags(fs),
+		dryRun:         addDryRunFlags(fs),
+		resume: fs.String("resume", "", "Record the miners looked up in this checkpoint file as they finish, and skip the miners already in it. "+
+			"Failed lookups are not recorded, so they are retried. The --out file is appended to. Cannot be used with --sorted, --probe, or --format table"),
 	}
+}
 
-	if populateCommand.Parsed() {
-		gateway := *populateGatewayPtr
-		fmt.Println("Populating...")
-		err := populateMinerPeerIds(gateway)
+// validate checks that the populate flags can be used together.
+func (f *populateFlags) validate() error {
+	if *f.concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	if *f.maxRuntime < 0 {
+		return errors.New("max-runtime must not be negative")
+	}
+	if *f.batchSize < 0 {
+		return errors.New("batch-size must not be negative")
+	}
+	if *f.batchSize > 1 && *f.rpc.transport == "ws" {
+		return errors.New("batch-size cannot be used with the ws transport")
+	}
+	switch *f.format {
+	case "text":
+	case "ndjson", "table":
+		if *f.probe {
+			return fmt.Errorf("probe cannot be used with %s format", *f.format)
+		}
+	default:
+		return fmt.Errorf("unsupported output format %q", *f.format)
+	}
+	if *f.peersOnly {
+		if *f.format != "text" {
+			return fmt.Errorf("peers-only cannot be used with %s format", *f.format)
+		}
+		if *f.probe {
+			return errors.New("peers-only cannot be used with probe")
+		}
+	}
+	if *f.groupByTransport && *f.format != "ndjson" {
+		return errors.New("group-by-transport can only be used with ndjson format")
+	}
+	if *f.diffFormat != "text" && *f.diffFormat != "json" {
+		return fmt.Errorf("unsupported diff format %q", *f.diffFormat)
+	}
+	if *f.diffOut != "" && *f.diff == "" {
+		return errors.New("diff-out can only be used with diff")
+	}
+	if err := f.dryRun.validate(); err != nil {
+		return err
+	}
+	if *f.streamParticipants {
+		var conflict string
+		switch {
+		case *f.sort:
+			conflict = "sort"
+		case *f.participants.file != "":
+			conflict = "participants-file"
+		case *f.dryRun.enabled:
+			conflict = "dry-run"
+		}
+		if conflict != "" {
+			return fmt.Errorf("stream-participants cannot be used with %s", conflict)
+		}
+	}
+	if *f.resume != "" {
+		// Results are only recorded once written, which these delay.
+		var conflict string
+		switch {
+		case *f.sorted:
+			conflict = "sorted"
+		case *f.probe:
+			conflict = "probe"
+		case *f.format == "table":
+			conflict = "table format"
+		}
+		if conflict != "" {
+			return fmt.Errorf("resume cannot be used with %s", conflict)
+		}
+	}
+	return nil
+}
+
+// runPopulate runs the populate subcommand.
+func runPopulate(ctx context.Context, f *populateFlags, args []string) (err error) {
+	if err = f.validate(); err != nil {
+		return err
+	}
+	caller, err := f.rpc.newCaller()
+	if err != nil {
+		return err
+	}
+	defer caller.close()
+	var resume *checkpoint
+	if *f.resume != "" {
+		resume, err = loadCheckpoint(*f.resume)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+			return err
 		}
 	}
+	if *f.dryRun.enabled {
+		minerList, err := populateMinerList(ctx, caller, f.participants, *f.limit, *f.sort, resume)
+		if err != nil {
+			return err
+		}
+		return writeDryRun(os.Stdout, minerList, *f.dryRun.listIDs)
+	}
 
-	if queryAsksCommand.Parsed() {
-		gateway := *queryAsksGatewayPtr
+	// closeFile closes a file written by populate, returning the error from
+	// closing it if there is no other error.
+	closeFile := func(file *os.File) {
+		if cerr := file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	var outFile *os.File
+	switch {
+	case *f.out != "" && resume != nil:
+		// The results of the previous runs are kept.
+		outFile, err = os.OpenFile(*f.out, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	case *f.out != "":
+		outFile, err = createOutFile(*f.out, *f.force)
+	}
+	if err != nil {
+		return err
+	}
+	if outFile != nil {
+		defer closeFile(outFile)
+	}
+	if outFile != nil || *f.format != "text" || *f.peersOnly {
+		fmt.Fprintln(os.Stderr, "Populating...")
+	} else {
 		fmt.Println("Populating...")
-		err := queryAskMiners(gateway)
+	}
+	formatPeerID, err := parsePeerIDFormat(*f.peerIDFormat)
+	if err != nil {
+		return err
+	}
+	minPower, err := parseBytes(*f.minPower)
+	if err != nil {
+		return fmt.Errorf("min-power: %w", err)
+	}
+	cfg := populateConfig{
+		deadline:           maxRuntimeDeadline(*f.maxRuntime),
+		concurrency:        *f.concurrency,
+		formatPeerID:       formatPeerID,
+		probe:              *f.probe,
+		probeTimeout:       *f.probeTimeout,
+		limit:              *f.limit,
+		sort:               *f.sort,
+		sorted:             *f.sorted,
+		workerIdleTimeout:  *f.workerIdleTimeout,
+		batchSize:          *f.batchSize,
+		streamParticipants: *f.streamParticipants,
+		resume:             resume,
+		lookupErrors:       newErrorCollector(*f.rpc.verbose),
+		progress:           !*f.noProgress,
+		participants:       f.participants,
+		filter: &populateFilter{
+			minPower:        minPower,
+			onlyWithAddrs:   *f.onlyWithAddrs,
+			includeNoPeerID: *f.includeNoPeerID,
+		},
+	}
+	// out is where the results are written.
+	var out io.Writer = os.Stdout
+	if outFile != nil {
+		cfg.out = outFile
+		out = outFile
+	}
+	if *f.excludePrivateAddrs {
+		cfg.filters = append(cfg.filters, spidresolver.NoPrivateAddr)
+	}
+	if *f.showDuplicates {
+		cfg.duplicates = make(peerMiners)
+	}
+	if *f.diff != "" {
+		cfg.diff, err = newPopulateDiff(*f.diff)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+			return fmt.Errorf("cannot read diff snapshot: %w", err)
+		}
+		cfg.diff.asJSON = *f.diffFormat == "json"
+		cfg.diff.out = os.Stderr
+		if *f.diffOut != "" {
+			diffFile, err := createOutFile(*f.diffOut, *f.force)
+			if err != nil {
+				return err
+			}
+			defer closeFile(diffFile)
+			cfg.diff.out = diffFile
 		}
 	}
-}
-
-func spidToAddrInfo(ctx context.Context, gateway, spid string) (peer.AddrInfo, map[string]MarketBalance, error) {
-	u := url.URL{
-		Host:   gateway,
-		Scheme: "https",
-		Path:   "/rpc/v0",
+	switch {
+	case *f.format == "ndjson":
+		cfg.writer = newNDJSONWriter(out, formatPeerID, *f.groupByTransport)
+	case *f.format == "table":
+		cfg.writer = newPeerIDTableWriter(out, formatPeerID)
+	case *f.peersOnly:
+		cfg.writer = newPeersOnlyWriter(out, formatPeerID)
+	case cfg.probe:
+		// Output waits for the probe status of every miner.
+	case outFile != nil:
+		cfg.writer = newTextWriter(outFile, false, formatPeerID)
+	default:
+		fmt.Println("Miner-PeerId List:")
+		cfg.writer = newTextWriter(os.Stdout, true, formatPeerID)
 	}
-	gatewayURL := u.String()
-
-	// Get miner info from lotus
-	spAddress, err := address.NewFromString(spid)
+	if cfg.sorted && cfg.writer != nil {
+		cfg.writer = &sortedWriter{w: cfg.writer}
+	}
+	if *f.peerstore != "" {
+		var pw *peerstoreWriter
+		pw, err = newPeerstoreWriter(*f.peerstore, *f.force)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := pw.close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}()
+		cfg.sinks = append(cfg.sinks, peerstoreSink{pw})
+	}
+	if *f.db != "" {
+		var db *resultDB
+		db, err = openResultDB(*f.db)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err == nil {
+				fmt.Fprintln(os.Stderr, "Wrote", db.written, "storage provider records to database")
+			}
+			if cerr := db.close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}()
+		cfg.sinks = append(cfg.sinks, db)
+	}
+	caller.cache, err = f.cache.newCache()
 	if err != nil {
-		return peer.AddrInfo{}, nil, fmt.Errorf("invalid provider filecoin address: %s", err)
+		return err
 	}
+	return populateMinerPeerIds(ctx, caller, cfg)
+}
 
-	jrpcClient := jrpc.NewClient(gatewayURL)
+// peerIDResult is the result of looking up the peer ID of one miner.
+type peerIDResult struct {
+	minerID  string
+	addrInfo peer.AddrInfo
+	// belowMinPower is true if the miner has less than the minimum power.
+	belowMinPower bool
+	err           error
+}
 
-	var ets ExpTipSet
-	err = jrpcClient.CallFor(&ets, "Filecoin.ChainHead")
-	if err != nil {
-		return peer.AddrInfo{}, nil, err
-	}
+// resultWriter writes peer ID lookup results as they arrive.
+type resultWriter interface {
+	write(result peerIDResult) error
+	flush() error
+}
 
-	var minerInfo MinerInfo
-	err = jrpcClient.CallFor(&minerInfo, "Filecoin.StateMinerInfo", spAddress, ets.Cids)
-	if err != nil {
-		return peer.AddrInfo{}, nil, err
+// textWriter writes each resolved miner as a line of text. Lookup errors are
+// counted by populateCollector.
+type textWriter struct {
+	w io.Writer
+	// describe writes the full provider info instead of the miner ID, peer ID
+	// and addresses separated by spaces.
+	describe     bool
+	formatPeerID peerIDFormat
+}
+
+func newTextWriter(w io.Writer, describe bool, formatPeerID peerIDFormat) *textWriter {
+	return &textWriter{
+		w:            w,
+		describe:     describe,
+		formatPeerID: formatPeerID,
 	}
+}
 
-	minerList := make(map[string]MarketBalance)
-	err = jrpcClient.CallFor(&minerList, "Filecoin.StateMarketParticipants", nil)
-	if err != nil {
-		return peer.AddrInfo{}, nil, err
+func (tw *textWriter) write(result peerIDResult) error {
+	if errors.Is(result.err, spidresolver.ErrNoPeerID) {
+		var err error
+		if tw.describe {
+			_, err = fmt.Fprintln(tw.w, result.minerID, "has no peer ID")
+		} else {
+			_, err = fmt.Fprintln(tw.w, result.minerID, noPeerIDField)
+		}
+		return err
 	}
+	if result.err != nil {
+		return nil
+	}
+	var err error
+	if tw.describe {
+		spInfo := SPInfo{
+			PeerID: result.addrInfo.ID,
+			SPID:   result.minerID,
+			Addrs:  result.addrInfo.Addrs,
+		}
+		_, err = fmt.Fprintf(tw.w, "Storage provider info: %s\n", spInfo.format(tw.formatPeerID))
+	} else {
+		fields := []interface{}{result.minerID, tw.formatPeerID(result.addrInfo.ID)}
+		for _, a := range result.addrInfo.Addrs {
+			fields = append(fields, a)
+		}
+		_, err = fmt.Fprintln(tw.w, fields...)
+	}
+	return err
+}
 
-	if minerInfo.PeerId == nil {
-		return peer.AddrInfo{}, nil, errors.New("no peer id for service provider")
+func (tw *textWriter) flush() error {
+	return nil
+}
+
+// peersOnlyWriter writes only the peer ID of each resolved miner, one per
+// line, for tools that take a list of peers. A peer ID shared by several
+// miners is written once.
+type peersOnlyWriter struct {
+	w            io.Writer
+	formatPeerID peerIDFormat
+	seen         map[peer.ID]struct{}
+}
+
+func newPeersOnlyWriter(w io.Writer, formatPeerID peerIDFormat) *peersOnlyWriter {
+	return &peersOnlyWriter{
+		w:            w,
+		formatPeerID: formatPeerID,
+		seen:         make(map[peer.ID]struct{}),
 	}
+}
 
-	// Get miner peer ID and addresses from miner info
-	addrInfo, err := minerInfoToAddrInfo(minerInfo)
-	if err != nil {
-		return peer.AddrInfo{}, nil, err
+func (pw *peersOnlyWriter) write(result peerIDResult) error {
+	if errors.Is(result.err, spidresolver.ErrNoPeerID) {
+		return nil
+	}
+	if result.err != nil {
+		return nil
 	}
+	if _, ok := pw.seen[result.addrInfo.ID]; ok {
+		return nil
+	}
+	pw.seen[result.addrInfo.ID] = struct{}{}
+	_, err := fmt.Fprintln(pw.w, pw.formatPeerID(result.addrInfo.ID))
+	return err
+}
 
-	return addrInfo, minerList, err
+func (pw *peersOnlyWriter) flush() error {
+	return nil
 }
 
-func minerInfoToAddrInfo(minerInfo MinerInfo) (peer.AddrInfo, error) {
-	multiaddrs := make([]multiaddr.Multiaddr, 0, len(minerInfo.Multiaddrs))
-	for _, a := range minerInfo.Multiaddrs {
-		maddr, err := multiaddr.NewMultiaddrBytes(a)
-		if err != nil {
-			continue
+// noPeerIDField is written by textWriter in place of the peer ID of a miner
+// that has none.
+const noPeerIDField = "no-peer-id"
+
+// peerIDRecord is the JSON object written for each miner by ndjsonWriter.
+type peerIDRecord struct {
+	Miner    string   `json:"miner"`
+	PeerID   string   `json:"peerId,omitempty"`
+	NoPeerID bool     `json:"noPeerId,omitempty"`
+	Addrs    []string `json:"addrs,omitempty"`
+	// AddrsByTransport has the same addresses as Addrs, grouped by transport.
+	AddrsByTransport map[string][]string `json:"addrsByTransport,omitempty"`
+	Error            string              `json:"error,omitempty"`
+}
+
+// ndjsonWriter writes each peer ID lookup result as a line of JSON. If
+// groupByTransport is set, the addresses are also written grouped by
+// transport.
+type ndjsonWriter struct {
+	enc              *json.Encoder
+	formatPeerID     peerIDFormat
+	groupByTransport bool
+}
+
+func newNDJSONWriter(w io.Writer, formatPeerID peerIDFormat, groupByTransport bool) *ndjsonWriter {
+	return &ndjsonWriter{
+		enc:              json.NewEncoder(w),
+		formatPeerID:     formatPeerID,
+		groupByTransport: groupByTransport,
+	}
+}
+
+func (nw *ndjsonWriter) write(result peerIDResult) error {
+	rec := peerIDRecord{
+		Miner: result.minerID,
+	}
+	switch {
+	case errors.Is(result.err, spidresolver.ErrNoPeerID):
+		rec.NoPeerID = true
+	case result.err != nil:
+		rec.Error = result.err.Error()
+	default:
+		rec.PeerID = nw.formatPeerID(result.addrInfo.ID)
+		for _, a := range result.addrInfo.Addrs {
+			rec.Addrs = append(rec.Addrs, a.String())
+		}
+		if nw.groupByTransport && len(result.addrInfo.Addrs) != 0 {
+			rec.AddrsByTransport = spidresolver.GroupByTransport(result.addrInfo.Addrs)
 		}
-		multiaddrs = append(multiaddrs, maddr)
 	}
+	return nw.enc.Encode(&rec)
+}
 
-	return peer.AddrInfo{
-		ID:    *minerInfo.PeerId,
-		Addrs: multiaddrs,
-	}, nil
+func (nw *ndjsonWriter) flush() error {
+	return nil
 }
 
-func minerListToPeerId(minerList map[string]MarketBalance, jrpcClient jrpc.RPCClient) (map[peer.ID]SPInfo, error) {
-	minerIdToPeerId := make(map[peer.ID]SPInfo)
-	minerChan := make(chan string)
-	resultChan := make(chan SPInfo)
+// streamLimit returns the maximum number of streamed participants to look up,
+// which is the lower of the limit and the maximum number of participants, or
+// zero if neither is set.
+func (cfg populateConfig) streamLimit() int {
+	limit := cfg.limit
+	if max := *cfg.participants.max; max > 0 && (limit <= 0 || max < limit) {
+		limit = max
+	}
+	return limit
+}
+
+// minerListToPeerId looks up the peer ID and addresses of each miner, as of
+// the tipset identified by tsk or the chain head if tsk is nil, and passes
+// each result to a populateCollector, which records it in prog and stats,
+// and writes the results kept by cfg.filter to cfg.writer and cfg.sinks. The
+// number of miners that could not be looked up, not counting those that have
+// no peer ID, is returned. If cfg.batchSize is more than one, each worker
+// looks up the miner info of that many miners with one batch call. Workers
+// stop when ctx is cancelled. After cfg.deadline, no more miners are looked
+// up, but the lookups in progress are finished. If cfg.streamParticipants is
+// set, minerList is not used, and the miners are looked up as they are read
+// from the gateway. Their number is then recorded in prog and stats once they
+// have all been read.
+func minerListToPeerId(ctx context.Context, minerList map[string]spidresolver.MarketBalance, caller *rpcCaller, cfg populateConfig, tsk []cid.Cid, prog *progress, stats *summary) (int, error) {
+	feedCtx, cancelFeed := withDeadline(ctx, cfg.deadline)
+	defer cancelFeed()
+	batchChan := make(chan []string)
+	resultChan := make(chan peerIDResult)
+	total := len(minerList)
+	workers := workerCount(cfg.concurrency, total)
+	if cfg.streamParticipants {
+		// The number of miners is not known until all are read.
+		workers = workerCount(cfg.concurrency, cfg.concurrency)
+	}
 	var wg sync.WaitGroup
-	wg.Add(maxRoutines)
-	for i := 0; i < maxRoutines; i++ {
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
 		go func() {
-			for minerId := range minerChan {
-				peerID, err := printMinerIdPeerId(minerId, jrpcClient)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, err)
-					continue
-				}
-
-				resultChan <- SPInfo{
-					PeerID: peerID,
-					SPID:   minerId,
-				}
-			}
+			lookupBatches(ctx, caller, cfg, tsk, batchChan, resultChan)
 			wg.Done()
 		}()
 	}
+	collector := newPopulateCollector(cfg, caller.log, prog, stats)
+	collected := make(chan struct{})
 	go func() {
-		for spinfo := range resultChan {
-			minerIdToPeerId[spinfo.PeerID] = spinfo
+		for result := range resultChan {
+			collector.collect(result)
 		}
+		close(collected)
 	}()
-	for k := range minerList {
-		minerChan <- k
+	var streamErr error
+	if cfg.streamParticipants {
+		ids := make(chan string)
+		streamDone := make(chan struct{})
+		go func() {
+			defer close(streamDone)
+			total, streamErr = streamParticipants(feedCtx, caller, cfg.streamLimit(), cfg.resume.skip, ids)
+		}()
+		batchIDs(feedCtx, ids, cfg.batchSize, batchChan)
+		<-streamDone
+		prog.setTotal(total)
+	} else {
+		feedBatches(feedCtx, minerList, cfg.batchSize, batchChan)
 	}
-	close(minerChan)
 	wg.Wait()
 	close(resultChan)
+	<-collected
+	stats.total = total
+
+	err := collector.finish()
+	if err == nil {
+		// The results of the miners read before the stream failed are kept.
+		err = streamErr
+	}
+	if err != nil {
+		return collector.failed, err
+	}
 
-	return minerIdToPeerId, nil
+	if cfg.resume != nil {
+		fmt.Fprintln(os.Stderr, "Skipped", cfg.resume.skipped, "miners already in", cfg.resume.path)
+	}
+	cfg.filter.report(os.Stderr)
+	reportInterrupted(ctx, collector.processed, total)
+	if ctx.Err() == nil && feedCtx.Err() != nil && int(collector.processed) < total {
+		fmt.Fprintf(os.Stderr, "Max runtime reached: processed %d of %d miners\n", collector.processed, total)
+	}
+	return collector.failed, nil
+}
+
+// lookupBatches looks up the miners in each batch from batchChan, and sends
+// the result of each to resultChan, until batchChan is closed. The miner info
+// of a batch of more than one miner is looked up with one call. The lookups
+// interrupted by cancelling ctx are not sent.
+func lookupBatches(ctx context.Context, caller *rpcCaller, cfg populateConfig, tsk []cid.Cid, batchChan <-chan []string, resultChan chan<- peerIDResult) {
+	for batch := range batchChan {
+		var infos []minerInfoResult
+		if len(batch) > 1 {
+			batchCtx, cancel := withIdleTimeout(ctx, cfg.workerIdleTimeout)
+			infos = caller.minerInfoBatch(batchCtx, batch, tsk)
+			cancel()
+		}
+		for j, minerId := range batch {
+			lookupCtx, cancel := withIdleTimeout(ctx, cfg.workerIdleTimeout)
+			var addrInfo peer.AddrInfo
+			var err error
+			if infos != nil {
+				addrInfo, err = minerAddrInfo(minerId, infos[j].minerInfo, infos[j].err, caller, cfg.filters...)
+			} else {
+				addrInfo, err = lookupMinerAddrInfo(lookupCtx, minerId, caller, tsk, cfg.filters...)
+			}
+			var belowMinPower bool
+			if err == nil && cfg.filter.minPower != nil {
+				belowMinPower, err = hasLessPower(lookupCtx, minerId, caller, tsk, *cfg.filter.minPower)
+			}
+			lookupTimedOut := lookupCtx.Err() != nil
+			cancel()
+			// Do not report miners whose lookup was interrupted.
+			if err != nil && ctx.Err() != nil {
+				continue
+			}
+			if err != nil && lookupTimedOut {
+				err = fmt.Errorf("%w: lookup abandoned after %s", err, cfg.workerIdleTimeout)
+			}
+			resultChan <- peerIDResult{
+				minerID:       minerId,
+				addrInfo:      addrInfo,
+				belowMinPower: belowMinPower,
+				err:           err,
+			}
+		}
+	}
 }
 
-func minerListToQueryAsks(minerList map[string]MarketBalance, jrpcClient jrpc.RPCClient) (map[string]string, error) {
-	minerIdToQueryAsks := make(map[string]string)
+// minerListToQueryAsks queries the storage ask of each miner, and writes each
+// result that filter accepts to aw as it arrives. Each result is recorded in
+// prog and counted in stats. The peer ID and addresses of a miner in peers
+// are not looked up. If asker is not nil, each ask is first queried directly.
+// Returns the number of miners whose ask could not be queried, not counting
+// those that have no peer ID. Workers stop when ctx is cancelled.
+func minerListToQueryAsks(ctx context.Context, minerList map[string]spidresolver.MarketBalance, peers map[string]peer.AddrInfo, caller *rpcCaller, asker *directAsker, concurrency int, filter *askFilter, aw askWriter, prog *progress, stats *summary) (int, error) {
+	var processed int64
+	var failed int
 	minerChan := make(chan string)
-	resultChan := make(chan string)
+	resultChan := make(chan queryAskResult)
+	workers := workerCount(concurrency, len(minerList))
 	var wg sync.WaitGroup
-	wg.Add(maxRoutines)
-	for i := 0; i < maxRoutines; i++ {
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
 		go func() {
 			for minerId := range minerChan {
-				resultChan <- printMinerQueryAskResult(minerId, jrpcClient)
+				var result queryAskResult
+				if addrInfo, ok := peers[minerId]; ok {
+					result = queryMinerAskWithAddrInfo(ctx, minerId, addrInfo, caller, asker)
+				} else {
+					result = queryMinerAsk(ctx, minerId, caller, asker)
+				}
+				// Do not report miners whose query was interrupted.
+				if result.err != nil && ctx.Err() != nil {
+					continue
+				}
+				resultChan <- result
 			}
 			wg.Done()
 		}()
 	}
+	writeErr := make(chan error, 1)
 	go func() {
-		for out := range resultChan {
-			fmt.Print(out)
+		var err error
+		for result := range resultChan {
+			processed++
+			prog.record(result.err)
+			stats.record(result.err)
+			if result.err != nil && !errors.Is(result.err, spidresolver.ErrNoPeerID) {
+				failed++
+			}
+			if result.ask != nil && !filter.accept(result.ask) {
+				continue
+			}
+			if err == nil {
+				err = aw.write(result)
+			}
 		}
+		writeErr <- err
 	}()
-	for k := range minerList {
-		minerChan <- k
-	}
-	close(minerChan)
+	feedMiners(ctx, minerList, minerChan)
 	wg.Wait()
 	close(resultChan)
 
-	return minerIdToQueryAsks, nil
+	if err := <-writeErr; err != nil {
+		return failed, err
+	}
+	reportInterrupted(ctx, processed, len(minerList))
+	return failed, aw.flush()
+}
+
+// feedMiners sends each miner ID in minerList to minerChan, and then closes
+// minerChan. No more miner IDs are sent after ctx is cancelled.
+func feedMiners(ctx context.Context, minerList map[string]spidresolver.MarketBalance, minerChan chan<- string) {
+	defer close(minerChan)
+	for k := range minerList {
+		select {
+		case minerChan <- k:
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
-func printMinerIdPeerId(minerId string, jrpcClient jrpc.RPCClient) (peer.ID, error) {
-	var minerInfo MinerInfo
-	err := jrpcClient.CallFor(&minerInfo, "Filecoin.StateMinerInfo", minerId, nil)
+// feedBatches sends the miner IDs in minerList to batchChan, in batches of up
+// to size miners, and then closes batchChan. Each miner is sent in its own
+// batch if size is less than 2. No more batches are sent after ctx is
+// cancelled.
+func feedBatches(ctx context.Context, minerList map[string]spidresolver.MarketBalance, size int, batchChan chan<- []string) {
+	ids := make(chan string)
+	go feedMiners(ctx, minerList, ids)
+	batchIDs(ctx, ids, size, batchChan)
+}
 
+// reportInterrupted prints how many miners were processed if ctx was
+// cancelled before all miners were processed.
+func reportInterrupted(ctx context.Context, processed int64, total int) {
+	if ctx.Err() != nil {
+		fmt.Fprintf(os.Stderr, "Interrupted: processed %d of %d miners\n", processed, total)
+	}
+}
+
+// workerCount returns the number of worker goroutines to start for n items.
+// This is the requested concurrency, or the default if not set, but no more
+// than the number of items.
+func workerCount(concurrency, n int) int {
+	if concurrency < 1 {
+		concurrency = defaultConcurrency
+	}
+	if concurrency > n {
+		return n
+	}
+	return concurrency
+}
+
+// maxRuntimeDeadline returns the time that a run limited to maxRuntime,
+// starting now, must stop by. The zero time is returned if maxRuntime is zero,
+// meaning no limit.
+func maxRuntimeDeadline(maxRuntime time.Duration) time.Time {
+	if maxRuntime <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(maxRuntime)
+}
+
+// withDeadline returns a context that is cancelled at deadline, or only when
+// ctx is, if deadline is the zero time.
+func withDeadline(ctx context.Context, deadline time.Time) (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline)
+}
+
+// withIdleTimeout returns a context that is cancelled after timeout, so that
+// a worker abandons a lookup that hangs, and is free to look up the next
+// miner. A timeout of zero means no limit.
+func withIdleTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// lookupMinerAddrInfo returns the peer ID and addresses of the miner. Only
+// addresses accepted by all of the filters are returned.
+func lookupMinerAddrInfo(ctx context.Context, minerId string, caller *rpcCaller, tsk []cid.Cid, filters ...spidresolver.AddrFilter) (peer.AddrInfo, error) {
+	minerInfo, err := caller.minerInfo(ctx, minerId, tsk)
+	return minerAddrInfo(minerId, minerInfo, err, caller, filters...)
+}
+
+// minerAddrInfo returns the peer ID and addresses in the miner info of the
+// miner, or err, the error from getting the miner info, if not nil. Only
+// addresses accepted by all of the filters are returned.
+func minerAddrInfo(minerId string, minerInfo spidresolver.MinerInfo, err error, caller *rpcCaller, filters ...spidresolver.AddrFilter) (peer.AddrInfo, error) {
 	if err != nil {
-		return peer.ID(""), err
+		return peer.AddrInfo{}, fmt.Errorf("storage provider %q: %w", minerId, err)
 	}
 	if minerInfo.PeerId == nil {
-		return peer.ID(""), fmt.Errorf("storage provide %q has no peer ID", minerId)
+		return peer.AddrInfo{}, fmt.Errorf("storage provider %q: %w", minerId, spidresolver.ErrNoPeerID)
 	}
-	return *minerInfo.PeerId, nil
+	_, invalid := spidresolver.ParseMultiaddrs(minerInfo.Multiaddrs)
+	for _, err = range invalid {
+		caller.log.debugf("%s: %s", minerId, err)
+	}
+	return spidresolver.MinerInfoToAddrInfo(minerInfo, filters...)
 }
 
-func printMinerQueryAskResult(minerId string, jrpcClient jrpc.RPCClient) string {
-	var minerInfo MinerInfo
-	err := jrpcClient.CallFor(&minerInfo, "Filecoin.StateMinerInfo", minerId, nil)
+// hasLessPower returns true if the raw byte power of the miner, as of the
+// tipset identified by tsk, is less than minPower.
+func hasLessPower(ctx context.Context, minerId string, caller *rpcCaller, tsk []cid.Cid, minPower big.Int) (bool, error) {
+	power, err := spidresolver.StateMinerPower(ctx, caller, minerId, tsk)
+	if err != nil {
+		return false, fmt.Errorf("storage provider %q power: %w", minerId, err)
+	}
+	return power.MinerPower.RawBytePower.LessThan(minPower), nil
+}
 
+// queryMinerAsk looks up the peer ID and addresses of the miner, and then
+// queries its storage ask.
+func queryMinerAsk(ctx context.Context, minerId string, caller *rpcCaller, asker *directAsker) queryAskResult {
+	minerInfo, err := caller.minerInfo(ctx, minerId, nil)
 	if err != nil {
-		return fmt.Sprintln(minerId, err)
+		return queryAskResult{
+			minerID: minerId,
+			err:     err,
+		}
 	}
 	if minerInfo.PeerId == nil {
-		return fmt.Sprintln(minerId, "has no peer ID")
+		return queryAskResult{
+			minerID: minerId,
+			err:     spidresolver.ErrNoPeerID,
+		}
+	}
+	addrs, _ := spidresolver.ParseMultiaddrs(minerInfo.Multiaddrs)
+	addrInfo := peer.AddrInfo{
+		ID:    *minerInfo.PeerId,
+		Addrs: addrs,
 	}
+	return queryMinerAskWithAddrInfo(ctx, minerId, addrInfo, caller, asker)
+}
 
-	var queryAskResult string
-	err = jrpcClient.CallFor(&queryAskResult, "Filecoin.ClientQueryAsk", minerInfo.PeerId, minerId)
+// queryMinerAskWithAddrInfo queries the storage ask of the miner, which has
+// the given peer ID and addresses. If asker is not nil, the ask is queried
+// directly, and Filecoin.ClientQueryAsk is only called if that fails.
+func queryMinerAskWithAddrInfo(ctx context.Context, minerId string, addrInfo peer.AddrInfo, caller *rpcCaller, asker *directAsker) queryAskResult {
+	result := queryAskResult{
+		minerID: minerId,
+		peerID:  addrInfo.ID,
+	}
+	start := time.Now()
+	if asker != nil {
+		ask, err := asker.queryAsk(ctx, minerId, addrInfo)
+		if err == nil || asker.noFallback {
+			result.ask = ask
+			result.err = err
+			result.duration = time.Since(start)
+			return result
+		}
+		caller.log.debugf("direct ask query for %s failed, calling ClientQueryAsk: %s", minerId, err)
+	}
 
+	ask, err := spidresolver.QueryAsk(ctx, caller, minerId, addrInfo.ID)
+	result.duration = time.Since(start)
 	if err != nil {
-		return fmt.Sprintln(minerId, err)
-	}
-	if queryAskResult == "" {
-		return fmt.Sprintln(minerId, "has no query ask result")
+		result.err = err
+		return result
 	}
-	return fmt.Sprintln(minerId, " -> ", queryAskResult)
+	result.ask = ask
+	return result
 }
 
-func populateMinerPeerIds(gateway string) error {
-	u := url.URL{
-		Host:   gateway,
-		Scheme: "https",
-		Path:   "/rpc/v0",
+// populateMinerPeerIds looks up the peer ID of every market participant and
+// stores the results in the datastore. If cfg.out is not nil, the miner to
+// peer ID map is written to cfg.out, and status messages are written to
+// stderr. Otherwise, everything is written to stdout.
+func populateMinerPeerIds(ctx context.Context, caller *rpcCaller, cfg populateConfig) error {
+	start := time.Now()
+	// Streamed participants are counted as they are read.
+	var minerList map[string]spidresolver.MarketBalance
+	total := unknownTotal
+	if !cfg.streamParticipants {
+		var err error
+		minerList, err = populateMinerList(ctx, caller, cfg.participants, cfg.limit, cfg.sort, cfg.resume)
+		if err != nil {
+			return err
+		}
+		total = len(minerList)
 	}
-	gatewayURL := u.String()
-	jrpcClient := jrpc.NewClient(gatewayURL)
 
-	minerList := make(map[string]MarketBalance)
-	err := jrpcClient.CallFor(&minerList, "Filecoin.StateMarketParticipants", nil)
+	// The errors are summarized after the totals.
+	defer cfg.lookupErrors.write(os.Stderr)
+	stats := newSummary(total, start)
+	defer stats.write(os.Stderr)
+
+	// Cached miner info is only valid for the tipset it was looked up at, so
+	// look up all miner info at the current chain head.
+	var tsk []cid.Cid
+	if caller.cache != nil && !caller.cache.stale {
+		ets, err := caller.chainHead(ctx)
+		if err != nil {
+			return err
+		}
+		tsk = ets.Cids
+	}
+
+	err := os.MkdirAll(dataStorePath, 0750)
 	if err != nil {
 		return err
 	}
-
-	mIdPeerIdMap, err := minerListToPeerId(minerList, jrpcClient)
+	dstore, err := leveldb.NewDatastore(dataStorePath, nil)
 	if err != nil {
 		return err
 	}
+	defer dstore.Close()
+	store := &storeSink{store: dstore}
+	cfg.sinks = append(cfg.sinks, store)
+	// Memory use only grows with the number of miners if they are all needed
+	// after the lookups.
+	var spInfos spInfoMap
+	if cfg.probe {
+		spInfos = make(spInfoMap)
+		cfg.sinks = append(cfg.sinks, spInfos)
+	}
+	if cfg.duplicates != nil {
+		cfg.sinks = append(cfg.sinks, cfg.duplicates)
+	}
 
-	err = os.MkdirAll(dataStorePath, 0750)
+	// Even if ctx is cancelled, save the results collected so far.
+	var prog *progress
+	if cfg.progress {
+		prog = startProgress(os.Stderr, total, progressInterval)
+	}
+	failed, err := minerListToPeerId(ctx, minerList, caller, cfg, tsk, prog, stats)
+	fmt.Fprintln(os.Stderr, "Wrote", store.stored, "storage provider records")
+	prog.finish()
 	if err != nil {
 		return err
 	}
+	if failed != 0 && failed == stats.total {
+		return fmt.Errorf("lookup failed for all %d miners", failed)
+	}
 
-	dstore, err := leveldb.NewDatastore(dataStorePath, nil)
+	if cfg.probe {
+		// Miners not probed before the deadline have an unknown status.
+		probeCtx, cancel := withDeadline(ctx, cfg.deadline)
+		err = writeProbed(probeCtx, spInfos, cfg)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.duplicates != nil {
+		// Written with the summary, so that it is not mixed into the output.
+		if err = cfg.duplicates.write(os.Stderr, cfg.formatPeerID); err != nil {
+			return err
+		}
+	}
+	// The changes are only known if every miner was looked up.
+	if cfg.diff != nil && ctx.Err() == nil && stats.processed() == stats.total {
+		if err = cfg.diff.write(cfg.formatPeerID); err != nil {
+			return err
+		}
+	}
+
+	// Results are saved even if interrupted, but the run is not successful.
+	// Stopping at the deadline is successful.
+	return ctx.Err()
+}
+
+// writeProbed probes each miner in spInfos and writes it, along with whether it
+// is reachable, to cfg.out or stdout, ordered by miner ID if cfg.sorted is set.
+// Miners that were not probed, because the run was interrupted, have an unknown
+// status rather than being reported as unreachable.
+func writeProbed(ctx context.Context, spInfos map[peer.ID]SPInfo, cfg populateConfig) error {
+	var reachable map[peer.ID]bool
+	if ctx.Err() == nil {
+		p, err := newProber(cfg.probeTimeout)
+		if err != nil {
+			return fmt.Errorf("cannot create libp2p host: %w", err)
+		}
+		reachable = probeMiners(ctx, spInfos, p, cfg.concurrency)
+		p.close()
+	}
+	peerIDs := make([]peer.ID, 0, len(spInfos))
+	for k := range spInfos {
+		peerIDs = append(peerIDs, k)
+	}
+	if cfg.sorted {
+		sort.Slice(peerIDs, func(i, j int) bool {
+			return lessMinerID(spInfos[peerIDs[i]].SPID, spInfos[peerIDs[j]].SPID)
+		})
+	}
+	if cfg.out == nil {
+		fmt.Println("Miner-PeerId List:")
+	}
+	for _, k := range peerIDs {
+		v := spInfos[k]
+		status := "unknown"
+		if ok, probed := reachable[k]; probed {
+			status = "unreachable"
+			if ok {
+				status = "reachable"
+			}
+		}
+		if cfg.out == nil {
+			fmt.Printf("Storage provider info: %s %s\n", v.format(cfg.formatPeerID), status)
+			continue
+		}
+		fields := []interface{}{v.SPID, cfg.formatPeerID(k), status}
+		for _, a := range v.Addrs {
+			fields = append(fields, a)
+		}
+		if _, err := fmt.Fprintln(cfg.out, fields...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeSPInfo saves spInfo in dstore, keyed by peer ID.
+func storeSPInfo(dstore datastore.Datastore, spInfo SPInfo) error {
+	value, err := json.Marshal(&spInfo)
 	if err != nil {
 		return err
 	}
+	return dstore.Put(context.Background(), datastore.NewKey(spInfo.PeerID.String()), value)
+}
+
+// populateMinerList returns the market participants to look up, at most limit
+// of them if limit is positive. The miners recorded in resume, if not nil, are
+// left out before the limit is applied.
+func populateMinerList(ctx context.Context, caller *rpcCaller, participants participantsFlags, limit int, sorted bool, resume *checkpoint) (map[string]spidresolver.MarketBalance, error) {
+	minerList, err := participants.marketParticipants(ctx, caller)
+	if err != nil {
+		return nil, err
+	}
+	if resume != nil {
+		resume.skipDone(minerList)
+	}
+	if limit > 0 {
+		minerList = limitMiners(minerList, limit, sorted)
+	}
+	return minerList, nil
+}
+
+// limitMiners returns a map containing at most limit miners from minerList.
+// If sorted is true, the miners with the lowest IDs, as ordered by lessMinerID,
+// are selected. Otherwise, the selection is arbitrary.
+func limitMiners(minerList map[string]spidresolver.MarketBalance, limit int, sorted bool) map[string]spidresolver.MarketBalance {
+	if len(minerList) <= limit {
+		return minerList
+	}
+	minerIds := make([]string, 0, len(minerList))
+	for k := range minerList {
+		minerIds = append(minerIds, k)
+	}
+	if sorted {
+		sort.Slice(minerIds, func(i, j int) bool {
+			return lessMinerID(minerIds[i], minerIds[j])
+		})
+	}
 
-	fmt.Println("Miner-PeerId List:")
-	var count int
-	for k, v := range mIdPeerIdMap {
-		fmt.Printf("Stgorage provider info: %+v\n", v)
-		value, err := json.Marshal(&v)
+	limited := make(map[string]spidresolver.MarketBalance, limit)
+	for _, minerId := range minerIds[:limit] {
+		limited[minerId] = minerList[minerId]
+	}
+	return limited
+}
+
+// lessMinerID reports whether miner ID a sorts before b. IDs are ordered by
+// the numeric actor ID that follows the network and protocol prefix, so that
+// f09 comes before f010. IDs without a numeric actor ID sort after those with
+// one, and are ordered lexically.
+func lessMinerID(a, b string) bool {
+	na, aok := minerIDNumber(a)
+	nb, bok := minerIDNumber(b)
+	switch {
+	case aok && bok:
+		if na != nb {
+			return na < nb
+		}
+	case aok:
+		return true
+	case bok:
+		return false
+	}
+	return a < b
+}
+
+// minerIDNumber returns the actor ID of an ID address such as f01234.
+func minerIDNumber(minerID string) (uint64, bool) {
+	if len(minerID) < 3 || minerID[1] != '0' {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(minerID[2:], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// createOutFile creates the file at path for writing. If the file already
+// exists, it is truncated if force is true, and an error is returned otherwise.
+func createOutFile(path string, force bool) (*os.File, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !force {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("output file %s already exists, use --force to overwrite", path)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// readPopulateOutput reads the peer ID and addresses of each miner from a file
+// written by populate --out, which has a "minerID peerID" line for each miner,
+// optionally followed by a reachability status and the miner's addresses.
+func readPopulateOutput(path string) (map[string]peer.AddrInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	peers := make(map[string]peer.AddrInfo)
+	scanner := bufio.NewScanner(f)
+	var line int
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s line %d: expected miner ID and peer ID", path, line)
+		}
+		if fields[1] == noPeerIDField {
+			continue
+		}
+		peerID, err := peer.Decode(fields[1])
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("%s line %d: invalid peer ID: %w", path, line, err)
+		}
+		addrInfo := peer.AddrInfo{ID: peerID}
+		for _, field := range fields[2:] {
+			// Skip the reachability status.
+			if !strings.HasPrefix(field, "/") {
+				continue
+			}
+			maddr, err := multiaddr.NewMultiaddr(field)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: invalid address: %w", path, line, err)
+			}
+			addrInfo.Addrs = append(addrInfo.Addrs, maddr)
 		}
-		dsKey := datastore.NewKey(k.String())
-		if err = dstore.Put(context.Background(), dsKey, value); err != nil {
+		peers[fields[0]] = addrInfo
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// queryAsksFlags holds the flags of the query-asks subcommand.
+type queryAsksFlags struct {
+	rpc              rpcFlags
+	participants     participantsFlags
+	dryRun           dryRunFlags
+	concurrency      *int
+	format           *string
+	timing           *bool
+	noProgress       *bool
+	maxPrice         *string
+	maxVerifiedPrice *string
+	minPieceSize     *uint64
+	maxPieceSize     *uint64
+	sorted           *bool
+	fromPopulate     *string
+	connect          *bool
+	dialTimeout      *time.Duration
+}
+
+func addQueryAsksFlags(fs *flag.FlagSet) *queryAsksFlags {
+	return &queryAsksFlags{
+		rpc:              addRPCFlags(fs),
+		concurrency:      fs.Int("concurrency", defaultConcurrency, "Number of miners to query concurrently"),
+		format:           fs.String("format", "text", "Output format: text, csv, or table to align the asks in columns"),
+		timing:           fs.Bool("timing", false, "Also output how long each ask query took, in milliseconds, and whether it timed out. With csv, queries that timed out are also output"),
+		noProgress:       fs.Bool("no-progress", false, "Do not report progress on stderr"),
+		maxPrice:         fs.String("max-price", "", "Filter out miners whose ask price, in attoFIL, is higher"),
+		maxVerifiedPrice: fs.String("max-verified-price", "", "Filter out miners whose verified ask price, in attoFIL, is higher"),
+		minPieceSize:     fs.Uint64("min-piece-size", 0, "Filter out miners whose maximum piece size, in bytes, is smaller"),
+		maxPieceSize:     fs.Uint64("max-piece-size", 0, "Filter out miners whose minimum piece size, in bytes, is larger"),
+		sorted:           fs.Bool("sorted", false, "Buffer the output and order it by miner ID, so that runs can be compared"),
+		fromPopulate:     fs.String("from-populate", "", "Only query the miners, and use the peer IDs, listed in this file written by populate --out"),
+		participants:     addParticipantsFlags(fs),
+		dryRun:           addDryRunFlags(fs),
+		connect:          fs.Bool("connect-and-identify", false, "Connect to each miner with libp2p and read its ask with the storage ask protocol, instead of calling ClientQueryAsk. ClientQueryAsk is still used if that fails"),
+		dialTimeout:      fs.Duration("dial-timeout", defaultProbeTimeout, "Time allowed for connecting to a miner and reading its ask, with --connect-and-identify"),
+	}
+}
+
+// runQueryAsks runs the query-asks subcommand.
+func runQueryAsks(ctx context.Context, f *queryAsksFlags, args []string) error {
+	if *f.concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	if *f.fromPopulate != "" && *f.participants.file != "" {
+		return errors.New("from-populate cannot be used with participants-file")
+	}
+	maxPrice, err := parsePrice(*f.maxPrice)
+	if err != nil {
+		return fmt.Errorf("max-price: %w", err)
+	}
+	maxVerifiedPrice, err := parsePrice(*f.maxVerifiedPrice)
+	if err != nil {
+		return fmt.Errorf("max-verified-price: %w", err)
+	}
+	if *f.maxPieceSize != 0 && *f.minPieceSize > *f.maxPieceSize {
+		return errors.New("min-piece-size must not be larger than max-piece-size")
+	}
+	if err = f.dryRun.validate(); err != nil {
+		return err
+	}
+	caller, err := f.rpc.newCaller()
+	if err != nil {
+		return err
+	}
+	defer caller.close()
+	if *f.dryRun.enabled {
+		minerList, _, err := queryAsksMinerList(ctx, caller, *f.fromPopulate, f.participants)
+		if err != nil {
 			return err
 		}
-		count++
+		return writeDryRun(os.Stdout, minerList, *f.dryRun.listIDs)
+	}
+	aw, err := newAskWriter(*f.format, os.Stdout, *f.timing)
+	if err != nil {
+		return err
+	}
+	if *f.sorted {
+		aw = &sortedAskWriter{w: aw}
+	}
+	if *f.format == "text" {
+		fmt.Println("Populating...")
+	} else {
+		fmt.Fprintln(os.Stderr, "Populating...")
 	}
-	fmt.Println("Wrote", count, "storage provider records")
-	if err = dstore.Sync(context.Background(), datastore.NewKey("")); err != nil {
-		return fmt.Errorf("cannot sync provider info: %s", err)
+	cfg := queryAsksConfig{
+		concurrency:  *f.concurrency,
+		progress:     !*f.noProgress,
+		fromPopulate: *f.fromPopulate,
+		participants: f.participants,
+		connect:      *f.connect,
+		dialTimeout:  *f.dialTimeout,
+		filter: askFilter{
+			maxPrice:         maxPrice,
+			maxVerifiedPrice: maxVerifiedPrice,
+			minPieceSize:     *f.minPieceSize,
+			maxPieceSize:     *f.maxPieceSize,
+		},
 	}
+	return queryAskMiners(ctx, caller, cfg, aw)
+}
 
-	return err
+// queryAsksMinerList returns the miners to query the asks of. These are the
+// miners in the fromPopulate file, if set, along with their peer IDs and
+// addresses, or the market participants otherwise.
+func queryAsksMinerList(ctx context.Context, caller *rpcCaller, fromPopulate string, participants participantsFlags) (map[string]spidresolver.MarketBalance, map[string]peer.AddrInfo, error) {
+	if fromPopulate == "" {
+		minerList, err := participants.marketParticipants(ctx, caller)
+		return minerList, nil, err
+	}
+	// Only the miners known to have a peer ID are queried, and their peer IDs
+	// do not need to be looked up.
+	peers, err := readPopulateOutput(fromPopulate)
+	if err != nil {
+		return nil, nil, err
+	}
+	minerList := make(map[string]spidresolver.MarketBalance, len(peers))
+	for minerId := range peers {
+		minerList[minerId] = spidresolver.MarketBalance{}
+	}
+	return minerList, peers, nil
 }
 
-func queryAskMiners(gateway string) error {
-	u := url.URL{
-		Host:   gateway,
-		Scheme: "https",
-		Path:   "/rpc/v0",
+func queryAskMiners(ctx context.Context, caller *rpcCaller, cfg queryAsksConfig, aw askWriter) error {
+	start := time.Now()
+	minerList, peers, err := queryAsksMinerList(ctx, caller, cfg.fromPopulate, cfg.participants)
+	if err != nil {
+		return err
+	}
+
+	var asker *directAsker
+	if cfg.connect {
+		asker, err = newDirectAsker(cfg.dialTimeout)
+		if err != nil {
+			return fmt.Errorf("cannot create libp2p host: %w", err)
+		}
+		defer asker.close()
 	}
-	gatewayURL := u.String()
-	jrpcClient := jrpc.NewClient(gatewayURL)
 
-	minerList := make(map[string]MarketBalance)
-	err := jrpcClient.CallFor(&minerList, "Filecoin.StateMarketParticipants", nil)
+	// A gateway without ClientQueryAsk fails every query the same way, so
+	// find out before querying any miner.
+	supported, err := clientQueryAskSupported(ctx, caller)
 	if err != nil {
 		return err
 	}
+	if !supported {
+		if asker == nil {
+			return errClientQueryAskUnsupported
+		}
+		fmt.Fprintln(os.Stderr, "The gateway does not support Filecoin.ClientQueryAsk, so asks are only queried directly from the miners")
+		asker.noFallback = true
+	}
+
+	stats := newSummary(len(minerList), start)
+	defer stats.write(os.Stderr)
 
-	mIdQueryAskMap, err := minerListToQueryAsks(minerList, jrpcClient)
-	fmt.Println("Miner-QueryAsk List:")
-	for k, v := range mIdQueryAskMap {
-		fmt.Printf("%s -> %s\n", k, v)
+	var prog *progress
+	if cfg.progress {
+		prog = startProgress(os.Stderr, len(minerList), progressInterval)
 	}
-	return err
+	failed, err := minerListToQueryAsks(ctx, minerList, peers, caller, asker, cfg.concurrency, &cfg.filter, aw, prog, stats)
+	prog.finish()
+	if err != nil {
+		return err
+	}
+	if failed != 0 && failed == len(minerList) {
+		return fmt.Errorf("query failed for all %d miners", failed)
+	}
+	if cfg.filter.active() {
+		fmt.Fprintf(os.Stderr, "Kept %d miners, filtered out %d\n", cfg.filter.kept, cfg.filter.filtered)
+	}
+	return ctx.Err()
 }
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+)
+
+func TestLimitMinersSorted(t *testing.T) {
+	minerList := map[string]spidresolver.MarketBalance{
+		"f010":  {},
+		"f09":   {},
+		"f0100": {},
+		"f02":   {},
+	}
+	limited := limitMiners(minerList, 2, true)
+	if len(limited) != 2 {
+		t.Fatalf("got %d miners, want 2", len(limited))
+	}
+	for _, minerID := range []string{"f02", "f09"} {
+		if _, ok := limited[minerID]; !ok {
+			t.Errorf("%s not selected, got %v", minerID, limited)
+		}
+	}
+
+	if got := limitMiners(minerList, 10, true); len(got) != len(minerList) {
+		t.Errorf("got %d miners, want all %d", len(got), len(minerList))
+	}
+}
+
+func TestLessMinerID(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{name: "shorter id first", a: "f09", b: "f010", want: true},
+		{name: "longer id after", a: "f010", b: "f09", want: false},
+		{name: "same length", a: "f01234", b: "f01235", want: true},
+		{name: "leading zeros", a: "f0010", b: "f09", want: false},
+		{name: "equal", a: "f01000", b: "f01000", want: false},
+		{name: "same number, by prefix", a: "f01000", b: "t01000", want: true},
+		{name: "id before key address", a: "f099999", b: "f1abcdefg", want: true},
+		{name: "key address after id", a: "f1abcdefg", b: "f01", want: false},
+		{name: "non-ids lexically", a: "f1abc", b: "f3abc", want: true},
+		{name: "no actor id", a: "f0", b: "f01", want: false},
+		{name: "malformed actor id", a: "f0abc", b: "f0999", want: false},
+		{name: "overflowing actor id", a: "f099999999999999999999", b: "f01", want: false},
+		{name: "empty", a: "", b: "f01", want: false},
+		{name: "both malformed", a: "bad", b: "f0x", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lessMinerID(tt.a, tt.b); got != tt.want {
+				t.Errorf("lessMinerID(%q, %q) = %t, want %t", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubcommands(t *testing.T) {
+	if len(subcommands) != len(commands) {
+		t.Errorf("got %d subcommands, and help for %d", len(subcommands), len(commands))
+	}
+	for _, help := range commands {
+		sub, ok := subcommands[help.name]
+		if !ok {
+			t.Errorf("no subcommand %s", help.name)
+			continue
+		}
+		fs := newFlagSet(help.name)
+		if run := sub(fs); run == nil {
+			t.Errorf("subcommand %s has no run function", help.name)
+		}
+		if fs.Lookup("gateway") == nil {
+			t.Errorf("subcommand %s has no RPC flags", help.name)
+		}
+	}
+}
+
+func TestFindFlagsInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		numIds  int
+		errText string
+	}{
+		{"concurrency", []string{"--concurrency", "0"}, 1, "concurrency must be at least 1"},
+		{"output", []string{"--output", "xml"}, 1, "unsupported output format"},
+		{"raw json", []string{"--output", "json", "--raw"}, 1, "raw cannot be used with json output"},
+		{"fields text", []string{"--fields", "peerId"}, 1, "fields can only be used with json output"},
+		{"ip versions", []string{"--ipv4-only", "--ipv6-only"}, 1, "cannot both be set"},
+		{"watch several", []string{"--watch"}, 2, "watch can only be used with one storage provider"},
+		{"stale at height", []string{"--at-height", "100", "--cache-stale"}, 1, "cache-stale cannot be used with at-height"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newFlagSet("find")
+			fs.SetOutput(io.Discard)
+			f := addFindFlags(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			_, err := f.config(tt.numIds)
+			if err == nil || !strings.Contains(err.Error(), tt.errText) {
+				t.Fatalf("err = %v, want error containing %q", err, tt.errText)
+			}
+			if code := exitCode(err); code != exitInvalidInput {
+				t.Errorf("exit code %d, want %d", code, exitInvalidInput)
+			}
+		})
+	}
+}
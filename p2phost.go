@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// p2pHost is a libp2p host that does not listen, for connecting to storage
+// providers one exchange at a time.
+type p2pHost struct {
+	host    host.Host
+	timeout time.Duration
+}
+
+// newP2PHost creates a libp2p host, whose exchanges with a peer must each
+// complete within timeout.
+func newP2PHost(timeout time.Duration) (*p2pHost, error) {
+	h, err := libp2p.New(libp2p.NoListenAddrs)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create libp2p host: %w", err)
+	}
+	return &p2pHost{
+		host:    h,
+		timeout: timeout,
+	}, nil
+}
+
+func (h *p2pHost) close() error {
+	return h.host.Close()
+}
+
+// connect connects to the peer, calls exchange, if it is not nil, with the
+// connected peer, and then disconnects and forgets the peer's addresses. The
+// context passed to exchange is done when the timeout ends. Connect does not
+// return until the identify exchange has completed, so exchange can read what
+// the peer sent in it from the peerstore.
+func (h *p2pHost) connect(ctx context.Context, addrInfo peer.AddrInfo, exchange func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	defer func() {
+		h.host.Network().ClosePeer(addrInfo.ID)
+		h.host.Peerstore().ClearAddrs(addrInfo.ID)
+	}()
+
+	if err := h.host.Connect(ctx, addrInfo); err != nil {
+		return err
+	}
+	if exchange == nil {
+		return nil
+	}
+	return exchange(ctx)
+}
+
+// peerAgent is the software that a peer reported running in the identify
+// exchange.
+type peerAgent struct {
+	agentVersion    string
+	protocolVersion string
+}
+
+// agent returns the agent and protocol versions that the connected peer sent
+// in the identify exchange.
+func (h *p2pHost) agent(peerID peer.ID) peerAgent {
+	var agent peerAgent
+	if v, err := h.host.Peerstore().Get(peerID, "AgentVersion"); err == nil {
+		agent.agentVersion, _ = v.(string)
+	}
+	if v, err := h.host.Peerstore().Get(peerID, "ProtocolVersion"); err == nil {
+		agent.protocolVersion, _ = v.(string)
+	}
+	return agent
+}
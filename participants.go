@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+)
+
+// participantsFlags holds the flags that select where the list of market
+// participants comes from.
+//
+// Filecoin.StateMarketParticipants returns every participant in a single
+// response, which on mainnet is several megabytes that must be held in memory
+// all at once, and which can time out on public gateways. Reading the
+// participants from a file avoids that call, and the file is decoded one entry
+// at a time, so a cap also limits how much of it is held in memory. A cap on
+// the participants from the RPC call only limits how many are processed.
+type participantsFlags struct {
+	file *string
+	max  *int
+}
+
+func addParticipantsFlags(fs *flag.FlagSet) participantsFlags {
+	return participantsFlags{
+		file: fs.String("participants-file", "", "Read the market participants from this file, holding the JSON result of Filecoin.StateMarketParticipants, instead of calling the gateway"),
+		max:  fs.Int("max-participants", 0, "Use at most this many market participants. No limit if 0"),
+	}
+}
+
+// marketParticipants returns the market participants, from the participants
+// file if one is set, or from the gateway otherwise.
+func (f participantsFlags) marketParticipants(ctx context.Context, caller *rpcCaller) (map[string]spidresolver.MarketBalance, error) {
+	if *f.file == "" {
+		minerList, err := caller.marketParticipants(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(minerList) == 0 {
+			fmt.Fprintln(os.Stderr, "warning: the gateway returned no market participants, even after retrying. It may be overloaded")
+		}
+		if *f.max > 0 {
+			minerList = limitMiners(minerList, *f.max, false)
+		}
+		return minerList, nil
+	}
+
+	file, err := os.Open(*f.file)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	minerList, err := spidresolver.ReadMarketParticipants(file, *f.max)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read participants file %s: %w", *f.file, err)
+	}
+	return minerList, nil
+}
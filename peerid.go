@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// peerIDFormat converts a peer ID to a string for output.
+type peerIDFormat func(peer.ID) string
+
+// parsePeerIDFormat returns the peerIDFormat with the given name. The base58
+// format is the legacy base58btc encoding, such as "12D3Koo...". The cidv1
+// format is the peer ID as a CIDv1 with the libp2p-key codec, in base32.
+func parsePeerIDFormat(name string) (peerIDFormat, error) {
+	switch name {
+	case "base58":
+		return peer.ID.String, nil
+	case "cidv1":
+		return func(id peer.ID) string {
+			return peer.ToCid(id).String()
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported peer ID format %q", name)
+}
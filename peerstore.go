@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// peerstoreWriter writes a JSON array of peer address info that can be
+// unmarshaled into []peer.AddrInfo, for importing into a libp2p peerstore.
+// Entries are written as they are added, so that the array does not need to
+// be held in memory.
+type peerstoreWriter struct {
+	f     *os.File
+	w     *bufio.Writer
+	count int
+}
+
+func newPeerstoreWriter(path string, force bool) (*peerstoreWriter, error) {
+	f, err := createOutFile(path, force)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	if _, err = w.WriteString("["); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &peerstoreWriter{
+		f: f,
+		w: w,
+	}, nil
+}
+
+// add writes addrInfo to the array. Peers with no addresses are not written,
+// since there is nothing to import for them.
+func (pw *peerstoreWriter) add(addrInfo peer.AddrInfo) error {
+	if len(addrInfo.Addrs) == 0 {
+		return nil
+	}
+	// AddrInfo marshals the peer ID in its standard text encoding and each
+	// multiaddr as a string.
+	data, err := json.Marshal(addrInfo)
+	if err != nil {
+		return err
+	}
+	if pw.count != 0 {
+		if _, err = pw.w.WriteString(","); err != nil {
+			return err
+		}
+	}
+	if _, err = pw.w.WriteString("\n  "); err != nil {
+		return err
+	}
+	if _, err = pw.w.Write(data); err != nil {
+		return err
+	}
+	pw.count++
+	return nil
+}
+
+// close ends the array and closes the file.
+func (pw *peerstoreWriter) close() error {
+	_, err := pw.w.WriteString("\n]\n")
+	if err == nil {
+		err = pw.w.Flush()
+	}
+	if cerr := pw.f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const defaultProbeTimeout = 10 * time.Second
+
+// prober checks whether peers are reachable by connecting to them with a
+// libp2p host.
+type prober struct {
+	*p2pHost
+}
+
+func newProber(timeout time.Duration) (*prober, error) {
+	h, err := newP2PHost(timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &prober{h}, nil
+}
+
+// probe connects to the peer, and then disconnects. An error is returned if
+// the peer could not be connected to within the dial timeout.
+func (p *prober) probe(ctx context.Context, addrInfo peer.AddrInfo) error {
+	return p.connect(ctx, addrInfo, nil)
+}
+
+// identify connects to the peer, and returns the agent and protocol versions
+// it sent in the identify exchange, and then disconnects. An error is returned
+// if the peer could not be connected to within the dial timeout.
+func (p *prober) identify(ctx context.Context, addrInfo peer.AddrInfo) (peerAgent, error) {
+	var agent peerAgent
+	err := p.connect(ctx, addrInfo, func(context.Context) error {
+		agent = p.agent(addrInfo.ID)
+		return nil
+	})
+	if err != nil {
+		return peerAgent{}, err
+	}
+	return agent, nil
+}
+
+// probeResult is the result of probing one peer.
+type probeResult struct {
+	peerID    peer.ID
+	reachable bool
+}
+
+// probeMiners probes each storage provider and returns whether each probed
+// peer is reachable. Peers that were not probed, because ctx was cancelled, are
+// not in the returned map.
+func probeMiners(ctx context.Context, spInfos map[peer.ID]SPInfo, p *prober, concurrency int) map[peer.ID]bool {
+	reachable := make(map[peer.ID]bool)
+	spInfoChan := make(chan SPInfo)
+	resultChan := make(chan probeResult)
+	workers := workerCount(concurrency, len(spInfos))
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for spInfo := range spInfoChan {
+				addrInfo := peer.AddrInfo{
+					ID:    spInfo.PeerID,
+					Addrs: spInfo.Addrs,
+				}
+				err := p.probe(ctx, addrInfo)
+				// A probe cut short by cancellation says nothing about the peer.
+				if err != nil && ctx.Err() != nil {
+					continue
+				}
+				resultChan <- probeResult{
+					peerID:    spInfo.PeerID,
+					reachable: err == nil,
+				}
+			}
+			wg.Done()
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		for result := range resultChan {
+			reachable[result.peerID] = result.reachable
+		}
+		close(done)
+	}()
+feed:
+	for _, spInfo := range spInfos {
+		select {
+		case spInfoChan <- spInfo:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(spInfoChan)
+	wg.Wait()
+	close(resultChan)
+	<-done
+
+	return reachable
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+)
+
+const progressInterval = 5 * time.Second
+
+// unknownTotal is the total number of miners while it is not yet known, such
+// as while the miners are being streamed from the gateway.
+const unknownTotal = -1
+
+// progress periodically writes how many of the miners have been processed,
+// and how many of those succeeded or failed. A nil progress reports nothing.
+type progress struct {
+	w io.Writer
+
+	mu        sync.Mutex
+	total     int
+	succeeded int
+	failed    int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startProgress starts reporting progress to w every interval, until finish
+// is called.
+func startProgress(w io.Writer, total int, interval time.Duration) *progress {
+	p := &progress{
+		w:     w,
+		total: total,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.report()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// record counts one processed miner, which failed if err is not nil.
+func (p *progress) record(err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	if err != nil {
+		p.failed++
+	} else {
+		p.succeeded++
+	}
+	p.mu.Unlock()
+}
+
+// setTotal sets the total number of miners, once it is known.
+func (p *progress) setTotal(total int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.total = total
+	p.mu.Unlock()
+}
+
+// finish stops the periodic reports and writes a final report.
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.report()
+}
+
+func (p *progress) report() {
+	p.mu.Lock()
+	total, succeeded, failed := p.total, p.succeeded, p.failed
+	p.mu.Unlock()
+	if total == unknownTotal {
+		fmt.Fprintf(p.w, "Processed %d miners: %d succeeded, %d failed\n", succeeded+failed, succeeded, failed)
+		return
+	}
+	fmt.Fprintf(p.w, "Processed %d/%d miners: %d succeeded, %d failed\n", succeeded+failed, total, succeeded, failed)
+}
+
+// summary counts the outcome of each processed miner, and reports the totals
+// along with the elapsed time at the end of a run.
+type summary struct {
+	start     time.Time
+	total     int
+	succeeded int
+	noPeerID  int
+	failed    int
+}
+
+func newSummary(total int, start time.Time) *summary {
+	return &summary{
+		start: start,
+		total: total,
+	}
+}
+
+// record counts one processed miner. A miner with no peer ID is counted
+// separately from other failures.
+func (s *summary) record(err error) {
+	switch {
+	case err == nil:
+		s.succeeded++
+	case errors.Is(err, spidresolver.ErrNoPeerID):
+		s.noPeerID++
+	default:
+		s.failed++
+	}
+}
+
+// processed returns the number of miners counted.
+func (s *summary) processed() int {
+	return s.succeeded + s.noPeerID + s.failed
+}
+
+func (s *summary) write(w io.Writer) {
+	fmt.Fprintln(w, "Summary:")
+	if s.total == unknownTotal {
+		fmt.Fprintln(w, "  Total miners: unknown")
+	} else {
+		fmt.Fprintln(w, "  Total miners:", s.total)
+	}
+	fmt.Fprintln(w, "  Succeeded:   ", s.succeeded)
+	fmt.Fprintln(w, "  No peer ID:  ", s.noPeerID)
+	fmt.Fprintln(w, "  Errors:      ", s.failed)
+	fmt.Fprintln(w, "  Elapsed:     ", time.Since(s.start).Round(time.Millisecond))
+}
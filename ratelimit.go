@@ -0,0 +1,15 @@
+package main
+
+import (
+	"golang.org/x/time/rate"
+)
+
+// newRateLimiter returns a limiter, shared by all workers, that allows
+// perSecond requests per second, spaced out evenly. If perSecond is not
+// positive, requests are not limited.
+func newRateLimiter(perSecond float64) *rate.Limiter {
+	if perSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, 1)
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), 1)
+}
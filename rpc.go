@@ -0,0 +1,667 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+	"github.com/gorilla/websocket"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	jrpc "github.com/ybbus/jsonrpc/v2"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultRetries = 3
+	defaultBackoff = time.Second
+	// defaultMaxIdleConnsPerHost is more than the default number of workers,
+	// so that each worker can keep a connection to the gateway open.
+	defaultMaxIdleConnsPerHost = 100
+)
+
+// apiInfoEnv is the environment variable, in the lotus FULLNODE_API_INFO
+// format "<token>:<multiaddr>", from which the gateway and API token are read
+// when the --gateway flag is not given.
+const apiInfoEnv = "FULLNODE_API_INFO"
+
+// rpcFlags holds the flags, common to all subcommands, that configure the
+// connection to the gateway.
+type rpcFlags struct {
+	gateway   *stringList
+	rpcPath   *string
+	timeout   *time.Duration
+	token     *string
+	retries   *int
+	backoff   *time.Duration
+	rate      *float64
+	verbose   *bool
+	transport *string
+	network   *string
+	maxIdle   *int
+	// participantsMethod and minerInfoMethod are the names of the methods
+	// called in place of the standard ones.
+	participantsMethod *string
+	minerInfoMethod    *string
+	// insecureSkipVerify and caCert configure how gateway TLS certificates
+	// are verified.
+	insecureSkipVerify *bool
+	caCert             *string
+	// proxy is the URL of the proxy that HTTP RPC requests are sent through.
+	proxy *string
+	// freshHead disables reusing the chain head for spidresolver.DefaultHeadTTL.
+	freshHead *bool
+}
+
+func addRPCFlags(fs *flag.FlagSet) rpcFlags {
+	var gateways stringList
+	fs.Var(&gateways, "gateway", "Gateway host, host:port, or URL. The scheme defaults to https and the path to --rpc-path. "+
+		"Repeat, or give a comma-separated list, to try each gateway in order when a call fails. "+
+		"Defaults to the API address in $"+apiInfoEnv+", or "+defaultGateway)
+	return rpcFlags{
+		gateway: &gateways,
+		rpcPath: fs.String("rpc-path", spidresolver.DefaultRPCPath, "Path of the JSON-RPC endpoint, such as /rpc/v1, used if --gateway has no path"),
+		timeout: fs.Duration("timeout", spidresolver.DefaultTimeout, "Timeout for each RPC call"),
+		token: fs.String("token", "", "API token sent as a bearer token. Without a token only read permission is granted. "+
+			"Defaults to the token in $"+apiInfoEnv+" if --gateway is not given"),
+		retries: fs.Int("retries", defaultRetries, "Number of times to retry an RPC call that failed with a network or server error"),
+		backoff: fs.Duration("backoff", defaultBackoff, "Delay before the first retry, doubled for each subsequent retry"),
+		rate:    fs.Float64("rate", 0, "Maximum number of RPC requests per second, shared by all workers. No limit if 0"),
+		verbose: fs.Bool("verbose", false, "Log each RPC call, its arguments, duration, and result to stderr. With populate, also print every lookup error as it happens, instead of only a summary"),
+		transport: fs.String("transport", "http", "RPC transport: http, to make an HTTP request for each call, "+
+			"or ws, to send all calls over one WebSocket connection to each gateway"),
+		network: fs.String("network", spidresolver.NetworkMainnet, "Filecoin network of the gateway: mainnet, calibnet, or testnet. "+
+			"Storage provider IDs must have the network's address prefix, f for mainnet and t otherwise"),
+		maxIdle: fs.Int("max-idle-conns-per-host", defaultMaxIdleConnsPerHost, "Maximum number of idle HTTP connections kept open to each gateway for reuse by later calls"),
+		participantsMethod: fs.String("participants-method", spidresolver.MethodStateMarketParticipants, "Name of the RPC method that returns the market participants, "+
+			"for gateways that expose it under another name"),
+		minerInfoMethod: fs.String("miner-info-method", spidresolver.MethodStateMinerInfo, "Name of the RPC method that returns the miner info, "+
+			"for gateways that expose it under another name"),
+		insecureSkipVerify: fs.Bool("insecure-skip-verify", false, "Do not verify the TLS certificate of https and wss gateways. "+
+			"This lets anyone who can intercept the connection read the API token and change the results, so only use it for testing. Prefer --ca-cert"),
+		caCert: fs.String("ca-cert", "", "Also trust the CA certificates in this PEM file when verifying the TLS certificate of https and wss gateways, "+
+			"such as for a gateway with a self-signed certificate"),
+		proxy: fs.String("proxy", "", "Send RPC requests through this proxy, an http, https, or socks5 URL such as socks5://localhost:1080. "+
+			"Defaults to the proxy in $HTTPS_PROXY or $HTTP_PROXY. With --transport ws, it must be an http or socks5 URL"),
+		freshHead: fs.Bool("fresh-head", false, "Fetch the chain head for each lookup, instead of reusing one fetched less than "+
+			spidresolver.DefaultHeadTTL.String()+" ago"),
+	}
+}
+
+// newCaller returns an rpcCaller configured by the flags, for the gateways of
+// the network given by --network. An error is returned if any gateway or the
+// network is not valid.
+func (f rpcFlags) newCaller() (*rpcCaller, error) {
+	network, err := spidresolver.ParseNetwork(*f.network)
+	if err != nil {
+		return nil, err
+	}
+	// The address library only writes addresses with the network's prefix if
+	// it is set for the whole process. This is done before any lookups start,
+	// and the lookups themselves use the caller's network.
+	address.CurrentNetwork = network
+	token := *f.token
+	var gateways []string
+	for _, value := range f.gateway.values {
+		gateways = append(gateways, splitList(value)...)
+	}
+	if len(gateways) == 0 {
+		// The environment is only read when no gateway is given, and the
+		// token in it is only sent to the API address it came with, never to
+		// another gateway.
+		envToken, envGateway, err := parseAPIInfo(os.Getenv(apiInfoEnv))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", apiInfoEnv, err)
+		}
+		if envGateway != "" {
+			gateways = []string{envGateway}
+			if token == "" {
+				token = envToken
+			}
+		} else {
+			gateways = []string{defaultGateway}
+		}
+	}
+	if *f.transport != "http" && *f.transport != "ws" {
+		return nil, fmt.Errorf("unsupported transport %q", *f.transport)
+	}
+	var proxy *url.URL
+	if *f.proxy != "" {
+		var err error
+		proxy, err = parseProxyURL(*f.proxy)
+		if err != nil {
+			return nil, err
+		}
+		// The websocket dialer only connects through http and socks5 proxies.
+		if *f.transport == "ws" && proxy.Scheme == "https" {
+			return nil, errors.New("an https proxy cannot be used with the ws transport")
+		}
+	}
+	if *f.maxIdle < 1 {
+		return nil, errors.New("max-idle-conns-per-host must be at least 1")
+	}
+	methods := make(map[string]string)
+	for method, name := range map[string]string{
+		spidresolver.MethodStateMarketParticipants: *f.participantsMethod,
+		spidresolver.MethodStateMinerInfo:          *f.minerInfoMethod,
+	} {
+		if name == "" {
+			return nil, fmt.Errorf("the method name for %s cannot be empty", method)
+		}
+		if name != method {
+			methods[method] = name
+		}
+	}
+	tlsConfig, err := newTLSConfig(*f.caCert, *f.insecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	// All gateways share one transport, so that connections are pooled and
+	// reused by every worker, instead of being opened for each call.
+	transport := newHTTPTransport(*f.maxIdle, tlsConfig, proxy)
+	clients := make([]gatewayClient, len(gateways))
+	for i, gateway := range gateways {
+		thr := &throttle{}
+		if *f.transport == "ws" {
+			dialer := *websocket.DefaultDialer
+			dialer.TLSClientConfig = tlsConfig
+			if proxy != nil {
+				dialer.Proxy = http.ProxyURL(proxy)
+			}
+			client, err := spidresolver.NewWSClientWithDialer(gateway, *f.rpcPath, token, *f.timeout, &dialer)
+			if err != nil {
+				return nil, err
+			}
+			clients[i] = gatewayClient{
+				gateway:  gateway,
+				client:   client,
+				throttle: thr,
+			}
+			continue
+		}
+		httpClient := &http.Client{
+			Timeout: *f.timeout,
+			Transport: &retryAfterTransport{
+				base:         transport,
+				throttle:     thr,
+				defaultDelay: *f.backoff,
+			},
+		}
+		client, err := spidresolver.NewClientWithHTTPClient(gateway, *f.rpcPath, token, httpClient)
+		if err != nil {
+			return nil, err
+		}
+		clients[i] = gatewayClient{
+			gateway:  gateway,
+			client:   client,
+			throttle: thr,
+		}
+	}
+	caller := &rpcCaller{
+		clients: clients,
+		methods: methods,
+		network: network,
+		timeout: *f.timeout,
+		retries: *f.retries,
+		backoff: *f.backoff,
+		limiter: newRateLimiter(*f.rate),
+		log:     newLogger(os.Stderr, *f.verbose),
+	}
+	headTTL := spidresolver.DefaultHeadTTL
+	if *f.freshHead {
+		headTTL = 0
+	}
+	caller.resolver, err = spidresolver.NewResolver(spidresolver.WithCaller(caller), spidresolver.WithHeadTTL(headTTL))
+	if err != nil {
+		return nil, err
+	}
+	return caller, nil
+}
+
+// newTLSConfig returns the TLS configuration used to connect to gateways. The
+// certificates in the PEM file at caCert, if set, are trusted along with the
+// system's CAs. If insecureSkipVerify is set, certificates are not verified
+// at all. Nil is returned if neither is set, to use the default configuration.
+func newTLSConfig(caCert string, insecureSkipVerify bool) (*tls.Config, error) {
+	if caCert == "" && !insecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{}
+	if caCert != "" {
+		pem, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA certificate: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if insecureSkipVerify {
+		fmt.Fprintln(os.Stderr, "warning: gateway TLS certificates are not verified")
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig, nil
+}
+
+// parseProxyURL parses the URL of the proxy that RPC requests are sent
+// through. An error is returned if its scheme is not http, https, or socks5,
+// or it has no host.
+func parseProxyURL(proxy string) (*url.URL, error) {
+	// Without "://", a host:port is parsed as a scheme and opaque data.
+	if !strings.Contains(proxy, "://") {
+		return nil, fmt.Errorf("proxy URL %q has no scheme, it must be http, https, or socks5", proxy)
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, it must be http, https, or socks5", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("proxy URL %q has no host", proxy)
+	}
+	return u, nil
+}
+
+// newHTTPTransport returns an HTTP transport, with the same settings as
+// http.DefaultTransport, that keeps up to maxIdlePerHost idle connections
+// open to each host. If tlsConfig is not nil, it is used for TLS connections.
+// If proxy is not nil, requests are sent through it, instead of the proxy set
+// in the environment.
+func newHTTPTransport(maxIdlePerHost int, tlsConfig *tls.Config, proxy *url.URL) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	transport.MaxIdleConnsPerHost = maxIdlePerHost
+	// Only limit the idle connections per host, since there is one host per
+	// gateway.
+	transport.MaxIdleConns = 0
+	return transport
+}
+
+// parseAPIInfo parses the token and API multiaddr from apiInfo, which is in
+// the lotus API info format "<token>:<multiaddr>", or just "<multiaddr>". The
+// multiaddr is returned as an http or https URL. An empty apiInfo returns
+// empty strings.
+func parseAPIInfo(apiInfo string) (string, string, error) {
+	apiInfo = strings.TrimSpace(apiInfo)
+	if apiInfo == "" {
+		return "", "", nil
+	}
+	var token, addr string
+	if strings.HasPrefix(apiInfo, "/") {
+		addr = apiInfo
+	} else {
+		var found bool
+		token, addr, found = strings.Cut(apiInfo, ":")
+		if !found {
+			return "", "", errors.New("expected <token>:<multiaddr>")
+		}
+	}
+
+	maddr, err := multiaddr.NewMultiaddr(addr)
+	if err != nil {
+		return "", "", err
+	}
+	_, hostPort, err := manet.DialArgs(maddr)
+	if err != nil {
+		return "", "", err
+	}
+	scheme := "http"
+	for _, p := range maddr.Protocols() {
+		switch p.Code {
+		case multiaddr.P_HTTPS, multiaddr.P_TLS, multiaddr.P_WSS:
+			scheme = "https"
+		}
+	}
+	return token, scheme + "://" + hostPort, nil
+}
+
+// gatewayClient is the JSON-RPC client for one gateway.
+type gatewayClient struct {
+	gateway string
+	client  spidresolver.Client
+	// throttle pauses calls to the gateway after it responds with 429.
+	throttle *throttle
+}
+
+// rpcCaller makes RPC calls that are each limited by a timeout, and retries
+// calls that fail with transient errors. Each call is made to the first
+// gateway, and then to each following gateway if the call fails with a
+// transient error.
+type rpcCaller struct {
+	clients []gatewayClient
+	// methods maps the names of standard methods to the names called
+	// instead.
+	methods map[string]string
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+	// limiter limits the rate of calls.
+	limiter *rate.Limiter
+	// cache, if not nil, is used to avoid looking up miner info.
+	cache *minerInfoCache
+	// network is the network of the gateways, whose storage provider IDs are
+	// accepted.
+	network address.Network
+	// resolver reuses the chain head fetched by chainHead for its head TTL.
+	resolver *spidresolver.Resolver
+	log      *logger
+}
+
+// Network returns the network of the gateways, so that the spidresolver
+// functions given the caller accept its storage provider IDs.
+func (c *rpcCaller) Network() address.Network {
+	return c.network
+}
+
+// close closes the clients that keep a connection open, such as WebSocket
+// clients. A nil caller has nothing to close.
+func (c *rpcCaller) close() error {
+	if c == nil {
+		return nil
+	}
+	var err error
+	for _, gc := range c.clients {
+		if closer, ok := gc.client.(io.Closer); ok {
+			if cerr := closer.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+// callError is an error returned by an RPC call. It has the same message as
+// the error it wraps, and identifies the error as coming from the gateway
+// call, since the JSON-RPC client does not wrap network errors.
+type callError struct {
+	err error
+}
+
+func (e *callError) Error() string {
+	return e.err.Error()
+}
+
+func (e *callError) Unwrap() error {
+	return e.err
+}
+
+// CallFor makes an RPC call and decodes the result into out. A call that
+// fails with a transient error is retried, with exponential backoff and
+// jitter, up to c.retries times. A failed call returns a *callError. If the
+// method has been renamed, the new name is called.
+func (c *rpcCaller) CallFor(ctx context.Context, out interface{}, method string, params ...interface{}) error {
+	method = c.methodName(method)
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = c.callOnce(ctx, out, method, params...)
+		if err == nil {
+			return nil
+		}
+		if attempt >= c.retries || ctx.Err() != nil || !isTransient(err) {
+			return &callError{err: err}
+		}
+
+		if !c.waitRetry(ctx, method, attempt) {
+			return &callError{err: err}
+		}
+	}
+}
+
+// waitRetry waits before retrying a failed call of the method, for between
+// 1/2 and the full backoff interval, which doubles with each attempt. It
+// returns false if ctx is done first.
+func (c *rpcCaller) waitRetry(ctx context.Context, method string, attempt int) bool {
+	delay := c.backoff << attempt
+	if delay > 0 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+	c.log.debugf("retrying %s in %s", method, delay)
+	timer := time.NewTimer(delay)
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		timer.Stop()
+		return false
+	}
+}
+
+// partialResultError is an error from decoding the result of a streamed call.
+// The call is not retried, since part of the result has already been used.
+type partialResultError struct {
+	err error
+}
+
+func (e *partialResultError) Error() string {
+	return e.err.Error()
+}
+
+func (e *partialResultError) Unwrap() error {
+	return e.err
+}
+
+// CallStream makes an RPC call, and calls decodeResult with a decoder whose
+// next value is the result, as it is read from the first gateway whose client
+// can stream calls, or from the first gateway if none can. Like CallFor, a
+// call that fails with a transient error is retried, but not once the result
+// is being decoded. The call is not limited by c.timeout, since decodeResult
+// may take longer than a call, but each HTTP request is. If the method has
+// been renamed, the new name is called.
+func (c *rpcCaller) CallStream(ctx context.Context, decodeResult func(dec *json.Decoder) error, method string, params ...interface{}) error {
+	method = c.methodName(method)
+	gc := c.clients[0]
+	for _, client := range c.clients {
+		if _, ok := client.client.(spidresolver.StreamClient); ok {
+			gc = client
+			break
+		}
+	}
+	decode := func(dec *json.Decoder) error {
+		if err := decodeResult(dec); err != nil {
+			return &partialResultError{err: err}
+		}
+		return nil
+	}
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = gc.throttle.wait(ctx); err != nil {
+			return &callError{err: err}
+		}
+		if err = c.limiter.Wait(ctx); err != nil {
+			return &callError{err: err}
+		}
+		start := time.Now()
+		err = spidresolver.CallStream(ctx, gc.client, decode, method, params...)
+		if err == nil {
+			c.log.debugf("%s streamed from %s in %s", method, gc.gateway, time.Since(start))
+			return nil
+		}
+		c.log.debugf("%s failed on %s after %s: %s", method, gc.gateway, time.Since(start), err)
+		if attempt >= c.retries || ctx.Err() != nil || !isTransient(err) {
+			return &callError{err: err}
+		}
+		if !c.waitRetry(ctx, method, attempt) {
+			return &callError{err: err}
+		}
+	}
+}
+
+// methodName returns the name that is called for the standard method.
+func (c *rpcCaller) methodName(method string) string {
+	if name, ok := c.methods[method]; ok {
+		return name
+	}
+	return method
+}
+
+// callOnce makes an RPC call, trying each gateway in turn until one succeeds
+// or fails with an error that is not transient. Before each gateway is tried,
+// the call waits until the gateway is no longer throttled, and then for the
+// rate limiter.
+func (c *rpcCaller) callOnce(ctx context.Context, out interface{}, method string, params ...interface{}) error {
+	var err error
+	for i, gc := range c.clients {
+		if i != 0 {
+			c.log.debugf("%s failed on %s, trying %s", method, c.clients[i-1].gateway, gc.gateway)
+		}
+		if err = gc.throttle.wait(ctx); err != nil {
+			return err
+		}
+		if err = c.limiter.Wait(ctx); err != nil {
+			return err
+		}
+		err = c.callGateway(ctx, gc, out, method, params...)
+		if err == nil {
+			if len(c.clients) > 1 {
+				c.log.debugf("%s served by %s", method, gc.gateway)
+			}
+			return nil
+		}
+		if ctx.Err() != nil || !isTransient(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// callGateway makes an RPC call to one gateway. The call is abandoned, and
+// returns an error, if it does not complete within the timeout. Since the
+// connection of an abandoned call stays in use until the HTTP client times
+// out, a retry of the call is made on a different connection.
+func (c *rpcCaller) callGateway(ctx context.Context, gc gatewayClient, out interface{}, method string, params ...interface{}) error {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	err := spidresolver.CallFor(ctx, gc.client, out, method, params...)
+	if err != nil {
+		c.log.debugf("%s %v failed after %s: %s", method, params, time.Since(start), err)
+	} else {
+		c.log.debugf("%s %v succeeded in %s", method, params, time.Since(start))
+	}
+	return err
+}
+
+// chainHead returns the gateway's chain head, which is reused for the head TTL
+// of the caller's resolver. A caller without a resolver always fetches it.
+func (c *rpcCaller) chainHead(ctx context.Context) (spidresolver.ExpTipSet, error) {
+	if c.resolver == nil {
+		return spidresolver.ChainHead(ctx, c)
+	}
+	return c.resolver.ChainHead(ctx)
+}
+
+// marketParticipants returns the storage market participants keyed by miner ID.
+func (c *rpcCaller) marketParticipants(ctx context.Context) (map[string]spidresolver.MarketBalance, error) {
+	return spidresolver.MarketParticipants(ctx, c)
+}
+
+// minerInfo returns the miner info of the miner as of the tipset identified by
+// tsk, or as of the chain head if tsk is nil.
+func (c *rpcCaller) minerInfo(ctx context.Context, minerId string, tsk []cid.Cid) (spidresolver.MinerInfo, error) {
+	if c.cache == nil {
+		return spidresolver.StateMinerInfo(ctx, c, minerId, tsk)
+	}
+
+	// The cache is only used for a valid address, which names its files.
+	spAddress, err := spidresolver.ParseAddress(minerId, c.network)
+	if err != nil {
+		return spidresolver.MinerInfo{}, err
+	}
+	if minerInfo, ok := c.cache.get(spAddress, tsk); ok {
+		return minerInfo, nil
+	}
+
+	minerInfo, err := spidresolver.StateMinerInfo(ctx, c, minerId, tsk)
+	if err != nil {
+		return spidresolver.MinerInfo{}, err
+	}
+
+	if err = c.cache.put(spAddress, tsk, minerInfo); err != nil {
+		c.log.infof("cannot cache miner info: %s", err)
+	}
+	return minerInfo, nil
+}
+
+// isMethodNotFound reports whether the RPC error means that the gateway does
+// not have the method that was called.
+func isMethodNotFound(rpcErr *jrpc.RPCError) bool {
+	if rpcErr.Code == jsonrpcMethodNotFound {
+		return true
+	}
+	msg := strings.ToLower(rpcErr.Message)
+	return strings.Contains(msg, "not supported") ||
+		(strings.Contains(msg, "method") && strings.Contains(msg, "not found"))
+}
+
+// jsonrpcMethodNotFound is the JSON-RPC error code for a method that does not
+// exist.
+const jsonrpcMethodNotFound = -32601
+
+// isTransient returns true if the error is from a failure that may not happen
+// if the call is repeated, such as a network or server error. Errors returned
+// by the RPC method itself, such as "actor not found", are not transient.
+func isTransient(err error) bool {
+	var rpcErr *jrpc.RPCError
+	if errors.As(err, &rpcErr) {
+		return false
+	}
+	var httpErr *jrpc.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code >= 500 || httpErr.Code == http.StatusTooManyRequests
+	}
+	var statusErr *spidresolver.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	var partialErr *partialResultError
+	if errors.As(err, &partialErr) {
+		return false
+	}
+	var handshakeErr *spidresolver.HandshakeError
+	if errors.As(err, &handshakeErr) {
+		return handshakeErr.StatusCode >= 500 || handshakeErr.StatusCode == http.StatusTooManyRequests
+	}
+	// A result that cannot be decoded will be the same if the call is repeated.
+	var decodeErr *spidresolver.DecodeError
+	if errors.As(err, &decodeErr) {
+		return false
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return false
+	}
+	// Anything else, including a timed out call, is a network error.
+	return true
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+)
+
+// scanConfig holds the settings for the scan subcommand.
+type scanConfig struct {
+	// concurrency is the number of miners to scan concurrently.
+	concurrency int
+	// limit, if positive, is the number of miners to scan.
+	limit int
+	// participants selects where the market participants are read from.
+	participants participantsFlags
+	// ask enables querying the storage ask of each miner directly, over a
+	// libp2p connection to the addresses in its miner info.
+	ask bool
+	// dialTimeout is the time allowed for each direct ask query.
+	dialTimeout time.Duration
+	// formatPeerID converts peer IDs to strings for output.
+	formatPeerID peerIDFormat
+	// progress enables periodic progress reports on stderr.
+	progress bool
+}
+
+// scanFlags holds the flags of the scan subcommand.
+type scanFlags struct {
+	rpc          rpcFlags
+	participants participantsFlags
+	concurrency  *int
+	limit        *int
+	ask          *bool
+	dialTimeout  *time.Duration
+	peerIDFormat *string
+	noProgress   *bool
+}
+
+func addScanFlags(fs *flag.FlagSet) *scanFlags {
+	return &scanFlags{
+		rpc:          addRPCFlags(fs),
+		concurrency:  fs.Int("concurrency", defaultConcurrency, "Number of miners to scan concurrently"),
+		limit:        fs.Int("limit", 0, "Only scan this many miners. Mainly for debugging"),
+		ask:          fs.Bool("ask", false, "Also query the storage ask of each miner, by connecting to it with libp2p at the addresses in its miner info"),
+		dialTimeout:  fs.Duration("dial-timeout", defaultProbeTimeout, "Time allowed for connecting to a miner and reading its ask, with --ask"),
+		peerIDFormat: fs.String("peerid-format", "base58", "Peer ID output format: base58 or cidv1"),
+		noProgress:   fs.Bool("no-progress", false, "Do not report progress on stderr"),
+		participants: addParticipantsFlags(fs),
+	}
+}
+
+// runScan runs the scan subcommand.
+func runScan(ctx context.Context, f *scanFlags, args []string) error {
+	if *f.concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	formatPeerID, err := parsePeerIDFormat(*f.peerIDFormat)
+	if err != nil {
+		return err
+	}
+	caller, err := f.rpc.newCaller()
+	if err != nil {
+		return err
+	}
+	defer caller.close()
+	return scanMiners(ctx, caller, scanConfig{
+		concurrency:  *f.concurrency,
+		limit:        *f.limit,
+		participants: f.participants,
+		ask:          *f.ask,
+		dialTimeout:  *f.dialTimeout,
+		formatPeerID: formatPeerID,
+		progress:     !*f.noProgress,
+	}, os.Stdout)
+}
+
+// scanResult is the result of scanning one miner.
+type scanResult struct {
+	peerIDResult
+	ask    *spidresolver.StorageAsk
+	askErr error
+}
+
+// scanRecord is the JSON object written by scan for each miner. It has the
+// fields written by populate --format ndjson, and the miner's ask, if asks
+// are queried.
+type scanRecord struct {
+	peerIDRecord
+	Ask      *scanAsk `json:"ask,omitempty"`
+	AskError string   `json:"askError,omitempty"`
+}
+
+// scanAsk is the storage ask of a miner, with prices in attoFIL.
+type scanAsk struct {
+	Price         string `json:"price"`
+	VerifiedPrice string `json:"verifiedPrice"`
+	MinPieceSize  uint64 `json:"minPieceSize"`
+	MaxPieceSize  uint64 `json:"maxPieceSize"`
+}
+
+func newScanRecord(result scanResult, formatPeerID peerIDFormat) scanRecord {
+	rec := scanRecord{
+		peerIDRecord: peerIDRecord{
+			Miner: result.minerID,
+		},
+	}
+	switch {
+	case errors.Is(result.err, spidresolver.ErrNoPeerID):
+		rec.NoPeerID = true
+	case result.err != nil:
+		rec.Error = result.err.Error()
+	default:
+		rec.PeerID = formatPeerID(result.addrInfo.ID)
+		for _, a := range result.addrInfo.Addrs {
+			rec.Addrs = append(rec.Addrs, a.String())
+		}
+	}
+	if result.askErr != nil {
+		rec.AskError = result.askErr.Error()
+	} else if result.ask != nil {
+		rec.Ask = &scanAsk{
+			Price:         result.ask.Price.String(),
+			VerifiedPrice: result.ask.VerifiedPrice.String(),
+			MinPieceSize:  result.ask.MinPieceSize,
+			MaxPieceSize:  result.ask.MaxPieceSize,
+		}
+	}
+	return rec
+}
+
+// scanMiners looks up the peer ID and addresses of every market participant,
+// and, if cfg.ask is set, queries its storage ask directly from the miner
+// using those addresses. Each miner's info is fetched with a single RPC call,
+// instead of once by populate and again by query-asks. A JSON record is
+// written to w for each miner as its scan completes.
+func scanMiners(ctx context.Context, caller *rpcCaller, cfg scanConfig, w io.Writer) error {
+	start := time.Now()
+	minerList, err := populateMinerList(ctx, caller, cfg.participants, cfg.limit, false, nil)
+	if err != nil {
+		return err
+	}
+
+	var asker *directAsker
+	if cfg.ask {
+		asker, err = newDirectAsker(cfg.dialTimeout)
+		if err != nil {
+			return fmt.Errorf("cannot create libp2p host: %w", err)
+		}
+		defer asker.close()
+	}
+
+	stats := newSummary(len(minerList), start)
+	defer stats.write(os.Stderr)
+	var prog *progress
+	if cfg.progress {
+		prog = startProgress(os.Stderr, len(minerList), progressInterval)
+	}
+
+	minerChan := make(chan string)
+	resultChan := make(chan scanResult)
+	workers := workerCount(cfg.concurrency, len(minerList))
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for minerId := range minerChan {
+				result := scanMiner(ctx, minerId, caller, asker)
+				// Do not report miners whose scan was interrupted.
+				if (result.err != nil || result.askErr != nil) && ctx.Err() != nil {
+					continue
+				}
+				resultChan <- result
+			}
+			wg.Done()
+		}()
+	}
+	var processed int64
+	var failed int
+	writeErr := make(chan error, 1)
+	go func() {
+		enc := json.NewEncoder(w)
+		var err error
+		for result := range resultChan {
+			processed++
+			prog.record(result.err)
+			stats.record(result.err)
+			if result.err != nil && !errors.Is(result.err, spidresolver.ErrNoPeerID) {
+				failed++
+			}
+			// After a write error, keep draining results so workers finish.
+			if err == nil {
+				err = enc.Encode(newScanRecord(result, cfg.formatPeerID))
+			}
+		}
+		writeErr <- err
+	}()
+	feedMiners(ctx, minerList, minerChan)
+	wg.Wait()
+	close(resultChan)
+	prog.finish()
+
+	if err = <-writeErr; err != nil {
+		return err
+	}
+	reportInterrupted(ctx, processed, len(minerList))
+	if failed != 0 && failed == len(minerList) {
+		return fmt.Errorf("lookup failed for all %d miners", failed)
+	}
+	return ctx.Err()
+}
+
+// scanMiner looks up the peer ID and addresses of the miner, and, if asker is
+// not nil, queries the miner's storage ask using them.
+func scanMiner(ctx context.Context, minerId string, caller *rpcCaller, asker *directAsker) scanResult {
+	addrInfo, err := lookupMinerAddrInfo(ctx, minerId, caller, nil)
+	result := scanResult{
+		peerIDResult: peerIDResult{
+			minerID:  minerId,
+			addrInfo: addrInfo,
+			err:      err,
+		},
+	}
+	if err == nil && asker != nil {
+		result.ask, result.askErr = asker.queryAsk(ctx, minerId, addrInfo)
+	}
+	return result
+}
@@ -0,0 +1,53 @@
+package main
+
+import "sort"
+
+// sortedWriter buffers peer ID lookup results and writes them to w, ordered
+// by miner ID, when flushed.
+type sortedWriter struct {
+	w       resultWriter
+	results []peerIDResult
+}
+
+func (sw *sortedWriter) write(result peerIDResult) error {
+	sw.results = append(sw.results, result)
+	return nil
+}
+
+func (sw *sortedWriter) flush() error {
+	sort.Slice(sw.results, func(i, j int) bool {
+		return lessMinerID(sw.results[i].minerID, sw.results[j].minerID)
+	})
+	for _, result := range sw.results {
+		if err := sw.w.write(result); err != nil {
+			return err
+		}
+	}
+	sw.results = nil
+	return sw.w.flush()
+}
+
+// sortedAskWriter buffers query-ask results and writes them to w, ordered by
+// miner ID, when flushed.
+type sortedAskWriter struct {
+	w       askWriter
+	results []queryAskResult
+}
+
+func (sw *sortedAskWriter) write(result queryAskResult) error {
+	sw.results = append(sw.results, result)
+	return nil
+}
+
+func (sw *sortedAskWriter) flush() error {
+	sort.Slice(sw.results, func(i, j int) bool {
+		return lessMinerID(sw.results[i].minerID, sw.results[j].minerID)
+	})
+	for _, result := range sw.results {
+		if err := sw.w.write(result); err != nil {
+			return err
+		}
+	}
+	sw.results = nil
+	return sw.w.flush()
+}
@@ -0,0 +1,56 @@
+package spidresolver
+
+import (
+	"context"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+)
+
+// Account is an address from a miner's info, with its ID and key forms.
+type Account struct {
+	// Role is the use of the address: Owner, Worker, New Worker or Control.
+	Role string
+	// Addr is the address as given in the miner info.
+	Addr address.Address
+	// ID and Key are the ID and public key forms of Addr. Either is
+	// address.Undef if it could not be looked up.
+	ID  address.Address
+	Key address.Address
+	// Err is the reason ID or Key could not be looked up. Actors that are not
+	// accounts, such as multisigs, have no key address.
+	Err error
+}
+
+// Resolved returns true if both the ID and key forms of the address were
+// found.
+func (a Account) Resolved() bool {
+	return a.Err == nil
+}
+
+// ResolveAccounts looks up the ID and key forms of the owner, worker, and
+// control addresses in minerInfo, as of the tipset identified by tsk. A
+// failed lookup is recorded in the Account, and does not prevent looking up
+// the other addresses.
+func ResolveAccounts(ctx context.Context, caller Caller, minerInfo MinerInfo, tsk []cid.Cid) []Account {
+	accounts := []Account{
+		{Role: "Owner", Addr: minerInfo.Owner},
+		{Role: "Worker", Addr: minerInfo.Worker},
+	}
+	if minerInfo.NewWorker != address.Undef {
+		accounts = append(accounts, Account{Role: "New Worker", Addr: minerInfo.NewWorker})
+	}
+	for _, addr := range minerInfo.ControlAddresses {
+		accounts = append(accounts, Account{Role: "Control", Addr: addr})
+	}
+
+	for i := range accounts {
+		acct := &accounts[i]
+		acct.ID, acct.Err = StateLookupID(ctx, caller, acct.Addr, tsk)
+		if acct.Err != nil {
+			continue
+		}
+		acct.Key, acct.Err = StateAccountKey(ctx, caller, acct.Addr, tsk)
+	}
+	return accounts
+}
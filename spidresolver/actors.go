@@ -0,0 +1,90 @@
+package spidresolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// ErrNotMiner is returned when a storage provider ID is the address of an
+// actor that is not a storage miner, such as an account.
+var ErrNotMiner = errors.New("address is not a storage miner actor")
+
+// minerActorName is the name of the storage miner actor in the builtin actors
+// manifest.
+const minerActorName = "storageminer"
+
+// ActorNames maps the code CIDs of the builtin actors to their names, such as
+// "account" or "storageminer".
+type ActorNames map[cid.Cid]string
+
+// Name returns the name of the builtin actor with the given code CID, or an
+// empty string if it is not known. Actors from before network version 16 have
+// code CIDs that contain their name, such as "fil/7/storageminer", and are
+// named without looking them up.
+func (n ActorNames) Name(code cid.Cid) string {
+	if code.Prefix().MhType == multihash.IDENTITY {
+		decoded, err := multihash.Decode(code.Hash())
+		if err == nil {
+			return path.Base(string(decoded.Digest))
+		}
+	}
+	return n[code]
+}
+
+// StateGetActor returns the actor at the address spid, as of the tipset identified by tsk.
+func StateGetActor(ctx context.Context, caller Caller, spid string, tsk []cid.Cid) (Actor, error) {
+	spAddress, err := ParseAddress(spid, callerNetwork(caller))
+	if err != nil {
+		return Actor{}, err
+	}
+
+	var actor Actor
+	err = caller.CallFor(ctx, &actor, "Filecoin.StateGetActor", spAddress, tsk)
+	if err != nil {
+		return Actor{}, err
+	}
+	return actor, nil
+}
+
+// GetActorNames returns the names of the builtin actors for the network
+// version of the tipset identified by tsk.
+func GetActorNames(ctx context.Context, caller Caller, tsk []cid.Cid) (ActorNames, error) {
+	var version uint64
+	err := caller.CallFor(ctx, &version, "Filecoin.StateNetworkVersion", tsk)
+	if err != nil {
+		return nil, err
+	}
+	var codes map[string]cid.Cid
+	err = caller.CallFor(ctx, &codes, "Filecoin.StateActorCodeCIDs", version)
+	if err != nil {
+		return nil, err
+	}
+	names := make(ActorNames, len(codes))
+	for name, code := range codes {
+		names[code] = name
+	}
+	return names, nil
+}
+
+// CheckMinerActor returns an error that wraps ErrNotMiner if spid is not the
+// address of a storage miner actor, as of the tipset identified by tsk. The
+// actor's code CID is named using names.
+func CheckMinerActor(ctx context.Context, caller Caller, spid string, tsk []cid.Cid, names ActorNames) error {
+	actor, err := StateGetActor(ctx, caller, spid, tsk)
+	if err != nil {
+		return err
+	}
+	switch name := names.Name(actor.Code); name {
+	case minerActorName:
+		return nil
+	case "":
+		return fmt.Errorf("%w: %s has unknown actor code %s", ErrNotMiner, spid, actor.Code)
+	default:
+		return fmt.Errorf("%w: %s is a %s actor", ErrNotMiner, spid, name)
+	}
+}
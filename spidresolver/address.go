@@ -0,0 +1,92 @@
+package spidresolver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/filecoin-project/go-address"
+)
+
+// maxIDLength is the length of the largest actor ID, math.MaxInt64, written
+// in decimal.
+const maxIDLength = 19
+
+// validateAddress checks that spid is a well formed filecoin address of the
+// network, and returns an error describing the first problem found. The address
+// library only reports that an address is invalid, which does not help someone
+// find a typo.
+func validateAddress(spid string, network address.Network) error {
+	if spid == "" {
+		return fmt.Errorf("%w: storage provider ID is empty", ErrInvalidAddress)
+	}
+	if len(spid) < 3 {
+		return fmt.Errorf("%w: %q is too short, a storage provider ID looks like f01234", ErrInvalidAddress, spid)
+	}
+	if len(spid) > address.MaxAddressStringLength {
+		return fmt.Errorf("%w: %q is too long, a storage provider ID looks like f01234", ErrInvalidAddress, spid)
+	}
+	if strings.ToLower(spid) != spid {
+		return fmt.Errorf("%w: %s has upper case letters, filecoin addresses are lower case", ErrInvalidAddress, spid)
+	}
+
+	prefix := address.MainnetPrefix
+	if network == address.Testnet {
+		prefix = address.TestnetPrefix
+	}
+	switch spid[:1] {
+	case prefix:
+	case address.MainnetPrefix, address.TestnetPrefix:
+		return fmt.Errorf("%w: %s is not a %s network address, it must start with %q", ErrInvalidAddress, spid, prefixNetwork(prefix), prefix)
+	default:
+		return fmt.Errorf("%w: bad network prefix %q in %s, it must be %q for %s", ErrInvalidAddress, spid[:1], spid, prefix, prefixNetwork(prefix))
+	}
+
+	raw := spid[2:]
+	var protocol address.Protocol
+	switch spid[1] {
+	case '0':
+		if len(raw) > maxIDLength {
+			return fmt.Errorf("%w: actor ID in %s is too long, it can have at most %d digits", ErrInvalidAddress, spid, maxIDLength)
+		}
+		if _, err := strconv.ParseUint(raw, 10, 63); err != nil {
+			return fmt.Errorf("%w: actor ID %q in %s must be a decimal number", ErrInvalidAddress, raw, spid)
+		}
+		return nil
+	case '1':
+		protocol = address.SECP256K1
+	case '2':
+		protocol = address.Actor
+	case '3':
+		protocol = address.BLS
+	default:
+		return fmt.Errorf("%w: bad protocol %q in %s, it must be 0 (ID), 1 (secp256k1), 2 (actor), or 3 (BLS)", ErrInvalidAddress, spid[1:2], spid)
+	}
+
+	payloadCksum, err := address.AddressEncoding.WithPadding(-1).DecodeString(raw)
+	if err != nil {
+		return fmt.Errorf("%w: %s has characters other than a-z and 2-7 after the protocol", ErrInvalidAddress, spid)
+	}
+	payloadLen := address.PayloadHashLength
+	if protocol == address.BLS {
+		payloadLen = address.BlsPublicKeyBytes
+	}
+	if len(payloadCksum) != payloadLen+address.ChecksumHashLength {
+		return fmt.Errorf("%w: wrong length, %s has %d bytes of payload and checksum, want %d", ErrInvalidAddress,
+			spid, len(payloadCksum), payloadLen+address.ChecksumHashLength)
+	}
+	payload := payloadCksum[:payloadLen]
+	cksum := payloadCksum[payloadLen:]
+	if !address.ValidateChecksum(append([]byte{byte(protocol)}, payload...), cksum) {
+		return fmt.Errorf("%w: bad checksum in %s, check it for mistyped characters", ErrInvalidAddress, spid)
+	}
+	return nil
+}
+
+// prefixNetwork describes the networks that use the address prefix.
+func prefixNetwork(prefix string) string {
+	if prefix == address.MainnetPrefix {
+		return NetworkMainnet
+	}
+	return NetworkCalibnet + " or " + NetworkTestnet
+}
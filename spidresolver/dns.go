@@ -0,0 +1,87 @@
+package spidresolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/multiformats/go-multiaddr"
+	madns "github.com/multiformats/go-multiaddr-dns"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// ErrNoIP is returned by AddrIP for a multiaddr that has no IP address, such
+// as a DNS multiaddr that resolves to none.
+var ErrNoIP = errors.New("multiaddr has no IP address")
+
+// ResolveDNS resolves the dns, dns4, dns6, and dnsaddr multiaddrs in addrs to
+// IP-based multiaddrs. The returned list contains the original addresses
+// followed by the resolved addresses, with duplicates removed.
+//
+// If some addresses cannot be resolved, the addresses that were resolved are
+// still returned along with an error describing the failures.
+func ResolveDNS(ctx context.Context, addrs []multiaddr.Multiaddr) ([]multiaddr.Multiaddr, error) {
+	return resolveDNS(ctx, madns.DefaultResolver, addrs)
+}
+
+func resolveDNS(ctx context.Context, resolver *madns.Resolver, addrs []multiaddr.Multiaddr) ([]multiaddr.Multiaddr, error) {
+	seen := make(map[string]struct{}, len(addrs))
+	resolved := make([]multiaddr.Multiaddr, 0, len(addrs))
+	add := func(maddr multiaddr.Multiaddr) {
+		key := string(maddr.Bytes())
+		if _, ok := seen[key]; ok {
+			return
+		}
+		seen[key] = struct{}{}
+		resolved = append(resolved, maddr)
+	}
+
+	for _, maddr := range addrs {
+		add(maddr)
+	}
+
+	var failed []string
+	for _, maddr := range addrs {
+		if !madns.Matches(maddr) {
+			continue
+		}
+		rmaddrs, err := resolver.Resolve(ctx, maddr)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", maddr, err))
+			continue
+		}
+		for _, rmaddr := range rmaddrs {
+			add(rmaddr)
+		}
+	}
+
+	if len(failed) != 0 {
+		return resolved, fmt.Errorf("cannot resolve %d addresses: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return resolved, nil
+}
+
+// AddrIP returns the IP address of the multiaddr. A DNS multiaddr is resolved
+// first, and the IP address of the first resolved multiaddr is returned.
+func AddrIP(ctx context.Context, maddr multiaddr.Multiaddr) (net.IP, error) {
+	return addrIP(ctx, madns.DefaultResolver, maddr)
+}
+
+func addrIP(ctx context.Context, resolver *madns.Resolver, maddr multiaddr.Multiaddr) (net.IP, error) {
+	addrs := []multiaddr.Multiaddr{maddr}
+	if madns.Matches(maddr) {
+		var err error
+		addrs, err = resolver.Resolve(ctx, maddr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve %s: %w", maddr, err)
+		}
+	}
+	for _, a := range addrs {
+		if ip, err := manet.ToIP(a); err == nil {
+			return ip, nil
+		}
+	}
+	return nil, ErrNoIP
+}
@@ -0,0 +1,61 @@
+package spidresolver
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// fakeClient is a Client that returns canned results, or errors, by method.
+// It may be called concurrently.
+type fakeClient struct {
+	results map[string]interface{}
+	errs    map[string]error
+	calls   []string
+	mu      sync.Mutex
+}
+
+func (c *fakeClient) CallFor(out interface{}, method string, params ...interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, method)
+	if err, ok := c.errs[method]; ok {
+		return err
+	}
+	result, ok := c.results[method]
+	if !ok {
+		return fmt.Errorf("method %s not found", method)
+	}
+	// Round-trip through JSON, as the real client does.
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// emptyOnceClient is a fakeClient that returns no market participants the
+// first time they are requested.
+type emptyOnceClient struct {
+	fakeClient
+}
+
+func (c *emptyOnceClient) CallFor(out interface{}, method string, params ...interface{}) error {
+	if method == "Filecoin.StateMarketParticipants" && len(c.calls) == 0 {
+		c.calls = append(c.calls, method)
+		return json.Unmarshal([]byte("{}"), out)
+	}
+	return c.fakeClient.CallFor(out, method, params...)
+}
+
+// recordingLogger is a Logger that keeps the messages logged to it.
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Printf(format string, args ...interface{}) {
+	l.mu.Lock()
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+	l.mu.Unlock()
+}
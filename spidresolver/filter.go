@@ -0,0 +1,192 @@
+package spidresolver
+
+import (
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// AddrFilter reports whether a multiaddr should be kept.
+type AddrFilter func(multiaddr.Multiaddr) bool
+
+// HasProtocol returns an AddrFilter that keeps multiaddrs containing at least
+// one of the named protocols, such as "tcp" or "quic". An error is returned if
+// any name is not a known multiaddr protocol.
+func HasProtocol(names ...string) (AddrFilter, error) {
+	codes := make(map[int]struct{}, len(names))
+	for _, name := range names {
+		p := multiaddr.ProtocolWithName(name)
+		if p.Code == 0 {
+			return nil, fmt.Errorf("unknown multiaddr protocol %q", name)
+		}
+		codes[p.Code] = struct{}{}
+	}
+
+	return func(maddr multiaddr.Multiaddr) bool {
+		for _, p := range maddr.Protocols() {
+			if _, ok := codes[p.Code]; ok {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// IPVersion returns an AddrFilter that keeps multiaddrs for IP version 4 or
+// 6, and drops those for the other version. A multiaddr with an ip4 or dns4
+// component is IPv4, and one with an ip6 or dns6 component is IPv6. Multiaddrs
+// that are neither, such as /dns or /dnsaddr, are kept.
+func IPVersion(version int) (AddrFilter, error) {
+	var drop []int
+	switch version {
+	case 4:
+		drop = []int{multiaddr.P_IP6, multiaddr.P_DNS6}
+	case 6:
+		drop = []int{multiaddr.P_IP4, multiaddr.P_DNS4}
+	default:
+		return nil, fmt.Errorf("invalid IP version %d", version)
+	}
+
+	return func(maddr multiaddr.Multiaddr) bool {
+		for _, p := range maddr.Protocols() {
+			if p.Code == drop[0] || p.Code == drop[1] {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// NoPrivateAddr is an AddrFilter that drops multiaddrs for IP addresses that
+// cannot be reached from other networks: private (RFC 1918 and RFC 4193),
+// loopback, link-local, and unspecified addresses. Multiaddrs that do not start
+// with an IP address, such as /dns multiaddrs, are kept.
+func NoPrivateAddr(maddr multiaddr.Multiaddr) bool {
+	ip, err := manet.ToIP(maddr)
+	if err != nil {
+		return true
+	}
+	return !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsUnspecified()
+}
+
+// NoRelay is an AddrFilter that drops p2p-circuit relay multiaddrs.
+func NoRelay(maddr multiaddr.Multiaddr) bool {
+	return !IsRelayAddr(maddr)
+}
+
+// IsRelayAddr reports whether the multiaddr is a p2p-circuit relay address.
+func IsRelayAddr(maddr multiaddr.Multiaddr) bool {
+	for _, p := range maddr.Protocols() {
+		if p.Code == multiaddr.P_CIRCUIT {
+			return true
+		}
+	}
+	return false
+}
+
+// RelayOnly reports whether addrs is not empty and all of its multiaddrs are
+// relay addresses, meaning the peer can only be reached through a relay.
+func RelayOnly(addrs []multiaddr.Multiaddr) bool {
+	if len(addrs) == 0 {
+		return false
+	}
+	for _, maddr := range addrs {
+		if !IsRelayAddr(maddr) {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterAddrs returns the multiaddrs that are accepted by all of the filters.
+// The filtering is done in place, so addrs is modified.
+func FilterAddrs(addrs []multiaddr.Multiaddr, filters ...AddrFilter) []multiaddr.Multiaddr {
+	kept := addrs[:0]
+	for _, maddr := range addrs {
+		if acceptAddr(maddr, filters) {
+			kept = append(kept, maddr)
+		}
+	}
+	return kept
+}
+
+func acceptAddr(maddr multiaddr.Multiaddr, filters []AddrFilter) bool {
+	for _, filter := range filters {
+		if !filter(maddr) {
+			return false
+		}
+	}
+	return true
+}
+
+// WithP2P returns the multiaddrs with a /p2p component for peerID appended,
+// so that each one can be dialed on its own. A multiaddr that already ends with
+// a p2p component is returned unchanged. A relay address, which ends with
+// p2p-circuit, has the peer ID appended after the relay's.
+func WithP2P(addrs []multiaddr.Multiaddr, peerID peer.ID) ([]multiaddr.Multiaddr, error) {
+	p2p, err := multiaddr.NewComponent("p2p", peerID.String())
+	if err != nil {
+		return nil, err
+	}
+	out := make([]multiaddr.Multiaddr, len(addrs))
+	for i, maddr := range addrs {
+		if _, last := multiaddr.SplitLast(maddr); last != nil && last.Protocol().Code == multiaddr.P_P2P {
+			out[i] = maddr
+			continue
+		}
+		out[i] = maddr.Encapsulate(p2p)
+	}
+	return out, nil
+}
+
+// Transport names returned by TransportOf.
+const (
+	TransportTCP          = "tcp"
+	TransportQUIC         = "quic"
+	TransportWebSocket    = "websocket"
+	TransportWebTransport = "webtransport"
+	TransportOther        = "other"
+)
+
+// TransportOf classifies the multiaddr by the transport used to reach it, by
+// looking at its protocol stack. WebTransport, which runs over QUIC, and
+// WebSocket, which runs over TCP, are reported as their own transports.
+// Multiaddrs that fit none of the known transports are TransportOther.
+func TransportOf(maddr multiaddr.Multiaddr) string {
+	var tcp, quic, ws bool
+	for _, p := range maddr.Protocols() {
+		switch p.Code {
+		case multiaddr.P_WEBTRANSPORT:
+			return TransportWebTransport
+		case multiaddr.P_WS, multiaddr.P_WSS:
+			ws = true
+		case multiaddr.P_QUIC, multiaddr.P_QUIC_V1:
+			quic = true
+		case multiaddr.P_TCP:
+			tcp = true
+		}
+	}
+	switch {
+	case ws:
+		return TransportWebSocket
+	case quic:
+		return TransportQUIC
+	case tcp:
+		return TransportTCP
+	}
+	return TransportOther
+}
+
+// GroupByTransport returns the multiaddrs, as strings, keyed by the transport
+// that TransportOf classifies them as. Transports with no multiaddrs are not
+// included, and the multiaddrs keep their order within each transport.
+func GroupByTransport(addrs []multiaddr.Multiaddr) map[string][]string {
+	groups := make(map[string][]string)
+	for _, maddr := range addrs {
+		transport := TransportOf(maddr)
+		groups[transport] = append(groups[transport], maddr.String())
+	}
+	return groups
+}
@@ -0,0 +1,115 @@
+package spidresolver
+
+// OutputVersion is the version of the JSON output format of the
+// spidtoaddrinfo commands. It is increased when a field is removed or its
+// meaning is changed, but not when a field is added.
+const OutputVersion = 1
+
+// Output is the envelope of each JSON value written by the spidtoaddrinfo
+// commands. Result is a FindResult or a ChainHeadResult, depending on the
+// command, or a FindSummary after the results of find --summary. With find
+// --fields, Result is an object with only the selected fields. Errors are written as an ErrorResult, without an envelope.
+type Output[T any] struct {
+	Version int `json:"version"`
+	Result  T   `json:"result"`
+}
+
+// NewOutput returns result in an envelope with the current OutputVersion.
+func NewOutput[T any](result T) Output[T] {
+	return Output[T]{
+		Version: OutputVersion,
+		Result:  result,
+	}
+}
+
+// ErrorResult is the JSON output written in place of a result when a command
+// using JSON output fails. SPID is the storage provider that could not be
+// looked up, and Line is the input line it was read from, if any.
+type ErrorResult struct {
+	Error string `json:"error"`
+	SPID  string `json:"spid,omitempty"`
+	Line  int    `json:"line,omitempty"`
+}
+
+// ChainHeadResult is the JSON output of the chain-head command.
+type ChainHeadResult struct {
+	Height int64    `json:"height"`
+	Cids   []string `json:"cids"`
+}
+
+// FindResult is the JSON output of the find command for one storage provider.
+// Fields for information that was not requested are omitted.
+type FindResult struct {
+	StorageProvider string   `json:"storageProvider"`
+	PeerID          string   `json:"peerId"`
+	Addrs           []string `json:"addrs"`
+	// AddrsByTransport has the same addresses as Addrs, keyed by the
+	// transport that TransportOf classifies them as. It is only included if
+	// requested.
+	AddrsByTransport map[string][]string `json:"addrsByTransport,omitempty"`
+	// Countries has the ISO country code of the addresses whose country was
+	// looked up, keyed by address.
+	Countries map[string]string `json:"countries,omitempty"`
+	// RelayOnly is true if all of the storage provider's addresses, before
+	// filtering, are p2p-circuit relay addresses.
+	RelayOnly bool            `json:"relayOnly,omitempty"`
+	Power     *PowerResult    `json:"power,omitempty"`
+	Balance   *BalanceResult  `json:"balance,omitempty"`
+	Accounts  []AccountResult `json:"accounts,omitempty"`
+	Agent     *AgentResult    `json:"agent,omitempty"`
+	// Skipped describes the multiaddrs that could not be parsed.
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// PowerResult is the power of a storage provider, in bytes, as decimal
+// strings.
+type PowerResult struct {
+	RawBytePower    string `json:"rawBytePower"`
+	QualityAdjPower string `json:"qualityAdjPower"`
+}
+
+// BalanceResult is the balance of a storage provider, in attoFIL, as decimal
+// strings. Escrow and Locked are its funds in the storage market, and
+// Available is the balance of the miner actor that can be withdrawn.
+type BalanceResult struct {
+	Escrow    string `json:"escrow"`
+	Locked    string `json:"locked"`
+	Available string `json:"available"`
+}
+
+// FindSummary is the JSON output of find --summary, written after the results
+// of the storage providers. It has an entry for each storage provider, in the
+// order they were given.
+type FindSummary struct {
+	Providers []ProviderSummary `json:"providers"`
+}
+
+// ProviderSummary is whether a storage provider was resolved, and how many
+// addresses it has. Error is the reason it was not resolved. Reachable is only
+// included if its peer was connected to, with find --agent.
+type ProviderSummary struct {
+	StorageProvider string `json:"storageProvider"`
+	Resolved        bool   `json:"resolved"`
+	Addrs           int    `json:"addrs"`
+	Reachable       *bool  `json:"reachable,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+// AgentResult is what a storage provider's peer reported about itself in the
+// libp2p identify exchange. Status is "reachable", or "unreachable" if the
+// peer could not be connected to, and then the versions are empty.
+type AgentResult struct {
+	Status          string `json:"status"`
+	AgentVersion    string `json:"agentVersion,omitempty"`
+	ProtocolVersion string `json:"protocolVersion,omitempty"`
+}
+
+// AccountResult is the JSON form of an Account. ID and Key are empty if they
+// could not be looked up, and Error gives the reason.
+type AccountResult struct {
+	Role  string `json:"role"`
+	Addr  string `json:"addr"`
+	ID    string `json:"id,omitempty"`
+	Key   string `json:"key,omitempty"`
+	Error string `json:"error,omitempty"`
+}
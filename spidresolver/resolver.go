@@ -0,0 +1,232 @@
+package spidresolver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// DefaultHeadTTL is the default time that a Resolver reuses the chain head it
+// fetched, which is the time between Filecoin epochs.
+const DefaultHeadTTL = 30 * time.Second
+
+// Logger receives messages about problems that do not stop a Resolver lookup,
+// such as miner multiaddrs that cannot be parsed. It is satisfied by
+// *log.Logger.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// nopLogger is the Logger used when none is given.
+type nopLogger struct{}
+
+func (nopLogger) Printf(string, ...interface{}) {}
+
+// Option configures a Resolver.
+type Option func(*resolverConfig)
+
+type resolverConfig struct {
+	gateway string
+	rpcPath string
+	token   string
+	timeout time.Duration
+	client  Client
+	caller  Caller
+	logger  Logger
+	headTTL time.Duration
+	network address.Network
+}
+
+// WithGateway sets the gateway that RPC calls are made to, as described by
+// GatewayURL.
+func WithGateway(gateway string) Option {
+	return func(cfg *resolverConfig) {
+		cfg.gateway = gateway
+	}
+}
+
+// WithRPCPath sets the path of the JSON-RPC endpoint, used if the gateway has
+// no path.
+func WithRPCPath(rpcPath string) Option {
+	return func(cfg *resolverConfig) {
+		cfg.rpcPath = rpcPath
+	}
+}
+
+// WithToken sets the API token sent as a bearer token with each call.
+func WithToken(token string) Option {
+	return func(cfg *resolverConfig) {
+		cfg.token = token
+	}
+}
+
+// WithTimeout sets the time limit for each RPC call. The default is
+// DefaultTimeout, and zero means no limit.
+func WithTimeout(timeout time.Duration) Option {
+	return func(cfg *resolverConfig) {
+		cfg.timeout = timeout
+	}
+}
+
+// WithClient sets the JSON-RPC client used to make calls, instead of creating
+// one for the gateway.
+func WithClient(client Client) Option {
+	return func(cfg *resolverConfig) {
+		cfg.client = client
+	}
+}
+
+// WithCaller sets the Caller used to make calls, such as one that retries
+// failed calls. The gateway, token, timeout, client, and network options are
+// not used. The network is that of the caller, if it is a NetworkCaller, and
+// mainnet otherwise.
+func WithCaller(caller Caller) Option {
+	return func(cfg *resolverConfig) {
+		cfg.caller = caller
+	}
+}
+
+// WithNetwork sets the network of the gateway, whose storage provider IDs are
+// accepted. The default is mainnet.
+func WithNetwork(network address.Network) Option {
+	return func(cfg *resolverConfig) {
+		cfg.network = network
+	}
+}
+
+// WithLogger sets the Logger that receives messages about problems that do not
+// stop a lookup. By default, these are not logged.
+func WithLogger(logger Logger) Option {
+	return func(cfg *resolverConfig) {
+		cfg.logger = logger
+	}
+}
+
+// WithHeadTTL sets how long the chain head is reused once fetched, so that
+// the lookups made within that time are all as of the same tipset, and the
+// chain head is not fetched for each one. The default is DefaultHeadTTL, and
+// zero fetches a fresh chain head for each lookup.
+func WithHeadTTL(ttl time.Duration) Option {
+	return func(cfg *resolverConfig) {
+		cfg.headTTL = ttl
+	}
+}
+
+// Resolver looks up storage providers using one gateway connection, and the
+// configuration it was created with.
+type Resolver struct {
+	caller  Caller
+	client  Client
+	logger  Logger
+	headTTL time.Duration
+
+	// headMu protects head and headTime, the chain head last fetched and
+	// when it was fetched.
+	headMu   sync.Mutex
+	head     ExpTipSet
+	headTime time.Time
+}
+
+// NewResolver returns a Resolver configured by the options. A gateway, client,
+// or caller must be given.
+func NewResolver(opts ...Option) (*Resolver, error) {
+	cfg := resolverConfig{
+		timeout: DefaultTimeout,
+		logger:  nopLogger{},
+		headTTL: DefaultHeadTTL,
+		network: address.Mainnet,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.headTTL < 0 {
+		return nil, errors.New("head TTL must not be negative")
+	}
+
+	r := &Resolver{
+		caller:  cfg.caller,
+		logger:  cfg.logger,
+		headTTL: cfg.headTTL,
+	}
+	if r.caller != nil {
+		return r, nil
+	}
+	r.client = cfg.client
+	if r.client == nil {
+		if cfg.gateway == "" {
+			return nil, errors.New("a gateway, client, or caller is required")
+		}
+		var err error
+		r.client, err = NewClient(cfg.gateway, cfg.rpcPath, cfg.token, cfg.timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.caller = NewNetworkCaller(r.client, cfg.network)
+	return r, nil
+}
+
+// Close closes the JSON-RPC client, if it was created or given with
+// WithClient and can be closed, such as a WSClient.
+func (r *Resolver) Close() error {
+	if closer, ok := r.client.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// ChainHead returns the gateway's current chain head. A chain head fetched
+// less than the head TTL ago is reused. Concurrent calls share one fetch.
+func (r *Resolver) ChainHead(ctx context.Context) (ExpTipSet, error) {
+	r.headMu.Lock()
+	defer r.headMu.Unlock()
+	if r.headTTL > 0 && !r.headTime.IsZero() && time.Since(r.headTime) < r.headTTL {
+		return r.head, nil
+	}
+	ets, err := ChainHead(ctx, r.caller)
+	if err != nil {
+		return ExpTipSet{}, err
+	}
+	r.head = ets
+	r.headTime = time.Now()
+	return ets, nil
+}
+
+// SpidToAddrInfo looks up the storage provider identified by spid, using the
+// gateway's current chain head, and returns its peer ID and multiaddrs. Only
+// multiaddrs accepted by all of the filters are returned. Multiaddrs that
+// cannot be parsed are left out and logged. Calls made within the head TTL use
+// the same chain head.
+func (r *Resolver) SpidToAddrInfo(ctx context.Context, spid string, filters ...AddrFilter) (peer.AddrInfo, error) {
+	ets, err := r.ChainHead(ctx)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+
+	minerInfo, err := StateMinerInfo(ctx, r.caller, spid, ets.Cids)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+
+	_, invalid := ParseMultiaddrs(minerInfo.Multiaddrs)
+	for _, err = range invalid {
+		r.logger.Printf("%s: %s", spid, err)
+	}
+
+	// Get miner peer ID and addresses from miner info
+	return MinerInfoToAddrInfo(minerInfo, filters...)
+}
+
+// QueryAsk returns the storage ask of the miner, which has the given peer ID,
+// using Filecoin.ClientQueryAsk. A nil ask is returned if the miner has none.
+func (r *Resolver) QueryAsk(ctx context.Context, minerID string, peerID peer.ID) (*StorageAsk, error) {
+	if _, err := ParseAddress(minerID, callerNetwork(r.caller)); err != nil {
+		return nil, err
+	}
+	return QueryAsk(ctx, r.caller, minerID, peerID)
+}
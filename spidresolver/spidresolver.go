@@ -0,0 +1,603 @@
+// Package spidresolver resolves Filecoin storage provider IDs to libp2p peer
+// address information using the lotus JSON-RPC API.
+package spidresolver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	gobig "math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	jrpc "github.com/ybbus/jsonrpc/v2"
+)
+
+// DefaultTimeout is the default time limit for a single RPC call.
+const DefaultTimeout = 30 * time.Second
+
+// ErrEmptyTipSet is returned when the chain head has no tipset CIDs, which
+// can happen while the gateway's node is syncing.
+var ErrEmptyTipSet = errors.New("chain head returned no tipset CIDs, gateway may be syncing")
+
+// ErrNoTipSetAtHeight is returned when the tipset looked up by height has no
+// tipset CIDs.
+var ErrNoTipSetAtHeight = errors.New("no tipset CIDs returned for height")
+
+// ErrInvalidAddress is returned when a storage provider ID is not a valid
+// filecoin address.
+var ErrInvalidAddress = errors.New("invalid provider filecoin address")
+
+// ErrNoPeerID is returned when a storage provider has no peer ID.
+var ErrNoPeerID = errors.New("no peer id for service provider")
+
+// Names of the networks that can be given to ParseNetwork.
+const (
+	NetworkMainnet  = "mainnet"
+	NetworkCalibnet = "calibnet"
+	NetworkTestnet  = "testnet"
+)
+
+// ParseNetwork returns the filecoin network with the given name. Calibnet and
+// testnet both use the testnet address prefix "t", and mainnet uses "f".
+func ParseNetwork(name string) (address.Network, error) {
+	switch name {
+	case NetworkMainnet:
+		return address.Mainnet, nil
+	case NetworkCalibnet, NetworkTestnet:
+		return address.Testnet, nil
+	}
+	return address.Mainnet, fmt.Errorf("unsupported network %q", name)
+}
+
+// Names of the lotus JSON-RPC methods that gateways may expose under other
+// names.
+const (
+	MethodStateMarketParticipants = "Filecoin.StateMarketParticipants"
+	MethodStateMinerInfo          = "Filecoin.StateMinerInfo"
+)
+
+// DefaultRPCPath is the path of the JSON-RPC endpoint used when the gateway
+// does not specify one.
+const DefaultRPCPath = "/rpc/v0"
+
+// GatewayURL returns the JSON-RPC endpoint URL for the gateway. The gateway
+// may be a bare host, such as "api.node.glif.io", a host and port, or a full
+// URL such as "https://api.node.glif.io/rpc/v0". The scheme defaults to https.
+// If the gateway does not include a path, rpcPath is used, or DefaultRPCPath
+// if rpcPath is empty.
+func GatewayURL(gateway, rpcPath string) (string, error) {
+	if rpcPath == "" {
+		rpcPath = DefaultRPCPath
+	} else if !strings.HasPrefix(rpcPath, "/") {
+		return "", fmt.Errorf("invalid rpc path %q: must start with /", rpcPath)
+	}
+	gateway = strings.TrimSpace(gateway)
+	if gateway == "" {
+		return "", errors.New("gateway is empty")
+	}
+	if !strings.Contains(gateway, "://") {
+		gateway = "https://" + gateway
+	}
+	u, err := url.Parse(gateway)
+	if err != nil {
+		return "", fmt.Errorf("invalid gateway %q: %w", gateway, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("invalid gateway %q: scheme must be http or https", gateway)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("invalid gateway %q: missing host", gateway)
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("invalid gateway %q: must not have user info, query, or fragment", gateway)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = rpcPath
+	}
+	return u.String(), nil
+}
+
+// NewClient returns a JSON-RPC client for the gateway, using rpcPath as
+// described by GatewayURL. Each HTTP request made by the client is limited by
+// timeout. A timeout of zero means no limit.
+//
+// If token is not empty, it is sent as a bearer token in the Authorization
+// header of every request. Without a token, a lotus node only grants read
+// permission.
+func NewClient(gateway, rpcPath, token string, timeout time.Duration) (jrpc.RPCClient, error) {
+	return NewClientWithHTTPClient(gateway, rpcPath, token, &http.Client{
+		Timeout: timeout,
+	})
+}
+
+// NewClientWithHTTPClient is the same as NewClient, but makes requests using
+// httpClient, which sets the timeout and transport of the requests.
+func NewClientWithHTTPClient(gateway, rpcPath, token string, httpClient *http.Client) (jrpc.RPCClient, error) {
+	endpoint, err := GatewayURL(gateway, rpcPath)
+	if err != nil {
+		return nil, err
+	}
+	opts := &jrpc.RPCClientOpts{
+		HTTPClient: httpClient,
+	}
+	if token != "" {
+		opts.CustomHeaders = map[string]string{
+			"Authorization": "Bearer " + token,
+		}
+	}
+	return &httpRPCClient{
+		RPCClient:  jrpc.NewClientWithOpts(endpoint, opts),
+		endpoint:   endpoint,
+		token:      token,
+		httpClient: httpClient,
+	}, nil
+}
+
+// Client is the part of a JSON-RPC client that is used by this package. It is
+// satisfied by jrpc.RPCClient, and can be implemented by a fake in tests.
+type Client interface {
+	CallFor(out interface{}, method string, params ...interface{}) error
+}
+
+// Caller makes RPC calls for the functions in this package that query the
+// gateway. An implementation can add behavior, such as retries, around each
+// call.
+type Caller interface {
+	CallFor(ctx context.Context, out interface{}, method string, params ...interface{}) error
+}
+
+// NetworkCaller is a Caller for the gateway of a particular network. The
+// functions in this package that are given a storage provider ID and a Caller
+// only accept IDs of the caller's network, which is mainnet for a Caller that
+// is not a NetworkCaller.
+type NetworkCaller interface {
+	Caller
+	Network() address.Network
+}
+
+// callerNetwork returns the network of caller.
+func callerNetwork(caller Caller) address.Network {
+	if nc, ok := caller.(NetworkCaller); ok {
+		return nc.Network()
+	}
+	return address.Mainnet
+}
+
+// NewCaller returns a Caller that makes each call once using jrpcClient, for a
+// mainnet gateway.
+func NewCaller(jrpcClient Client) Caller {
+	return NewNetworkCaller(jrpcClient, address.Mainnet)
+}
+
+// NewNetworkCaller returns a NetworkCaller that makes each call once using
+// jrpcClient, for a gateway of the network.
+func NewNetworkCaller(jrpcClient Client, network address.Network) NetworkCaller {
+	return clientCaller{client: jrpcClient, network: network}
+}
+
+type clientCaller struct {
+	client  Client
+	network address.Network
+}
+
+func (c clientCaller) Network() address.Network {
+	return c.network
+}
+
+func (c clientCaller) CallFor(ctx context.Context, out interface{}, method string, params ...interface{}) error {
+	return CallFor(ctx, c.client, out, method, params...)
+}
+
+// DecodeError is returned when the result of an RPC call cannot be decoded.
+// Repeating the call will not fix this.
+type DecodeError struct {
+	Method string
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("cannot decode result of %s: %s", e.Method, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// CallFor calls the RPC method and decodes the result into out. It returns
+// ctx.Err() if the context is done before the call completes.
+func CallFor(ctx context.Context, jrpcClient Client, out interface{}, method string, params ...interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// The jsonrpc client does not take a context, so make the call in a
+	// separate goroutine. The http.Client timeout bounds how long that
+	// goroutine can outlive a cancelled call. The goroutine decodes into its
+	// own raw message, so that an abandoned call never writes to out.
+	var raw json.RawMessage
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- jrpcClient.CallFor(&raw, method, params...)
+	}()
+
+	select {
+	case err := <-errChan:
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(raw, out); err != nil {
+			return &DecodeError{Method: method, Err: err}
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("rpc call %s: %w", method, ctx.Err())
+	}
+}
+
+// BatchClient is a Client that can also send several calls in one request.
+// It is satisfied by the HTTP client returned by NewClient.
+type BatchClient interface {
+	Client
+	CallBatch(requests jrpc.RPCRequests) (jrpc.RPCResponses, error)
+}
+
+// CallBatch sends the requests to the gateway in one batch request, and
+// returns the responses. The requests are given IDs in the order they are in,
+// starting from zero. It returns ctx.Err() if the context is done before the
+// call completes. The error of each request is in its response.
+func CallBatch(ctx context.Context, client BatchClient, requests jrpc.RPCRequests) (jrpc.RPCResponses, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// As in CallFor, the call is made in a separate goroutine, since the
+	// jsonrpc client does not take a context.
+	type batchResult struct {
+		responses jrpc.RPCResponses
+		err       error
+	}
+	resultChan := make(chan batchResult, 1)
+	go func() {
+		responses, err := client.CallBatch(requests)
+		resultChan <- batchResult{responses, err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		return result.responses, result.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("rpc batch call: %w", ctx.Err())
+	}
+}
+
+// Resolve looks up the storage provider identified by spid, using the
+// gateway's current chain head, and returns its peer ID and multiaddrs.
+// Only multiaddrs accepted by all of the filters are returned. To look up
+// more than one storage provider, use a Resolver.
+func Resolve(ctx context.Context, gateway, spid string, filters ...AddrFilter) (peer.AddrInfo, error) {
+	r, err := NewResolver(WithGateway(gateway))
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	return r.SpidToAddrInfo(ctx, spid, filters...)
+}
+
+// ResolveWithClient is the same as Resolve, but uses the given JSON-RPC client.
+func ResolveWithClient(ctx context.Context, jrpcClient Client, spid string, filters ...AddrFilter) (peer.AddrInfo, error) {
+	r, err := NewResolver(WithClient(jrpcClient))
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	return r.SpidToAddrInfo(ctx, spid, filters...)
+}
+
+// ParseAddress parses a storage provider ID, such as "f01234", into a
+// filecoin address. The ID must have the prefix of the network. An error
+// describing what is wrong with the ID, wrapping ErrInvalidAddress, is
+// returned if it is not valid.
+func ParseAddress(spid string, network address.Network) (address.Address, error) {
+	if err := validateAddress(spid, network); err != nil {
+		return address.Undef, err
+	}
+	spAddress, err := address.NewFromString(spid)
+	if err != nil {
+		return address.Undef, fmt.Errorf("%w: %s", ErrInvalidAddress, err)
+	}
+	return spAddress, nil
+}
+
+// ChainHead returns the gateway's current chain head. ErrEmptyTipSet is
+// returned if the chain head has no tipset CIDs.
+func ChainHead(ctx context.Context, caller Caller) (ExpTipSet, error) {
+	var ets ExpTipSet
+	err := caller.CallFor(ctx, &ets, "Filecoin.ChainHead")
+	if err != nil {
+		return ExpTipSet{}, err
+	}
+	if len(ets.Cids) == 0 {
+		return ExpTipSet{}, ErrEmptyTipSet
+	}
+	return ets, nil
+}
+
+// ChainGetTipSetByHeight returns the tipset at the given height, looked up
+// from the tipset identified by tsk, or from the chain head if tsk is nil. If
+// the height is a null round, the tipset at the nearest lower height is
+// returned.
+func ChainGetTipSetByHeight(ctx context.Context, caller Caller, height int64, tsk []cid.Cid) (ExpTipSet, error) {
+	var ets ExpTipSet
+	err := caller.CallFor(ctx, &ets, "Filecoin.ChainGetTipSetByHeight", height, tsk)
+	if err != nil {
+		return ExpTipSet{}, err
+	}
+	if len(ets.Cids) == 0 {
+		return ExpTipSet{}, fmt.Errorf("%w %d", ErrNoTipSetAtHeight, height)
+	}
+	return ets, nil
+}
+
+// StateMinerInfo returns the miner info of the storage provider identified by
+// spid, as of the tipset identified by tsk.
+func StateMinerInfo(ctx context.Context, caller Caller, spid string, tsk []cid.Cid) (MinerInfo, error) {
+	spAddress, err := ParseAddress(spid, callerNetwork(caller))
+	if err != nil {
+		return MinerInfo{}, err
+	}
+
+	var minerInfo MinerInfo
+	err = caller.CallFor(ctx, &minerInfo, MethodStateMinerInfo, spAddress, tsk)
+	if err != nil {
+		return MinerInfo{}, err
+	}
+	return minerInfo, nil
+}
+
+// QueryAsk returns the storage ask of the miner, which has the given peer ID,
+// using Filecoin.ClientQueryAsk. A nil ask is returned if the miner has none.
+func QueryAsk(ctx context.Context, caller Caller, minerID string, peerID peer.ID) (*StorageAsk, error) {
+	// Decode into a pointer so that a null ask is left as nil rather than
+	// appearing as an ask with zero prices.
+	var ask *StorageAsk
+	err := caller.CallFor(ctx, &ask, "Filecoin.ClientQueryAsk", peerID, minerID)
+	if err != nil {
+		return nil, err
+	}
+	return ask, nil
+}
+
+// StateMinerPower returns the power of the storage provider identified by
+// spid, as of the tipset identified by tsk.
+func StateMinerPower(ctx context.Context, caller Caller, spid string, tsk []cid.Cid) (MinerPower, error) {
+	spAddress, err := ParseAddress(spid, callerNetwork(caller))
+	if err != nil {
+		return MinerPower{}, err
+	}
+
+	var minerPower MinerPower
+	err = caller.CallFor(ctx, &minerPower, "Filecoin.StateMinerPower", spAddress, tsk)
+	if err != nil {
+		return MinerPower{}, err
+	}
+	return minerPower, nil
+}
+
+// StateMinerAvailableBalance returns the balance, in attoFIL, of the storage
+// provider identified by spid that is not locked or needed for fees, as of
+// the tipset identified by tsk.
+func StateMinerAvailableBalance(ctx context.Context, caller Caller, spid string, tsk []cid.Cid) (big.Int, error) {
+	spAddress, err := ParseAddress(spid, callerNetwork(caller))
+	if err != nil {
+		return big.Int{}, err
+	}
+
+	var balance big.Int
+	err = caller.CallFor(ctx, &balance, "Filecoin.StateMinerAvailableBalance", spAddress, tsk)
+	if err != nil {
+		return big.Int{}, err
+	}
+	return balance, nil
+}
+
+// StateMarketBalance returns the escrow and locked funds, in attoFIL, of the
+// storage provider identified by spid in the storage market, as of the tipset
+// identified by tsk.
+func StateMarketBalance(ctx context.Context, caller Caller, spid string, tsk []cid.Cid) (MarketBalance, error) {
+	spAddress, err := ParseAddress(spid, callerNetwork(caller))
+	if err != nil {
+		return MarketBalance{}, err
+	}
+
+	var balance MarketBalance
+	err = caller.CallFor(ctx, &balance, "Filecoin.StateMarketBalance", spAddress, tsk)
+	if err != nil {
+		return MarketBalance{}, err
+	}
+	return balance, nil
+}
+
+// FILDecimals is the number of decimal places of FIL that can be
+// represented in attoFIL.
+const FILDecimals = 18
+
+// FormatFIL formats an amount in attoFIL as FIL, such as "1.5 FIL", with as
+// many decimal places as are needed to show the exact amount.
+func FormatFIL(attoFIL big.Int) string {
+	return FormatFILPrecision(attoFIL, FILDecimals)
+}
+
+// FormatFILPrecision formats an amount in attoFIL as FIL, rounded to at most
+// precision decimal places. Trailing zeros are not shown, so 1.5 FIL with a
+// precision of 3 is "1.5 FIL". A precision that is negative or more than
+// FILDecimals shows the exact amount. The amount is never converted to a
+// float, so large amounts are formatted without losing precision.
+func FormatFILPrecision(attoFIL big.Int, precision int) string {
+	if attoFIL.Int == nil {
+		return "0 FIL"
+	}
+	if precision < 0 || precision > FILDecimals {
+		precision = FILDecimals
+	}
+	attoPerFIL := new(gobig.Int).Exp(gobig.NewInt(10), gobig.NewInt(FILDecimals), nil)
+	r := new(gobig.Rat).SetFrac(attoFIL.Int, attoPerFIL)
+	s := r.FloatString(precision)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	if s == "-0" {
+		// A small negative amount rounded to zero.
+		s = "0"
+	}
+	return s + " FIL"
+}
+
+// StateLookupID returns the ID address of the actor at addr, as of the tipset
+// identified by tsk.
+func StateLookupID(ctx context.Context, caller Caller, addr address.Address, tsk []cid.Cid) (address.Address, error) {
+	var idAddr address.Address
+	err := caller.CallFor(ctx, &idAddr, "Filecoin.StateLookupID", addr, tsk)
+	if err != nil {
+		return address.Undef, err
+	}
+	return idAddr, nil
+}
+
+// StateAccountKey returns the public key address of the account actor at
+// addr, as of the tipset identified by tsk. An error is returned if the actor
+// is not an account actor, such as a multisig.
+func StateAccountKey(ctx context.Context, caller Caller, addr address.Address, tsk []cid.Cid) (address.Address, error) {
+	var keyAddr address.Address
+	err := caller.CallFor(ctx, &keyAddr, "Filecoin.StateAccountKey", addr, tsk)
+	if err != nil {
+		return address.Undef, err
+	}
+	return keyAddr, nil
+}
+
+// emptyParticipantsRetryDelay is how long the market participants are waited
+// for before they are asked for again, when the gateway returns none.
+var emptyParticipantsRetryDelay = 2 * time.Second
+
+// MarketParticipants returns the storage market participants known to the
+// gateway, keyed by miner ID. A busy gateway may return no participants
+// instead of an error, so if there are none, they are requested once more
+// after a short delay. An empty map is returned if there are still none.
+func MarketParticipants(ctx context.Context, caller Caller) (map[string]MarketBalance, error) {
+	minerList, err := marketParticipants(ctx, caller)
+	if err != nil || len(minerList) != 0 {
+		return minerList, err
+	}
+	if err = waitEmptyParticipants(ctx); err != nil {
+		return nil, err
+	}
+	return marketParticipants(ctx, caller)
+}
+
+// waitEmptyParticipants waits before the market participants are asked for
+// again, until emptyParticipantsRetryDelay has passed or ctx is done.
+func waitEmptyParticipants(ctx context.Context) error {
+	timer := time.NewTimer(emptyParticipantsRetryDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func marketParticipants(ctx context.Context, caller Caller) (map[string]MarketBalance, error) {
+	minerList := make(map[string]MarketBalance)
+	err := caller.CallFor(ctx, &minerList, MethodStateMarketParticipants, nil)
+	if err != nil {
+		return nil, err
+	}
+	return minerList, nil
+}
+
+// ReadMarketParticipants reads the result of Filecoin.StateMarketParticipants,
+// a JSON object keyed by miner ID, from r. The object is decoded one entry at a
+// time, so if max is greater than zero, reading stops after max participants
+// and the rest of the object is never held in memory.
+func ReadMarketParticipants(r io.Reader, max int) (map[string]MarketBalance, error) {
+	minerList := make(map[string]MarketBalance)
+	err := decodeParticipants(json.NewDecoder(r), func(minerID string, balance MarketBalance) error {
+		minerList[minerID] = balance
+		if max > 0 && len(minerList) == max {
+			return errStopStream
+		}
+		return nil
+	})
+	if err != nil && err != errStopStream {
+		return nil, err
+	}
+	return minerList, nil
+}
+
+// MinerInfoToAddrInfo converts the peer ID and multiaddrs in minerInfo to a
+// peer.AddrInfo. The multiaddrs are parsed as described by ParseMultiaddrs.
+// Multiaddrs that cannot be parsed, or that are rejected by any of the
+// filters, are skipped. Use ParseMultiaddrs to find out which multiaddrs could
+// not be parsed.
+func MinerInfoToAddrInfo(minerInfo MinerInfo, filters ...AddrFilter) (peer.AddrInfo, error) {
+	if minerInfo.PeerId == nil {
+		return peer.AddrInfo{}, ErrNoPeerID
+	}
+
+	parsed, _ := ParseMultiaddrs(minerInfo.Multiaddrs)
+	return peer.AddrInfo{
+		ID:    *minerInfo.PeerId,
+		Addrs: FilterAddrs(parsed, filters...),
+	}, nil
+}
+
+// InvalidMultiaddrError describes a miner multiaddr that could not be parsed.
+type InvalidMultiaddrError struct {
+	Raw []byte
+	Err error
+}
+
+func (e *InvalidMultiaddrError) Error() string {
+	return fmt.Sprintf("invalid multiaddr 0x%x: %s", e.Raw, e.Err)
+}
+
+func (e *InvalidMultiaddrError) Unwrap() error {
+	return e.Err
+}
+
+// ParseMultiaddrs parses the multiaddrs of a miner, as found in MinerInfo.
+// Duplicates are removed, and the multiaddrs are sorted so that the result is
+// the same for each call. An *InvalidMultiaddrError is returned for each
+// multiaddr that could not be parsed.
+func ParseMultiaddrs(raw [][]byte) ([]multiaddr.Multiaddr, []error) {
+	var invalid []error
+	seen := make(map[string]struct{}, len(raw))
+	multiaddrs := make([]multiaddr.Multiaddr, 0, len(raw))
+	for _, a := range raw {
+		maddr, err := multiaddr.NewMultiaddrBytes(a)
+		if err != nil {
+			invalid = append(invalid, &InvalidMultiaddrError{Raw: a, Err: err})
+			continue
+		}
+		key := string(maddr.Bytes())
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		multiaddrs = append(multiaddrs, maddr)
+	}
+	sort.Slice(multiaddrs, func(i, j int) bool {
+		return multiaddrs[i].String() < multiaddrs[j].String()
+	})
+	return multiaddrs, invalid
+}
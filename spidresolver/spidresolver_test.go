@@ -0,0 +1,1508 @@
+package spidresolver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/gorilla/websocket"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	madns "github.com/multiformats/go-multiaddr-dns"
+	"github.com/multiformats/go-multihash"
+	jrpc "github.com/ybbus/jsonrpc/v2"
+)
+
+func mustMultiaddr(t *testing.T, s string) multiaddr.Multiaddr {
+	t.Helper()
+	maddr, err := multiaddr.NewMultiaddr(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return maddr
+}
+
+func testPeerID(t *testing.T) peer.ID {
+	t.Helper()
+	h, err := multihash.Sum([]byte("test-peer"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return peer.ID(h)
+}
+
+func testCid(t *testing.T) cid.Cid {
+	t.Helper()
+	h, err := multihash.Sum([]byte("test-block"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cid.NewCidV1(cid.DagCBOR, h)
+}
+
+func addrStrings(addrs []multiaddr.Multiaddr) []string {
+	strs := make([]string, len(addrs))
+	for i, a := range addrs {
+		strs[i] = a.String()
+	}
+	return strs
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHasProtocol(t *testing.T) {
+	tests := []struct {
+		name      string
+		protocols []string
+		addr      string
+		want      bool
+	}{
+		{"tcp matches tcp", []string{"tcp"}, "/ip4/1.2.3.4/tcp/1234", true},
+		{"tcp does not match quic", []string{"tcp"}, "/ip4/1.2.3.4/udp/1234/quic", false},
+		{"any of several", []string{"tcp", "quic"}, "/ip4/1.2.3.4/udp/1234/quic", true},
+		{"matches inner protocol", []string{"ip6"}, "/ip6/::1/tcp/1234", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := HasProtocol(tt.protocols...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := filter(mustMultiaddr(t, tt.addr)); got != tt.want {
+				t.Errorf("filter(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasProtocolUnknown(t *testing.T) {
+	if _, err := HasProtocol("tcp", "carrier-pigeon"); err == nil {
+		t.Fatal("expected error for unknown protocol")
+	}
+}
+
+func TestIPVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		addr    string
+		want    bool
+	}{
+		{"ip4 kept by 4", 4, "/ip4/1.2.3.4/tcp/1234", true},
+		{"ip6 dropped by 4", 4, "/ip6/::1/tcp/1234", false},
+		{"dns6 dropped by 4", 4, "/dns6/example.com/tcp/1234", false},
+		{"dns kept by 4", 4, "/dns/example.com/tcp/1234", true},
+		{"ip6 kept by 6", 6, "/ip6/::1/tcp/1234", true},
+		{"ip4 dropped by 6", 6, "/ip4/1.2.3.4/tcp/1234", false},
+		{"dns4 dropped by 6", 6, "/dns4/example.com/tcp/1234", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := IPVersion(tt.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := filter(mustMultiaddr(t, tt.addr)); got != tt.want {
+				t.Errorf("filter(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := IPVersion(5); err == nil {
+		t.Fatal("expected error for invalid IP version")
+	}
+}
+
+func TestRelayOnly(t *testing.T) {
+	tcpAddr := mustMultiaddr(t, "/ip4/1.2.3.4/tcp/1234")
+	relayAddr := mustMultiaddr(t, "/ip4/5.6.7.8/tcp/4001/p2p-circuit")
+
+	if RelayOnly(nil) {
+		t.Error("no addresses should not be relay-only")
+	}
+	if !RelayOnly([]multiaddr.Multiaddr{relayAddr}) {
+		t.Error("only relay addresses should be relay-only")
+	}
+	if RelayOnly([]multiaddr.Multiaddr{relayAddr, tcpAddr}) {
+		t.Error("addresses with a direct address should not be relay-only")
+	}
+	if NoRelay(relayAddr) || !NoRelay(tcpAddr) {
+		t.Error("NoRelay should only drop relay addresses")
+	}
+}
+
+func TestNoPrivateAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"/ip4/10.1.2.3/tcp/1234", false},
+		{"/ip4/172.16.0.1/tcp/1234", false},
+		{"/ip4/192.168.1.10/udp/1234/quic-v1", false},
+		{"/ip4/127.0.0.1/tcp/1234", false},
+		{"/ip4/169.254.1.1/tcp/1234", false},
+		{"/ip4/0.0.0.0/tcp/1234", false},
+		{"/ip6/::1/tcp/1234", false},
+		{"/ip6/fe80::1/tcp/1234", false},
+		{"/ip6/fd00::1/tcp/1234", false},
+		{"/ip4/1.2.3.4/tcp/1234", true},
+		{"/ip4/172.32.0.1/tcp/1234", true},
+		{"/ip6/2001:db8::1/tcp/1234", true},
+		{"/dns4/localhost/tcp/1234", true},
+		{"/dns/example.com/tcp/443/wss", true},
+	}
+	for _, tt := range tests {
+		if got := NoPrivateAddr(mustMultiaddr(t, tt.addr)); got != tt.want {
+			t.Errorf("%s: got %t, want %t", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestWithP2P(t *testing.T) {
+	peerID, err := peer.Decode("12D3KooWRYM5bH1srPN1sCYMLLQD2AQNHbZDPFdmwGcGvMCDRfwv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs := []multiaddr.Multiaddr{
+		mustMultiaddr(t, "/ip4/1.2.3.4/tcp/1234"),
+		mustMultiaddr(t, "/ip4/1.2.3.4/tcp/1234/p2p/"+peerID.String()),
+		mustMultiaddr(t, "/ip4/5.6.7.8/tcp/4001/p2p/12D3KooWGzxzKZYveHXtpG6AsrUJBcWxHBFS2HsEoGTxrMLvKXtf/p2p-circuit"),
+	}
+	want := []string{
+		"/ip4/1.2.3.4/tcp/1234/p2p/" + peerID.String(),
+		"/ip4/1.2.3.4/tcp/1234/p2p/" + peerID.String(),
+		"/ip4/5.6.7.8/tcp/4001/p2p/12D3KooWGzxzKZYveHXtpG6AsrUJBcWxHBFS2HsEoGTxrMLvKXtf/p2p-circuit/p2p/" + peerID.String(),
+	}
+
+	got, err := WithP2P(addrs, peerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d addresses, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Errorf("address %d: got %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestGroupByTransport(t *testing.T) {
+	addrs := []multiaddr.Multiaddr{
+		mustMultiaddr(t, "/ip4/1.2.3.4/tcp/1234"),
+		mustMultiaddr(t, "/ip4/1.2.3.4/udp/1234/quic"),
+		mustMultiaddr(t, "/ip6/::1/udp/1234/quic-v1"),
+		mustMultiaddr(t, "/ip4/1.2.3.4/udp/1234/quic-v1/webtransport"),
+		mustMultiaddr(t, "/dns4/example.com/tcp/443/wss"),
+		mustMultiaddr(t, "/ip4/1.2.3.4/tcp/80/ws"),
+		mustMultiaddr(t, "/ip4/1.2.3.4/udp/1234"),
+		mustMultiaddr(t, "/dns4/example.com/tcp/4001"),
+	}
+	want := map[string][]string{
+		TransportTCP:          {"/ip4/1.2.3.4/tcp/1234", "/dns4/example.com/tcp/4001"},
+		TransportQUIC:         {"/ip4/1.2.3.4/udp/1234/quic", "/ip6/::1/udp/1234/quic-v1"},
+		TransportWebTransport: {"/ip4/1.2.3.4/udp/1234/quic-v1/webtransport"},
+		TransportWebSocket:    {"/dns4/example.com/tcp/443/wss", "/ip4/1.2.3.4/tcp/80/ws"},
+		TransportOther:        {"/ip4/1.2.3.4/udp/1234"},
+	}
+
+	got := GroupByTransport(addrs)
+	if len(got) != len(want) {
+		t.Errorf("got %d transports, want %d: %v", len(got), len(want), got)
+	}
+	for transport, wantAddrs := range want {
+		if strings.Join(got[transport], " ") != strings.Join(wantAddrs, " ") {
+			t.Errorf("%s: got %v, want %v", transport, got[transport], wantAddrs)
+		}
+	}
+	if got = GroupByTransport(nil); len(got) != 0 {
+		t.Errorf("got %v for no addresses, want empty", got)
+	}
+}
+
+func TestMinerInfoToAddrInfo(t *testing.T) {
+	peerID := testPeerID(t)
+	tcpAddr := mustMultiaddr(t, "/ip4/1.2.3.4/tcp/1234")
+	quicAddr := mustMultiaddr(t, "/ip4/1.2.3.4/udp/1234/quic")
+	privateAddr := mustMultiaddr(t, "/ip4/192.168.1.10/tcp/1234")
+	loopbackAddr := mustMultiaddr(t, "/ip6/::1/tcp/1234")
+	tcpOnly, err := HasProtocol("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		minerInfo MinerInfo
+		filters   []AddrFilter
+		want      []string
+		wantErr   bool
+	}{
+		{
+			name:      "no peer id",
+			minerInfo: MinerInfo{Multiaddrs: [][]byte{tcpAddr.Bytes()}},
+			wantErr:   true,
+		},
+		{
+			name:      "no addresses",
+			minerInfo: MinerInfo{PeerId: &peerID},
+			want:      []string{},
+		},
+		{
+			name: "unparseable address skipped",
+			minerInfo: MinerInfo{
+				PeerId:     &peerID,
+				Multiaddrs: [][]byte{{0xff, 0xff}, tcpAddr.Bytes()},
+			},
+			want: []string{tcpAddr.String()},
+		},
+		{
+			name: "duplicates removed and sorted",
+			minerInfo: MinerInfo{
+				PeerId:     &peerID,
+				Multiaddrs: [][]byte{tcpAddr.Bytes(), quicAddr.Bytes(), tcpAddr.Bytes()},
+			},
+			want: []string{tcpAddr.String(), quicAddr.String()},
+		},
+		{
+			name: "filtered",
+			minerInfo: MinerInfo{
+				PeerId:     &peerID,
+				Multiaddrs: [][]byte{quicAddr.Bytes(), tcpAddr.Bytes()},
+			},
+			filters: []AddrFilter{tcpOnly},
+			want:    []string{tcpAddr.String()},
+		},
+		{
+			name: "private addresses excluded",
+			minerInfo: MinerInfo{
+				PeerId:     &peerID,
+				Multiaddrs: [][]byte{privateAddr.Bytes(), tcpAddr.Bytes(), loopbackAddr.Bytes()},
+			},
+			filters: []AddrFilter{NoPrivateAddr},
+			want:    []string{tcpAddr.String()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrInfo, err := MinerInfoToAddrInfo(tt.minerInfo, tt.filters...)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addrInfo.ID != peerID {
+				t.Errorf("ID = %s, want %s", addrInfo.ID, peerID)
+			}
+			if got := addrStrings(addrInfo.Addrs); !equalStrings(got, tt.want) {
+				t.Errorf("Addrs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMinerInfoBeneficiary(t *testing.T) {
+	// Returned by gateways on network versions with beneficiaries.
+	data := `{
+		"Owner": "f01000",
+		"Beneficiary": "f01001",
+		"BeneficiaryTerm": {"Quota": "1000", "UsedQuota": "250", "Expiration": 3000000},
+		"PendingBeneficiaryTerm": {
+			"NewBeneficiary": "f01002",
+			"NewQuota": "2000",
+			"NewExpiration": 4000000,
+			"ApprovedByBeneficiary": true,
+			"ApprovedByNominee": false
+		}
+	}`
+	var minerInfo MinerInfo
+	if err := json.Unmarshal([]byte(data), &minerInfo); err != nil {
+		t.Fatal(err)
+	}
+	beneficiary, err := address.NewIDAddress(1001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if minerInfo.Beneficiary != beneficiary {
+		t.Errorf("Beneficiary = %s, want %s", minerInfo.Beneficiary, beneficiary)
+	}
+	term := minerInfo.BeneficiaryTerm
+	if term == nil {
+		t.Fatal("BeneficiaryTerm is nil")
+	}
+	if !term.Quota.Equals(big.NewInt(1000)) || !term.UsedQuota.Equals(big.NewInt(250)) || term.Expiration != 3000000 {
+		t.Errorf("BeneficiaryTerm = %+v", term)
+	}
+	nominee, err := address.NewIDAddress(1002)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := minerInfo.PendingBeneficiaryTerm
+	if pending == nil {
+		t.Fatal("PendingBeneficiaryTerm is nil")
+	}
+	if pending.NewBeneficiary != nominee || !pending.NewQuota.Equals(big.NewInt(2000)) || pending.NewExpiration != 4000000 ||
+		!pending.ApprovedByBeneficiary || pending.ApprovedByNominee {
+		t.Errorf("PendingBeneficiaryTerm = %+v", pending)
+	}
+
+	// Older gateways do not return the fields, and lotus returns null when
+	// no change is pending.
+	minerInfo = MinerInfo{}
+	if err := json.Unmarshal([]byte(`{"Owner": "f01000", "PendingBeneficiaryTerm": null}`), &minerInfo); err != nil {
+		t.Fatal(err)
+	}
+	if minerInfo.Beneficiary != address.Undef || minerInfo.BeneficiaryTerm != nil || minerInfo.PendingBeneficiaryTerm != nil {
+		t.Errorf("beneficiary fields = %s %v %v, want zero", minerInfo.Beneficiary, minerInfo.BeneficiaryTerm, minerInfo.PendingBeneficiaryTerm)
+	}
+}
+
+func TestParseMultiaddrsInvalid(t *testing.T) {
+	tcpAddr := mustMultiaddr(t, "/ip4/1.2.3.4/tcp/1234")
+	addrs, invalid := ParseMultiaddrs([][]byte{{0xff, 0xff}, tcpAddr.Bytes(), {}})
+	if len(invalid) != 2 {
+		t.Fatalf("got %d invalid multiaddrs, want 2", len(invalid))
+	}
+	var invalidErr *InvalidMultiaddrError
+	if !errors.As(invalid[0], &invalidErr) {
+		t.Fatalf("error is %T, want *InvalidMultiaddrError", invalid[0])
+	}
+	if !strings.Contains(invalidErr.Error(), "0xffff") {
+		t.Errorf("error %q does not contain the raw bytes in hex", invalidErr)
+	}
+	if len(addrs) != 1 || !addrs[0].Equal(tcpAddr) {
+		t.Errorf("addrs = %v, want [%s]", addrs, tcpAddr)
+	}
+}
+
+// failingResolver is a madns.BasicResolver for which every lookup fails
+// without using the network.
+type failingResolver struct{}
+
+func (failingResolver) LookupIPAddr(ctx context.Context, name string) ([]net.IPAddr, error) {
+	return nil, errors.New("no dns in tests")
+}
+
+func (failingResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return nil, errors.New("no dns in tests")
+}
+
+func newFailingResolver(t *testing.T) *madns.Resolver {
+	resolver, err := madns.NewResolver(madns.WithDefaultResolver(failingResolver{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resolver
+}
+
+func TestResolveDNSDeduplicates(t *testing.T) {
+	addrs := []multiaddr.Multiaddr{
+		mustMultiaddr(t, "/ip4/1.2.3.4/tcp/1234"),
+		mustMultiaddr(t, "/dns4/example.com/tcp/1234"),
+		mustMultiaddr(t, "/ip4/1.2.3.4/tcp/1234"),
+	}
+	resolver, err := madns.NewResolver(madns.WithDefaultResolver(&madns.MockResolver{
+		IP: map[string][]net.IPAddr{
+			"example.com": {{IP: net.ParseIP("1.2.3.4")}, {IP: net.ParseIP("5.6.7.8")}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved, err := resolveDNS(context.Background(), resolver, addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/ip4/1.2.3.4/tcp/1234", "/dns4/example.com/tcp/1234", "/ip4/5.6.7.8/tcp/1234"}
+	if got := addrStrings(resolved); !equalStrings(got, want) {
+		t.Errorf("resolved = %v, want %v", got, want)
+	}
+}
+
+func TestResolveDNSPartialFailure(t *testing.T) {
+	addrs := []multiaddr.Multiaddr{
+		mustMultiaddr(t, "/ip4/1.2.3.4/tcp/1234"),
+		mustMultiaddr(t, "/dns4/example.invalid/tcp/1234"),
+	}
+	resolved, err := resolveDNS(context.Background(), newFailingResolver(t), addrs)
+	if err == nil {
+		t.Fatal("expected error for unresolvable address")
+	}
+	// The originals are still returned when resolution fails.
+	want := []string{"/ip4/1.2.3.4/tcp/1234", "/dns4/example.invalid/tcp/1234"}
+	if got := addrStrings(resolved); !equalStrings(got, want) {
+		t.Errorf("resolved = %v, want %v", got, want)
+	}
+}
+
+func TestAddrIP(t *testing.T) {
+	resolver, err := madns.NewResolver(madns.WithDefaultResolver(&madns.MockResolver{
+		IP: map[string][]net.IPAddr{
+			"example.com": {{IP: net.ParseIP("5.6.7.8")}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr    string
+		want    string
+		wantErr error
+	}{
+		{addr: "/ip4/1.2.3.4/tcp/1234", want: "1.2.3.4"},
+		{addr: "/ip6/2001:db8::1/udp/1234/quic-v1", want: "2001:db8::1"},
+		{addr: "/dns4/example.com/tcp/1234", want: "5.6.7.8"},
+		{addr: "/p2p-circuit", wantErr: ErrNoIP},
+	}
+	for _, tt := range tests {
+		ip, err := addrIP(context.Background(), resolver, mustMultiaddr(t, tt.addr))
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: err = %v, want %v", tt.addr, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.addr, err)
+			continue
+		}
+		if ip.String() != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.addr, ip, tt.want)
+		}
+	}
+
+	if _, err = addrIP(context.Background(), newFailingResolver(t), mustMultiaddr(t, "/dns4/example.invalid/tcp/1234")); err == nil {
+		t.Error("expected error for unresolvable address")
+	}
+}
+
+func TestGatewayURL(t *testing.T) {
+	tests := []struct {
+		gateway string
+		rpcPath string
+		want    string
+		wantErr bool
+	}{
+		{gateway: "api.node.glif.io", want: "https://api.node.glif.io/rpc/v0"},
+		{gateway: "api.node.glif.io", rpcPath: "/rpc/v1", want: "https://api.node.glif.io/rpc/v1"},
+		{gateway: "https://api.node.glif.io/rpc/v0", rpcPath: "/rpc/v1", want: "https://api.node.glif.io/rpc/v0"},
+		{gateway: "api.node.glif.io", rpcPath: "rpc/v1", wantErr: true},
+		{gateway: "localhost:1234", want: "https://localhost:1234/rpc/v0"},
+		{gateway: "https://api.node.glif.io", want: "https://api.node.glif.io/rpc/v0"},
+		{gateway: "https://api.node.glif.io/rpc/v0", want: "https://api.node.glif.io/rpc/v0"},
+		{gateway: "http://127.0.0.1:1234/rpc/v1", want: "http://127.0.0.1:1234/rpc/v1"},
+		{gateway: "", wantErr: true},
+		{gateway: "ftp://api.node.glif.io", wantErr: true},
+		{gateway: "https://", wantErr: true},
+		{gateway: "api.node.glif.io:port", wantErr: true},
+		{gateway: "https://api.node.glif.io/rpc/v0?x=1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := GatewayURL(tt.gateway, tt.rpcPath)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("GatewayURL(%q) = %q, expected error", tt.gateway, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("GatewayURL(%q): %s", tt.gateway, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("GatewayURL(%q) = %q, want %q", tt.gateway, got, tt.want)
+		}
+	}
+}
+
+func TestResolveWithClient(t *testing.T) {
+	peerID := testPeerID(t)
+	tcpAddr := mustMultiaddr(t, "/ip4/1.2.3.4/tcp/1234")
+	head := ExpTipSet{Cids: []cid.Cid{testCid(t)}, Height: 100}
+	rpcErr := errors.New("gateway unavailable")
+
+	tests := []struct {
+		name    string
+		client  *fakeClient
+		want    []string
+		wantErr error
+	}{
+		{
+			name: "resolved",
+			client: &fakeClient{results: map[string]interface{}{
+				"Filecoin.ChainHead": head,
+				"Filecoin.StateMinerInfo": MinerInfo{
+					PeerId:     &peerID,
+					Multiaddrs: [][]byte{{0x01}, tcpAddr.Bytes()},
+				},
+			}},
+			want: []string{tcpAddr.String()},
+		},
+		{
+			name: "no peer id",
+			client: &fakeClient{results: map[string]interface{}{
+				"Filecoin.ChainHead":      head,
+				"Filecoin.StateMinerInfo": MinerInfo{},
+			}},
+			wantErr: ErrNoPeerID,
+		},
+		{
+			name: "empty tipset",
+			client: &fakeClient{results: map[string]interface{}{
+				"Filecoin.ChainHead": ExpTipSet{Height: 100},
+			}},
+			wantErr: ErrEmptyTipSet,
+		},
+		{
+			name: "rpc failure",
+			client: &fakeClient{
+				results: map[string]interface{}{"Filecoin.ChainHead": head},
+				errs:    map[string]error{"Filecoin.StateMinerInfo": rpcErr},
+			},
+			wantErr: rpcErr,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrInfo, err := ResolveWithClient(context.Background(), tt.client, "f01234")
+			if tt.wantErr != nil {
+				if err == nil || err.Error() != tt.wantErr.Error() {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := addrStrings(addrInfo.Addrs); !equalStrings(got, tt.want) {
+				t.Errorf("Addrs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolver(t *testing.T) {
+	peerID := testPeerID(t)
+	tcpAddr := mustMultiaddr(t, "/ip4/1.2.3.4/tcp/1234")
+	client := &fakeClient{results: map[string]interface{}{
+		"Filecoin.ChainHead": ExpTipSet{Cids: []cid.Cid{testCid(t)}, Height: 100},
+		"Filecoin.StateMinerInfo": MinerInfo{
+			PeerId:     &peerID,
+			Multiaddrs: [][]byte{tcpAddr.Bytes(), []byte("bad")},
+		},
+		"Filecoin.ClientQueryAsk": StorageAsk{
+			Price:         big.NewInt(500),
+			VerifiedPrice: big.NewInt(0),
+			MaxPieceSize:  1 << 30,
+		},
+	}}
+	logger := &recordingLogger{}
+	r, err := NewResolver(WithClient(client), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	addrInfo, err := r.SpidToAddrInfo(context.Background(), "f01000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrInfo.ID != peerID || len(addrInfo.Addrs) != 1 {
+		t.Fatalf("unexpected addr info: %v", addrInfo)
+	}
+	// The multiaddr that cannot be parsed is logged.
+	if len(logger.messages) != 1 || !strings.HasPrefix(logger.messages[0], "f01000: ") {
+		t.Errorf("unexpected log messages: %v", logger.messages)
+	}
+
+	ask, err := r.QueryAsk(context.Background(), "f01000", peerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ask == nil || ask.Price.Int64() != 500 {
+		t.Errorf("unexpected ask: %v", ask)
+	}
+	if _, err = r.QueryAsk(context.Background(), "bad", peerID); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("err = %v, want ErrInvalidAddress", err)
+	}
+
+	client.errs = map[string]error{"Filecoin.ClientQueryAsk": errors.New("method not found")}
+	if _, err = r.QueryAsk(context.Background(), "f01000", peerID); err == nil {
+		t.Error("expected error from ClientQueryAsk")
+	}
+
+	if _, err = NewResolver(); err == nil {
+		t.Error("expected error without a gateway, client, or caller")
+	}
+}
+
+func TestResolverHeadTTL(t *testing.T) {
+	peerID := testPeerID(t)
+	newClient := func() *fakeClient {
+		return &fakeClient{results: map[string]interface{}{
+			"Filecoin.ChainHead":      ExpTipSet{Cids: []cid.Cid{testCid(t)}, Height: 100},
+			"Filecoin.StateMinerInfo": MinerInfo{PeerId: &peerID},
+		}}
+	}
+	countHeads := func(client *fakeClient) int {
+		var n int
+		for _, method := range client.calls {
+			if method == "Filecoin.ChainHead" {
+				n++
+			}
+		}
+		return n
+	}
+
+	tests := []struct {
+		name string
+		opts []Option
+		want int
+	}{
+		{name: "default", want: 1},
+		{name: "fresh head", opts: []Option{WithHeadTTL(0)}, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newClient()
+			r, err := NewResolver(append([]Option{WithClient(client)}, tt.opts...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, spid := range []string{"f01000", "f01001", "f01002"} {
+				if _, err = r.SpidToAddrInfo(context.Background(), spid); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := countHeads(client); got != tt.want {
+				t.Errorf("chain head fetched %d times, want %d", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := NewResolver(WithClient(newClient()), WithHeadTTL(-time.Second)); err == nil {
+		t.Error("expected error with a negative head TTL")
+	}
+}
+
+func TestCallForDecodeError(t *testing.T) {
+	client := &fakeClient{results: map[string]interface{}{
+		"Filecoin.ChainHead": "not a tipset",
+	}}
+	_, err := ChainHead(context.Background(), NewCaller(client))
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Fatalf("err = %v, want *DecodeError", err)
+	}
+}
+
+func TestChainHeadEmptyTipSet(t *testing.T) {
+	client := &fakeClient{results: map[string]interface{}{
+		"Filecoin.ChainHead": ExpTipSet{Height: 100},
+	}}
+	_, err := ChainHead(context.Background(), NewCaller(client))
+	if !errors.Is(err, ErrEmptyTipSet) {
+		t.Fatalf("err = %v, want ErrEmptyTipSet", err)
+	}
+	if err.Error() != "chain head returned no tipset CIDs, gateway may be syncing" {
+		t.Errorf("unexpected error message %q", err)
+	}
+}
+
+func TestErrNoPeerID(t *testing.T) {
+	_, err := MinerInfoToAddrInfo(MinerInfo{})
+	if !errors.Is(err, ErrNoPeerID) {
+		t.Fatalf("err = %v, want ErrNoPeerID", err)
+	}
+
+	client := &fakeClient{results: map[string]interface{}{
+		"Filecoin.ChainHead":      ExpTipSet{Cids: []cid.Cid{testCid(t)}, Height: 100},
+		"Filecoin.StateMinerInfo": MinerInfo{},
+	}}
+	_, err = ResolveWithClient(context.Background(), client, "f01000")
+	if !errors.Is(err, ErrNoPeerID) {
+		t.Fatalf("err = %v, want ErrNoPeerID", err)
+	}
+}
+
+func TestErrInvalidAddress(t *testing.T) {
+	_, err := ParseAddress("not-an-address", address.Mainnet)
+	if !errors.Is(err, ErrInvalidAddress) {
+		t.Fatalf("err = %v, want ErrInvalidAddress", err)
+	}
+
+	client := &fakeClient{results: map[string]interface{}{
+		"Filecoin.ChainHead": ExpTipSet{Cids: []cid.Cid{testCid(t)}, Height: 100},
+	}}
+	_, err = ResolveWithClient(context.Background(), client, "not-an-address")
+	if !errors.Is(err, ErrInvalidAddress) {
+		t.Fatalf("err = %v, want ErrInvalidAddress", err)
+	}
+	if len(client.calls) != 1 {
+		t.Errorf("expected only the chain head call, got %v", client.calls)
+	}
+}
+
+func TestParseAddressMalformed(t *testing.T) {
+	actorAddr, err := address.NewActorAddress([]byte("miner"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The address is written with the prefix of address.CurrentNetwork.
+	valid := "f" + actorAddr.String()[1:]
+	if _, err = ParseAddress(valid, address.Mainnet); err != nil {
+		t.Fatalf("valid actor address %s rejected: %s", valid, err)
+	}
+	badChecksum := valid[:len(valid)-1] + "a"
+	if badChecksum == valid {
+		badChecksum = valid[:len(valid)-1] + "b"
+	}
+	short := "f2" + address.AddressEncoding.WithPadding(-1).EncodeToString([]byte("short"))
+
+	tests := []struct {
+		name string
+		spid string
+		want string
+	}{
+		{"empty", "", "empty"},
+		{"too short", "f0", "too short"},
+		{"upper case", "F01234", "upper case"},
+		{"bad network prefix", "x01234", "bad network prefix"},
+		{"other network", "t01234", "not a mainnet network address"},
+		{"bad protocol", "f91234", "bad protocol"},
+		{"ID not a number", "f012a4", "must be a decimal number"},
+		{"ID too long", "f012345678901234567890", "too long"},
+		{"not base32", "f2abc1", "other than a-z and 2-7"},
+		{"wrong length", short, "wrong length"},
+		{"bad checksum", badChecksum, "bad checksum"},
+	}
+	for _, tt := range tests {
+		_, err := ParseAddress(tt.spid, address.Mainnet)
+		if !errors.Is(err, ErrInvalidAddress) {
+			t.Errorf("%s: err = %v, want ErrInvalidAddress", tt.name, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %q, want it to contain %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestParseNetwork(t *testing.T) {
+	tests := []struct {
+		name string
+		want address.Network
+	}{
+		{NetworkMainnet, address.Mainnet},
+		{NetworkCalibnet, address.Testnet},
+		{NetworkTestnet, address.Testnet},
+	}
+	for _, tt := range tests {
+		got, err := ParseNetwork(tt.name)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseNetwork(%q) = (%d, %v), want %d", tt.name, got, err, tt.want)
+		}
+	}
+	if _, err := ParseNetwork("devnet"); err == nil {
+		t.Error("expected error for unsupported network")
+	}
+
+	if _, err := ParseAddress("t01234", address.Testnet); err != nil {
+		t.Fatalf("calibnet address rejected: %s", err)
+	}
+	_, err := ParseAddress("f01234", address.Testnet)
+	if !errors.Is(err, ErrInvalidAddress) || !strings.Contains(err.Error(), "not a calibnet or testnet network address") {
+		t.Fatalf("err = %v, want mainnet address rejected", err)
+	}
+}
+
+func TestNetworkCaller(t *testing.T) {
+	peerID := testPeerID(t)
+	newClient := func() *fakeClient {
+		return &fakeClient{results: map[string]interface{}{
+			"Filecoin.ChainHead":      ExpTipSet{Cids: []cid.Cid{testCid(t)}, Height: 100},
+			"Filecoin.StateMinerInfo": MinerInfo{PeerId: &peerID},
+		}}
+	}
+
+	// The network of the caller decides which IDs are accepted.
+	if _, err := StateMinerInfo(context.Background(), NewCaller(newClient()), "t01234", nil); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("err = %v, want calibnet address rejected by a mainnet caller", err)
+	}
+	caller := NewNetworkCaller(newClient(), address.Testnet)
+	if _, err := StateMinerInfo(context.Background(), caller, "t01234", nil); err != nil {
+		t.Errorf("calibnet address rejected by a calibnet caller: %s", err)
+	}
+
+	// A Resolver created for a network accepts its IDs.
+	r, err := NewResolver(WithClient(newClient()), WithNetwork(address.Testnet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.SpidToAddrInfo(context.Background(), "t01234"); err != nil {
+		t.Errorf("calibnet address rejected by a calibnet resolver: %s", err)
+	}
+	if _, err = r.SpidToAddrInfo(context.Background(), "f01234"); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("err = %v, want mainnet address rejected", err)
+	}
+}
+
+func TestMarketParticipantsRetryEmpty(t *testing.T) {
+	defer func(delay time.Duration) {
+		emptyParticipantsRetryDelay = delay
+	}(emptyParticipantsRetryDelay)
+	emptyParticipantsRetryDelay = time.Millisecond
+
+	client := &emptyOnceClient{
+		fakeClient: fakeClient{results: map[string]interface{}{
+			"Filecoin.StateMarketParticipants": map[string]MarketBalance{
+				"f01234": {Escrow: big.NewInt(1), Locked: big.NewInt(0)},
+			},
+		}},
+	}
+	minerList, err := MarketParticipants(context.Background(), NewCaller(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(minerList) != 1 {
+		t.Fatalf("got %d participants, want 1", len(minerList))
+	}
+	if len(client.calls) != 2 {
+		t.Errorf("expected 2 calls, got %v", client.calls)
+	}
+
+	// A gateway that always returns no participants is only asked twice.
+	client = &emptyOnceClient{fakeClient: fakeClient{results: map[string]interface{}{
+		"Filecoin.StateMarketParticipants": map[string]MarketBalance{},
+	}}}
+	minerList, err = MarketParticipants(context.Background(), NewCaller(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(minerList) != 0 {
+		t.Errorf("got %d participants, want 0", len(minerList))
+	}
+	if len(client.calls) != 2 {
+		t.Errorf("expected 2 calls, got %v", client.calls)
+	}
+}
+
+func TestStreamMarketParticipantsRetryEmpty(t *testing.T) {
+	defer func(delay time.Duration) {
+		emptyParticipantsRetryDelay = delay
+	}(emptyParticipantsRetryDelay)
+	emptyParticipantsRetryDelay = time.Millisecond
+
+	client := &emptyOnceClient{
+		fakeClient: fakeClient{results: map[string]interface{}{
+			"Filecoin.StateMarketParticipants": map[string]MarketBalance{
+				"f01234": {Escrow: big.NewInt(1), Locked: big.NewInt(0)},
+			},
+		}},
+	}
+	var ids []string
+	err := StreamMarketParticipants(context.Background(), NewCaller(client), func(minerID string, _ MarketBalance) error {
+		ids = append(ids, minerID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalStrings(ids, []string{"f01234"}) {
+		t.Errorf("got %v, want [f01234]", ids)
+	}
+	if len(client.calls) != 2 {
+		t.Errorf("expected 2 calls, got %v", client.calls)
+	}
+
+	// Participants that are read are not asked for again, even if the
+	// function skips them all.
+	client = &emptyOnceClient{fakeClient: fakeClient{results: map[string]interface{}{
+		"Filecoin.StateMarketParticipants": map[string]MarketBalance{
+			"f01234": {Escrow: big.NewInt(1), Locked: big.NewInt(0)},
+		},
+	}}}
+	client.calls = []string{"Filecoin.StateMarketParticipants"}
+	err = StreamMarketParticipants(context.Background(), NewCaller(client), func(string, MarketBalance) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.calls) != 2 {
+		t.Errorf("expected 1 more call, got %v", client.calls)
+	}
+}
+
+func TestReadMarketParticipants(t *testing.T) {
+	const participants = `{
+		"f01000": {"Escrow": "10", "Locked": "1"},
+		"f01001": {"Escrow": "20", "Locked": "2"},
+		"f01002": {"Escrow": "30", "Locked": "3"}
+	}`
+
+	minerList, err := ReadMarketParticipants(strings.NewReader(participants), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(minerList) != 3 {
+		t.Fatalf("expected 3 participants, got %d", len(minerList))
+	}
+	if minerList["f01001"].Escrow.String() != "20" {
+		t.Errorf("wrong escrow for f01001: %s", minerList["f01001"].Escrow)
+	}
+
+	minerList, err = ReadMarketParticipants(strings.NewReader(participants), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(minerList) != 2 {
+		t.Fatalf("expected 2 participants, got %d", len(minerList))
+	}
+
+	_, err = ReadMarketParticipants(strings.NewReader(`["f01000"]`), 0)
+	if err == nil {
+		t.Fatal("expected error reading non-object")
+	}
+}
+
+func TestResolveAccountsMultisigOwner(t *testing.T) {
+	owner, err := address.NewIDAddress(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker, err := address.NewIDAddress(1001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A multisig actor has an ID address but no key address.
+	client := &fakeClient{
+		results: map[string]interface{}{"Filecoin.StateLookupID": owner},
+		errs: map[string]error{
+			"Filecoin.StateAccountKey": errors.New("failed to get account actor state: actor code is not account"),
+		},
+	}
+	minerInfo := MinerInfo{Owner: owner, Worker: worker}
+	accounts := ResolveAccounts(context.Background(), NewCaller(client), minerInfo, nil)
+	if len(accounts) != 2 {
+		t.Fatalf("got %d accounts, want 2", len(accounts))
+	}
+	acct := accounts[0]
+	if acct.Role != "Owner" || acct.Addr != owner {
+		t.Errorf("first account is %s %s, want Owner %s", acct.Role, acct.Addr, owner)
+	}
+	if acct.Resolved() {
+		t.Error("multisig owner should not be resolved")
+	}
+	if acct.ID != owner {
+		t.Errorf("ID = %s, want %s", acct.ID, owner)
+	}
+	if acct.Key != address.Undef {
+		t.Errorf("Key = %s, want undefined", acct.Key)
+	}
+
+	// A failed ID lookup leaves both forms undefined.
+	client = &fakeClient{errs: map[string]error{
+		"Filecoin.StateLookupID": errors.New("actor not found"),
+	}}
+	accounts = ResolveAccounts(context.Background(), NewCaller(client), minerInfo, nil)
+	for _, acct := range accounts {
+		if acct.Resolved() || acct.ID != address.Undef || acct.Key != address.Undef {
+			t.Errorf("%s account should be unresolved: %+v", acct.Role, acct)
+		}
+	}
+	for _, method := range client.calls {
+		if method == "Filecoin.StateAccountKey" {
+			t.Error("key address looked up after ID lookup failed")
+		}
+	}
+}
+
+func TestCheckMinerActor(t *testing.T) {
+	minerCode, err := cid.Decode("bafk2bzacecqb3eolfurehny6yp7tgmapib4ocazo5ilkopjce2c7wc2bcec62")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountCode, err := cid.Decode("bafk2bzaceampw4romta75hyz5p4cqriypmpbgnkxncgxgqn6zptv5goommg5y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &fakeClient{results: map[string]interface{}{
+		"Filecoin.StateNetworkVersion": 21,
+		"Filecoin.StateActorCodeCIDs": map[string]cid.Cid{
+			"account":      accountCode,
+			"storageminer": minerCode,
+		},
+	}}
+	caller := NewCaller(client)
+	names, err := GetActorNames(context.Background(), caller, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.results["Filecoin.StateGetActor"] = Actor{Code: minerCode, Balance: big.Zero()}
+	if err = CheckMinerActor(context.Background(), caller, "f01234", nil, names); err != nil {
+		t.Errorf("miner actor rejected: %s", err)
+	}
+
+	client.results["Filecoin.StateGetActor"] = Actor{Code: accountCode, Balance: big.Zero()}
+	err = CheckMinerActor(context.Background(), caller, "f01234", nil, names)
+	if !errors.Is(err, ErrNotMiner) {
+		t.Fatalf("expected ErrNotMiner, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "account actor") {
+		t.Errorf("error does not name the actor: %s", err)
+	}
+
+	// Actors from before network version 16 are named by their code CID.
+	legacyCode, err := cid.V1Builder{Codec: cid.Raw, MhType: multihash.IDENTITY}.Sum([]byte("fil/7/storageminer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.results["Filecoin.StateGetActor"] = Actor{Code: legacyCode, Balance: big.Zero()}
+	if err = CheckMinerActor(context.Background(), caller, "f01234", nil, names); err != nil {
+		t.Errorf("legacy miner actor rejected: %s", err)
+	}
+}
+
+func TestFormatFIL(t *testing.T) {
+	tests := []struct {
+		attoFIL   string
+		precision int
+		want      string
+	}{
+		{"0", FILDecimals, "0 FIL"},
+		{"1", FILDecimals, "0.000000000000000001 FIL"},
+		{"999999999999999999", FILDecimals, "0.999999999999999999 FIL"},
+		{"1000000000000000000", FILDecimals, "1 FIL"},
+		{"1500000000000000000", FILDecimals, "1.5 FIL"},
+		{"-250000000000000000", FILDecimals, "-0.25 FIL"},
+		{"123456789000000000000000000000", FILDecimals, "123456789000 FIL"},
+		{"123456789123456789123456789", FILDecimals, "123456789.123456789123456789 FIL"},
+		{"1234567890000000000", 3, "1.235 FIL"},
+		{"1500000000000000000", 3, "1.5 FIL"},
+		{"999999999999999999", 3, "1 FIL"},
+		{"1", 3, "0 FIL"},
+		{"-1", 3, "0 FIL"},
+		{"-1234567890000000000", 0, "-1 FIL"},
+		{"1", -1, "0.000000000000000001 FIL"},
+		{"1", 30, "0.000000000000000001 FIL"},
+	}
+	for _, tt := range tests {
+		attoFIL, err := big.FromString(tt.attoFIL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := FormatFILPrecision(attoFIL, tt.precision); got != tt.want {
+			t.Errorf("FormatFILPrecision(%s, %d) = %s, want %s", tt.attoFIL, tt.precision, got, tt.want)
+		}
+	}
+	if got := FormatFIL(big.NewInt(1)); got != "0.000000000000000001 FIL" {
+		t.Errorf("FormatFIL(1) = %s, want 0.000000000000000001 FIL", got)
+	}
+	if got := FormatFIL(big.Int{}); got != "0 FIL" {
+		t.Errorf("FormatFIL of nil = %s, want 0 FIL", got)
+	}
+}
+
+func TestOutputJSON(t *testing.T) {
+	out := NewOutput(ChainHeadResult{
+		Height: 100,
+		Cids:   []string{"bafy"},
+	})
+	data, err := json.Marshal(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"version":1,"result":{"height":100,"cids":["bafy"]}}`
+	if string(data) != want {
+		t.Errorf("chain head output is %s, want %s", data, want)
+	}
+
+	// Information that was not requested is omitted.
+	data, err = json.Marshal(NewOutput(FindResult{
+		StorageProvider: "f01234",
+		PeerID:          "12D3Koo",
+		Addrs:           []string{},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{"version":1,"result":{"storageProvider":"f01234","peerId":"12D3Koo","addrs":[]}}`
+	if string(data) != want {
+		t.Errorf("find output is %s, want %s", data, want)
+	}
+
+	// Errors are written without an envelope.
+	data, err = json.Marshal(ErrorResult{
+		Error: "has no peer ID",
+		SPID:  "f01234",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{"error":"has no peer ID","spid":"f01234"}`
+	if string(data) != want {
+		t.Errorf("error output is %s, want %s", data, want)
+	}
+}
+
+func TestWSClient(t *testing.T) {
+	var conns atomic.Int32
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		conns.Add(1)
+		for {
+			var req jrpc.RPCRequest
+			if err := ws.ReadJSON(&req); err != nil {
+				return
+			}
+			switch req.Method {
+			case "Filecoin.ChainHead":
+				ws.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": map[string]int{"Height": 7}})
+			case "Drop":
+				// Close the connection without responding.
+				return
+			default:
+				ws.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "error": map[string]interface{}{"code": 1, "message": "not found"}})
+			}
+		}
+	}))
+	defer srv.Close()
+
+	client, err := NewWSClient(srv.URL, "", "secret", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var ets ExpTipSet
+	for i := 0; i < 2; i++ {
+		if err = client.CallFor(&ets, "Filecoin.ChainHead"); err != nil {
+			t.Fatal(err)
+		}
+		if ets.Height != 7 {
+			t.Fatalf("height is %d, want 7", ets.Height)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("calls made over %d connections, want 1", n)
+	}
+
+	var rpcErr *jrpc.RPCError
+	if err = client.CallFor(&ets, "Filecoin.Unknown"); !errors.As(err, &rpcErr) {
+		t.Errorf("unknown method returned %v, want RPC error", err)
+	}
+
+	// A dropped connection fails the call, and the next call reconnects.
+	if err = client.CallFor(&ets, "Drop"); err == nil {
+		t.Error("call on dropped connection succeeded")
+	}
+	if err = client.CallFor(&ets, "Filecoin.ChainHead"); err != nil {
+		t.Fatal(err)
+	}
+	if n := conns.Load(); n != 2 {
+		t.Errorf("calls made over %d connections, want 2", n)
+	}
+
+	// A refused handshake returns its status code.
+	client, err = NewWSClient(srv.URL, "", "", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handshakeErr *HandshakeError
+	if err = client.CallFor(&ets, "Filecoin.ChainHead"); !errors.As(err, &handshakeErr) || handshakeErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("call without token returned %v, want handshake error with status 401", err)
+	}
+
+	// Connections are opened with the given dialer.
+	var proxied atomic.Bool
+	dialer := *websocket.DefaultDialer
+	dialer.Proxy = func(*http.Request) (*url.URL, error) {
+		proxied.Store(true)
+		return nil, nil
+	}
+	client, err = NewWSClientWithDialer(srv.URL, "", "secret", 5*time.Second, &dialer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err = client.CallFor(&ets, "Filecoin.ChainHead"); err != nil {
+		t.Fatal(err)
+	}
+	if !proxied.Load() {
+		t.Error("connection not opened with the dialer")
+	}
+}
+
+// newMinerInfoServer returns a gateway that answers Filecoin.StateMinerInfo
+// calls, single or batched, after waiting for latency for each HTTP request.
+// The miner f099 does not exist.
+func newMinerInfoServer(tb testing.TB, latency time.Duration) *httptest.Server {
+	tb.Helper()
+	answer := func(req jrpc.RPCRequest) jrpc.RPCResponse {
+		resp := jrpc.RPCResponse{JSONRPC: "2.0", ID: req.ID}
+		params, _ := req.Params.([]interface{})
+		if len(params) == 0 || params[0] == "f099" {
+			resp.Error = &jrpc.RPCError{Code: 1, Message: "actor not found"}
+			return resp
+		}
+		resp.Result = MinerInfo{SectorSize: 34359738368}
+		return resp
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(latency)
+		var raw json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(raw) != 0 && raw[0] == '[' {
+			var reqs []jrpc.RPCRequest
+			if err := json.Unmarshal(raw, &reqs); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			resps := make([]jrpc.RPCResponse, len(reqs))
+			for i, req := range reqs {
+				resps[i] = answer(req)
+			}
+			json.NewEncoder(w).Encode(resps)
+			return
+		}
+		var req jrpc.RPCRequest
+		if err := json.Unmarshal(raw, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(answer(req))
+	}))
+	tb.Cleanup(srv.Close)
+	return srv
+}
+
+func TestCallBatch(t *testing.T) {
+	srv := newMinerInfoServer(t, 0)
+	client, err := NewClient(srv.URL, "", "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responses, err := CallBatch(context.Background(), client, jrpc.RPCRequests{
+		jrpc.NewRequest(MethodStateMinerInfo, "f01000", nil),
+		jrpc.NewRequest(MethodStateMinerInfo, "f099", nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byID := responses.AsMap()
+	if len(byID) != 2 {
+		t.Fatalf("got %d responses, want 2", len(byID))
+	}
+	var minerInfo MinerInfo
+	if err = byID[0].GetObject(&minerInfo); err != nil {
+		t.Fatal(err)
+	}
+	if minerInfo.SectorSize != 34359738368 {
+		t.Errorf("sector size is %d, want 34359738368", minerInfo.SectorSize)
+	}
+	if byID[1].Error == nil {
+		t.Error("expected an error for a miner that does not exist")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = CallBatch(ctx, client, jrpc.RPCRequests{jrpc.NewRequest(MethodStateMinerInfo, "f01000", nil)}); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
+
+// benchmarkMiners is the number of miners looked up in each iteration of the
+// miner info benchmarks, which is a typical batch size.
+const benchmarkMiners = 50
+
+// benchmarkLatency is the simulated round trip time to the gateway.
+const benchmarkLatency = time.Millisecond
+
+func BenchmarkStateMinerInfoPerCall(b *testing.B) {
+	srv := newMinerInfoServer(b, benchmarkLatency)
+	client, err := NewClient(srv.URL, "", "", time.Second)
+	if err != nil {
+		b.Fatal(err)
+	}
+	caller := NewCaller(client)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < benchmarkMiners; j++ {
+			if _, err = StateMinerInfo(ctx, caller, "f01000", nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkStateMinerInfoBatch(b *testing.B) {
+	srv := newMinerInfoServer(b, benchmarkLatency)
+	client, err := NewClient(srv.URL, "", "", time.Second)
+	if err != nil {
+		b.Fatal(err)
+	}
+	spAddress, err := ParseAddress("f01000", address.Mainnet)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		requests := make(jrpc.RPCRequests, benchmarkMiners)
+		for j := range requests {
+			requests[j] = jrpc.NewRequest(MethodStateMinerInfo, spAddress, nil)
+		}
+		responses, err := CallBatch(ctx, client, requests)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, resp := range responses {
+			var minerInfo MinerInfo
+			if err = resp.GetObject(&minerInfo); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestStreamMarketParticipants(t *testing.T) {
+	defer func(delay time.Duration) {
+		emptyParticipantsRetryDelay = delay
+	}(emptyParticipantsRetryDelay)
+	emptyParticipantsRetryDelay = time.Millisecond
+
+	var status int
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req jrpc.RPCRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Method != MethodStateMarketParticipants {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+	client, err := NewClient(srv.URL, "", "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collect := func(caller Caller, stopAfter int) ([]string, error) {
+		var ids []string
+		err := StreamMarketParticipants(context.Background(), caller, func(minerID string, _ MarketBalance) error {
+			ids = append(ids, minerID)
+			if len(ids) == stopAfter {
+				return errStopStream
+			}
+			return nil
+		})
+		return ids, err
+	}
+
+	status = http.StatusOK
+	body = `{"jsonrpc":"2.0","id":1,"result":{"f01000":{"Escrow":"1","Locked":"0"},"f01001":{"Escrow":"2","Locked":"1"}}}`
+	ids, err := collect(NewCaller(client), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalStrings(ids, []string{"f01000", "f01001"}) {
+		t.Errorf("got %v, want [f01000 f01001]", ids)
+	}
+
+	// Reading stops when the function returns an error.
+	ids, err = collect(NewCaller(client), 1)
+	if !errors.Is(err, errStopStream) || len(ids) != 1 {
+		t.Errorf("got %v, %v, want 1 participant and errStopStream", ids, err)
+	}
+
+	status = http.StatusOK
+	body = `{"jsonrpc":"2.0","id":1,"result":null}`
+	if ids, err = collect(NewCaller(client), 0); err != nil || len(ids) != 0 {
+		t.Errorf("got %v, %v, want no participants", ids, err)
+	}
+
+	status = http.StatusInternalServerError
+	body = `{"jsonrpc":"2.0","id":1,"error":{"code":1,"message":"actor not found"}}`
+	_, err = collect(NewCaller(client), 0)
+	var rpcErr *jrpc.RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Message != "actor not found" {
+		t.Errorf("err = %v, want RPC error", err)
+	}
+
+	status = http.StatusTooManyRequests
+	body = "slow down"
+	_, err = collect(NewCaller(client), 0)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("err = %v, want *StatusError with status 429", err)
+	}
+
+	// A client that cannot stream reads the whole result first.
+	fake := &fakeClient{results: map[string]interface{}{
+		MethodStateMarketParticipants: map[string]MarketBalance{
+			"f01000": {Escrow: big.NewInt(1), Locked: big.NewInt(0)},
+		},
+	}}
+	ids, err = collect(NewCaller(fake), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalStrings(ids, []string{"f01000"}) {
+		t.Errorf("got %v, want [f01000]", ids)
+	}
+}
+
+func TestChainGetTipSetByHeightEmpty(t *testing.T) {
+	client := &fakeClient{results: map[string]interface{}{
+		"Filecoin.ChainGetTipSetByHeight": ExpTipSet{},
+	}}
+	_, err := ChainGetTipSetByHeight(context.Background(), NewCaller(client), 1234, nil)
+	if !errors.Is(err, ErrNoTipSetAtHeight) {
+		t.Fatalf("err = %v, want ErrNoTipSetAtHeight", err)
+	}
+	if err.Error() != "no tipset CIDs returned for height 1234" {
+		t.Errorf("unexpected error message %q", err)
+	}
+}
@@ -0,0 +1,214 @@
+package spidresolver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	jrpc "github.com/ybbus/jsonrpc/v2"
+)
+
+// StreamClient is a Client that can also make a call whose result is decoded
+// while the response is being read, so that a large result is never held in
+// memory all at once. It is satisfied by the HTTP client returned by NewClient.
+type StreamClient interface {
+	Client
+	CallStream(ctx context.Context, decodeResult func(dec *json.Decoder) error, method string, params ...interface{}) error
+}
+
+// StreamCaller is a Caller that can also make a call whose result is decoded
+// while the response is being read. The Caller returned by NewCaller is a
+// StreamCaller.
+type StreamCaller interface {
+	Caller
+	CallStream(ctx context.Context, decodeResult func(dec *json.Decoder) error, method string, params ...interface{}) error
+}
+
+// CallStream makes an RPC call with client, and calls decodeResult with a
+// decoder whose next value is the result. If client is not a StreamClient, the
+// whole result is read first, and then decoded.
+func CallStream(ctx context.Context, client Client, decodeResult func(dec *json.Decoder) error, method string, params ...interface{}) error {
+	if streamClient, ok := client.(StreamClient); ok {
+		return streamClient.CallStream(ctx, decodeResult, method, params...)
+	}
+	var raw json.RawMessage
+	if err := CallFor(ctx, client, &raw, method, params...); err != nil {
+		return err
+	}
+	return decodeResult(json.NewDecoder(bytes.NewReader(raw)))
+}
+
+func (c clientCaller) CallStream(ctx context.Context, decodeResult func(dec *json.Decoder) error, method string, params ...interface{}) error {
+	return CallStream(ctx, c.client, decodeResult, method, params...)
+}
+
+// StatusError is returned by a streamed call when the gateway responds with
+// an HTTP error status, instead of a JSON-RPC response.
+type StatusError struct {
+	Method     string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("rpc call %s: %d %s", e.Method, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// httpRPCClient is the JSON-RPC client returned by NewClient. Calls are made by
+// the jsonrpc client, except for streamed calls, which it cannot make.
+type httpRPCClient struct {
+	jrpc.RPCClient
+	endpoint   string
+	token      string
+	httpClient *http.Client
+}
+
+// CallStream makes an RPC call, and calls decodeResult with a decoder whose
+// next value is the result. The response is not read after decodeResult
+// returns. An error response is returned as a *jrpc.RPCError, and an HTTP
+// error status as a *StatusError.
+func (c *httpRPCClient) CallStream(ctx context.Context, decodeResult func(dec *json.Decoder) error, method string, params ...interface{}) error {
+	body, err := json.Marshal(jrpc.NewRequest(method, params...))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("rpc call %s on %s: %w", method, c.endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	// An error status may come with an error response, which is returned if
+	// it can be read.
+	err = decodeResponse(json.NewDecoder(resp.Body), decodeResult)
+	if err != nil && resp.StatusCode >= 400 {
+		var rpcErr *jrpc.RPCError
+		if !errors.As(err, &rpcErr) {
+			return &StatusError{Method: method, StatusCode: resp.StatusCode}
+		}
+	}
+	return err
+}
+
+// decodeResponse reads a JSON-RPC response object from dec. When the result
+// is reached, decodeResult is called to decode it, and the rest of the
+// response is not read. The other members are skipped.
+func decodeResponse(dec *json.Decoder, decodeResult func(dec *json.Decoder) error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return errors.New("rpc response is not a JSON object")
+	}
+	for dec.More() {
+		tok, err = dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case "result":
+			return decodeResult(dec)
+		case "error":
+			var rpcErr *jrpc.RPCError
+			if err = dec.Decode(&rpcErr); err != nil {
+				return err
+			}
+			if rpcErr != nil {
+				return rpcErr
+			}
+		default:
+			var skip json.RawMessage
+			if err = dec.Decode(&skip); err != nil {
+				return err
+			}
+		}
+	}
+	return errors.New("rpc response has no result")
+}
+
+// errStopStream is returned by the function given to StreamMarketParticipants
+// to stop reading participants without an error.
+var errStopStream = errors.New("stop stream")
+
+// StreamMarketParticipants calls Filecoin.StateMarketParticipants, and calls fn
+// with the ID and balance of each participant as it is read from the
+// response. The response is decoded one entry at a time, so the participants
+// are never all held in memory. Reading stops, and the error is returned, if fn
+// returns an error. If caller is not a StreamCaller, the participants are all
+// read first. As with MarketParticipants, if the gateway returns no
+// participants, they are requested once more after a short delay.
+func StreamMarketParticipants(ctx context.Context, caller Caller, fn func(minerID string, balance MarketBalance) error) error {
+	var read int
+	count := func(minerID string, balance MarketBalance) error {
+		read++
+		return fn(minerID, balance)
+	}
+	err := streamMarketParticipants(ctx, caller, count)
+	if err != nil || read != 0 {
+		return err
+	}
+	if err = waitEmptyParticipants(ctx); err != nil {
+		return err
+	}
+	return streamMarketParticipants(ctx, caller, fn)
+}
+
+func streamMarketParticipants(ctx context.Context, caller Caller, fn func(minerID string, balance MarketBalance) error) error {
+	decode := func(dec *json.Decoder) error {
+		return decodeParticipants(dec, fn)
+	}
+	if streamCaller, ok := caller.(StreamCaller); ok {
+		return streamCaller.CallStream(ctx, decode, MethodStateMarketParticipants, nil)
+	}
+	var raw json.RawMessage
+	if err := caller.CallFor(ctx, &raw, MethodStateMarketParticipants, nil); err != nil {
+		return err
+	}
+	return decode(json.NewDecoder(bytes.NewReader(raw)))
+}
+
+// decodeParticipants decodes a JSON object of market participants keyed by
+// miner ID from dec, one entry at a time, and calls fn with each. A null
+// object has no participants.
+func decodeParticipants(dec *json.Decoder, fn func(minerID string, balance MarketBalance) error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return errors.New("market participants are not a JSON object")
+	}
+	for dec.More() {
+		tok, err = dec.Token()
+		if err != nil {
+			return err
+		}
+		minerID, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("unexpected %v in market participants", tok)
+		}
+		var balance MarketBalance
+		if err = dec.Decode(&balance); err != nil {
+			return fmt.Errorf("market participant %s: %w", minerID, err)
+		}
+		if err = fn(minerID, balance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package spidresolver
+
+import (
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ExpTipSet is the subset of the lotus TipSet returned by Filecoin.ChainHead.
+type ExpTipSet struct {
+	Cids []cid.Cid
+	//Blocks []*BlockHeader
+	//Height abi.ChainEpoch
+	Blocks []interface{}
+	Height int64
+}
+
+// Actor is the result of Filecoin.StateGetActor.
+type Actor struct {
+	Code    cid.Cid
+	Head    cid.Cid
+	Nonce   uint64
+	Balance big.Int
+}
+
+// MinerInfo is the result of Filecoin.StateMinerInfo.
+type MinerInfo struct {
+	Owner                      address.Address
+	Worker                     address.Address
+	NewWorker                  address.Address
+	ControlAddresses           []address.Address
+	WorkerChangeEpoch          int64
+	PeerId                     *peer.ID
+	Multiaddrs                 [][]byte
+	WindowPoStProofType        int64
+	SectorSize                 uint64
+	WindowPoStPartitionSectors uint64
+	ConsensusFaultElapsed      int64
+	// Beneficiary receives the miner's funds when withdrawn, within the
+	// limits of BeneficiaryTerm. Gateways on network versions before
+	// beneficiaries were added do not return these fields, which are then
+	// zero.
+	Beneficiary            address.Address
+	BeneficiaryTerm        *BeneficiaryTerm
+	PendingBeneficiaryTerm *PendingBeneficiaryChange
+}
+
+// BeneficiaryTerm limits what the beneficiary of a miner can withdraw. Quota
+// and UsedQuota are in attoFIL, and Expiration is the epoch at which the term
+// ends.
+type BeneficiaryTerm struct {
+	Quota      big.Int
+	UsedQuota  big.Int
+	Expiration int64
+}
+
+// PendingBeneficiaryChange is a proposed change of a miner's beneficiary, which
+// takes effect once approved by both the new beneficiary and the current one.
+type PendingBeneficiaryChange struct {
+	NewBeneficiary        address.Address
+	NewQuota              big.Int
+	NewExpiration         int64
+	ApprovedByBeneficiary bool
+	ApprovedByNominee     bool
+}
+
+// Claim is the power claimed by a miner, or the total power of the network.
+type Claim struct {
+	RawBytePower    big.Int
+	QualityAdjPower big.Int
+}
+
+// MinerPower is the result of Filecoin.StateMinerPower.
+type MinerPower struct {
+	MinerPower  Claim
+	TotalPower  Claim
+	HasMinPower bool
+}
+
+// StorageAsk is the result of Filecoin.ClientQueryAsk. Prices are in attoFIL
+// and piece sizes are in bytes.
+type StorageAsk struct {
+	Price         big.Int
+	VerifiedPrice big.Int
+	MinPieceSize  uint64
+	MaxPieceSize  uint64
+	Miner         address.Address
+	Timestamp     int64
+	Expiry        int64
+	SeqNo         uint64
+}
+
+// MarketBalance is the value type of the map returned by
+// Filecoin.StateMarketParticipants.
+type MarketBalance struct {
+	Escrow big.Int
+	Locked big.Int
+}
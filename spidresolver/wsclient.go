@@ -0,0 +1,295 @@
+package spidresolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	jrpc "github.com/ybbus/jsonrpc/v2"
+)
+
+// errConnClosed is returned by calls made after a WSClient is closed.
+var errConnClosed = errors.New("websocket client is closed")
+
+// HandshakeError is returned by a WSClient call when the gateway responds to
+// the request to open a WebSocket connection without opening it, such as when
+// the token is not valid.
+type HandshakeError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("cannot open websocket: %s: %s", http.StatusText(e.StatusCode), e.Err)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// WSClient is a JSON-RPC client that sends all calls over a single WebSocket
+// connection, instead of making an HTTP request for each call. Calls may be
+// made concurrently. If the connection drops, the calls waiting for a response
+// on it fail, and the next call opens a new connection.
+type WSClient struct {
+	endpoint string
+	header   http.Header
+	timeout  time.Duration
+	dialer   websocket.Dialer
+
+	mu     sync.Mutex
+	conn   *wsConn
+	nextID uint64
+	closed bool
+}
+
+// NewWSClient returns a WebSocket JSON-RPC client for the gateway, using
+// rpcPath as described by GatewayURL. The gateway may also be a ws or wss URL.
+// An http gateway is connected to with ws, and an https gateway with wss.
+// Connecting and each call are limited by timeout. A timeout of zero means no
+// limit.
+//
+// If token is not empty, it is sent as a bearer token when connecting.
+func NewWSClient(gateway, rpcPath, token string, timeout time.Duration) (*WSClient, error) {
+	return NewWSClientWithTLSConfig(gateway, rpcPath, token, timeout, nil)
+}
+
+// NewWSClientWithTLSConfig returns a WebSocket JSON-RPC client, as described
+// by NewWSClient, that connects to a wss gateway using tlsConfig, such as one
+// that trusts a private CA. A nil tlsConfig uses the default configuration.
+func NewWSClientWithTLSConfig(gateway, rpcPath, token string, timeout time.Duration, tlsConfig *tls.Config) (*WSClient, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	return NewWSClientWithDialer(gateway, rpcPath, token, timeout, &dialer)
+}
+
+// NewWSClientWithDialer returns a WebSocket JSON-RPC client, as described by
+// NewWSClient, that opens its connections with dialer, such as one that
+// connects through a proxy. The dialer is copied, so later changes to it have
+// no effect.
+func NewWSClientWithDialer(gateway, rpcPath, token string, timeout time.Duration, dialer *websocket.Dialer) (*WSClient, error) {
+	gateway = strings.TrimSpace(gateway)
+	if rest, ok := strings.CutPrefix(gateway, "ws://"); ok {
+		gateway = "http://" + rest
+	} else if rest, ok := strings.CutPrefix(gateway, "wss://"); ok {
+		gateway = "https://" + rest
+	}
+	endpoint, err := GatewayURL(gateway, rpcPath)
+	if err != nil {
+		return nil, err
+	}
+	// GatewayURL only returns http and https URLs.
+	endpoint = "ws" + strings.TrimPrefix(endpoint, "http")
+
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	return &WSClient{
+		endpoint: endpoint,
+		header:   header,
+		timeout:  timeout,
+		dialer:   *dialer,
+	}, nil
+}
+
+// CallFor calls the RPC method and decodes the result into out.
+func (c *WSClient) CallFor(out interface{}, method string, params ...interface{}) error {
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	conn, id, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	respChan := conn.register(id)
+	defer conn.unregister(id)
+
+	if params == nil {
+		params = []interface{}{}
+	}
+	req := jrpc.RPCRequest{
+		JSONRPC: "2.0",
+		ID:      int(id),
+		Method:  method,
+		Params:  params,
+	}
+	if err = conn.write(ctx, &req); err != nil {
+		return err
+	}
+
+	select {
+	case resp := <-respChan:
+		if resp.err != nil {
+			return resp.err
+		}
+		if resp.Error != nil {
+			return resp.Error
+		}
+		return json.Unmarshal(resp.Result, out)
+	case <-ctx.Done():
+		return fmt.Errorf("rpc call %s: %w", method, ctx.Err())
+	}
+}
+
+// Close closes the connection. Calls waiting for a response fail, and later
+// calls return an error.
+func (c *WSClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.ws.Close()
+	c.conn = nil
+	return err
+}
+
+// connect returns the open connection, or opens a new one if there is none,
+// and the ID for the next request.
+func (c *WSClient) connect(ctx context.Context) (*wsConn, uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, 0, errConnClosed
+	}
+	c.nextID++
+	if c.conn != nil && !c.conn.isDone() {
+		return c.conn, c.nextID, nil
+	}
+
+	ws, resp, err := c.dialer.DialContext(ctx, c.endpoint, c.header)
+	if err != nil {
+		if resp != nil {
+			return nil, 0, &HandshakeError{StatusCode: resp.StatusCode, Err: err}
+		}
+		return nil, 0, err
+	}
+	c.conn = newWSConn(ws)
+	return c.conn, c.nextID, nil
+}
+
+// wsResponse is a JSON-RPC response, or the error that ended the connection
+// before the response arrived.
+type wsResponse struct {
+	ID     uint64          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *jrpc.RPCError  `json:"error"`
+	err    error
+}
+
+// wsConn is one WebSocket connection, and the calls waiting for a response on
+// it.
+type wsConn struct {
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint64]chan wsResponse
+	// err is the error that ended the connection, if it has ended.
+	err error
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+	conn := &wsConn{
+		ws:      ws,
+		pending: make(map[uint64]chan wsResponse),
+	}
+	go conn.readLoop()
+	return conn
+}
+
+func (conn *wsConn) isDone() bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.err != nil
+}
+
+// register returns the channel on which the response to the request with the
+// given ID is sent. If the connection has already ended, the channel receives
+// the error that ended it.
+func (conn *wsConn) register(id uint64) <-chan wsResponse {
+	respChan := make(chan wsResponse, 1)
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.err != nil {
+		respChan <- wsResponse{err: conn.err}
+		return respChan
+	}
+	conn.pending[id] = respChan
+	return respChan
+}
+
+func (conn *wsConn) unregister(id uint64) {
+	conn.mu.Lock()
+	delete(conn.pending, id)
+	conn.mu.Unlock()
+}
+
+// write sends the request. The connection is ended if the request cannot be
+// sent, since a partly written message leaves it unusable.
+func (conn *wsConn) write(ctx context.Context, req *jrpc.RPCRequest) error {
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+	deadline, _ := ctx.Deadline()
+	conn.ws.SetWriteDeadline(deadline)
+	if err := conn.ws.WriteJSON(req); err != nil {
+		conn.fail(err)
+		return err
+	}
+	return nil
+}
+
+// readLoop delivers each response to the call waiting for it, until the
+// connection ends.
+func (conn *wsConn) readLoop() {
+	for {
+		var resp wsResponse
+		if err := conn.ws.ReadJSON(&resp); err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				// Skip a message that is not a response, such as a
+				// notification.
+				continue
+			}
+			conn.fail(fmt.Errorf("websocket connection lost: %w", err))
+			return
+		}
+		conn.mu.Lock()
+		respChan, ok := conn.pending[resp.ID]
+		delete(conn.pending, resp.ID)
+		conn.mu.Unlock()
+		if ok {
+			respChan <- resp
+		}
+	}
+}
+
+// fail ends the connection, and sends err to every call waiting for a
+// response.
+func (conn *wsConn) fail(err error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.err != nil {
+		return
+	}
+	conn.err = err
+	conn.ws.Close()
+	for id, respChan := range conn.pending {
+		respChan <- wsResponse{err: err}
+		delete(conn.pending, id)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+	"github.com/libp2p/go-libp2p/core/peer"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// askProtocolID is the libp2p protocol that storage providers serve their
+// storage ask on.
+const askProtocolID = "/fil/storage/ask/1.1.0"
+
+// errNoAsk is the error for a miner that answered the storage ask protocol
+// without an ask.
+var errNoAsk = errors.New("storage ask response has no ask")
+
+// directAsker queries the storage ask of miners by connecting to them with a
+// libp2p host, and using the storage ask protocol, instead of calling
+// Filecoin.ClientQueryAsk on the gateway.
+type directAsker struct {
+	*p2pHost
+	// noFallback is set if the gateway does not support
+	// Filecoin.ClientQueryAsk, so it is not called when a direct query fails.
+	noFallback bool
+}
+
+func newDirectAsker(timeout time.Duration) (*directAsker, error) {
+	h, err := newP2PHost(timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &directAsker{p2pHost: h}, nil
+}
+
+// queryAsk connects to the miner, and reads its storage ask from a storage ask
+// protocol stream. The whole exchange must complete within the timeout. The
+// signature of the ask is not verified.
+func (a *directAsker) queryAsk(ctx context.Context, minerId string, addrInfo peer.AddrInfo) (*spidresolver.StorageAsk, error) {
+	minerAddr, err := address.NewFromString(minerId)
+	if err != nil {
+		return nil, err
+	}
+
+	var ask *spidresolver.StorageAsk
+	err = a.connect(ctx, addrInfo, func(ctx context.Context) error {
+		stream, err := a.host.NewStream(ctx, addrInfo.ID, askProtocolID)
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			stream.SetDeadline(deadline)
+		}
+
+		var req bytes.Buffer
+		if err = writeAskRequest(&req, minerAddr); err != nil {
+			return err
+		}
+		if _, err = stream.Write(req.Bytes()); err != nil {
+			return err
+		}
+		ask, err = readAskResponse(bufio.NewReader(stream))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ask.Miner != minerAddr {
+		return nil, fmt.Errorf("storage ask is for miner %s", ask.Miner)
+	}
+	return ask, nil
+}
+
+// writeAskRequest writes a storage ask request for the miner, which is a CBOR
+// map with the miner address.
+func writeAskRequest(w io.Writer, minerAddr address.Address) error {
+	if err := cbg.WriteMajorTypeHeader(w, cbg.MajMap, 1); err != nil {
+		return err
+	}
+	if err := writeCborString(w, "Miner"); err != nil {
+		return err
+	}
+	return minerAddr.MarshalCBOR(w)
+}
+
+// readAskResponse reads a storage ask response, which is a CBOR map holding
+// the signed ask in its "Ask" field. The signed ask holds the ask in its own
+// "Ask" field.
+func readAskResponse(r *bufio.Reader) (*spidresolver.StorageAsk, error) {
+	var ask *spidresolver.StorageAsk
+	err := readCborMap(r, func(name string) error {
+		if name != "Ask" {
+			return skipCbor(r)
+		}
+		return readCborMap(r, func(name string) error {
+			if name != "Ask" {
+				return skipCbor(r)
+			}
+			var err error
+			ask, err = readStorageAsk(r)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ask == nil {
+		return nil, errNoAsk
+	}
+	return ask, nil
+}
+
+// readStorageAsk reads a storage ask, which is a CBOR map. A null ask is
+// returned as nil.
+func readStorageAsk(r *bufio.Reader) (*spidresolver.StorageAsk, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] == cbg.CborNull[0] {
+		_, err = r.Discard(1)
+		return nil, err
+	}
+	var ask spidresolver.StorageAsk
+	err = readCborMap(r, func(name string) error {
+		switch name {
+		case "Price":
+			return ask.Price.UnmarshalCBOR(r)
+		case "VerifiedPrice":
+			return ask.VerifiedPrice.UnmarshalCBOR(r)
+		case "MinPieceSize":
+			return readCborUint(r, &ask.MinPieceSize)
+		case "MaxPieceSize":
+			return readCborUint(r, &ask.MaxPieceSize)
+		case "Miner":
+			return ask.Miner.UnmarshalCBOR(r)
+		case "Timestamp":
+			return readCborInt(r, &ask.Timestamp)
+		case "Expiry":
+			return readCborInt(r, &ask.Expiry)
+		case "SeqNo":
+			return readCborUint(r, &ask.SeqNo)
+		}
+		return skipCbor(r)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode storage ask: %w", err)
+	}
+	return &ask, nil
+}
+
+// readCborMap reads a CBOR map, calling field with the name of each entry, to
+// read its value. A null value is read as an empty map.
+func readCborMap(r *bufio.Reader, field func(name string) error) error {
+	b, err := r.Peek(1)
+	if err != nil {
+		return err
+	}
+	if b[0] == cbg.CborNull[0] {
+		_, err = r.Discard(1)
+		return err
+	}
+	maj, n, err := cbg.CborReadHeader(r)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajMap {
+		return fmt.Errorf("expected cbor map, got major type %d", maj)
+	}
+	for i := uint64(0); i < n; i++ {
+		name, err := cbg.ReadString(r)
+		if err != nil {
+			return err
+		}
+		if err = field(name); err != nil {
+			return fmt.Errorf("field %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func readCborUint(r io.Reader, v *uint64) error {
+	maj, extra, err := cbg.CborReadHeader(r)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajUnsignedInt {
+		return fmt.Errorf("wrong type for uint64 field: %d", maj)
+	}
+	*v = extra
+	return nil
+}
+
+func readCborInt(r io.Reader, v *int64) error {
+	var ci cbg.CborInt
+	if err := ci.UnmarshalCBOR(r); err != nil {
+		return err
+	}
+	*v = int64(ci)
+	return nil
+}
+
+func writeCborString(w io.Writer, s string) error {
+	if err := cbg.WriteMajorTypeHeader(w, cbg.MajTextString, uint64(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+// skipCbor reads and discards one CBOR value.
+func skipCbor(r io.Reader) error {
+	var d cbg.Deferred
+	return d.UnmarshalCBOR(r)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// cborEncoder writes CBOR values for tests, keeping the first error.
+type cborEncoder struct {
+	buf bytes.Buffer
+	err error
+}
+
+func (e *cborEncoder) header(maj byte, n uint64) {
+	if e.err == nil {
+		e.err = cbg.WriteMajorTypeHeader(&e.buf, maj, n)
+	}
+}
+
+func (e *cborEncoder) str(s string) {
+	if e.err == nil {
+		e.err = writeCborString(&e.buf, s)
+	}
+}
+
+func (e *cborEncoder) marshal(v cbg.CBORMarshaler) {
+	if e.err == nil {
+		e.err = v.MarshalCBOR(&e.buf)
+	}
+}
+
+func (e *cborEncoder) null() {
+	if e.err == nil {
+		_, e.err = e.buf.Write(cbg.CborNull)
+	}
+}
+
+// unknownField writes an entry that is not part of the ask types, with a
+// nested value that must be skipped.
+func (e *cborEncoder) unknownField() {
+	e.str("Unknown")
+	e.header(cbg.MajArray, 2)
+	e.marshal(cbg.CborInt(-7))
+	e.header(cbg.MajMap, 1)
+	e.str("Nested")
+	e.str("value")
+}
+
+func (e *cborEncoder) storageAsk(ask *spidresolver.StorageAsk) {
+	e.header(cbg.MajMap, 9)
+	e.unknownField()
+	e.str("Price")
+	e.marshal(&ask.Price)
+	e.str("VerifiedPrice")
+	e.marshal(&ask.VerifiedPrice)
+	e.str("MinPieceSize")
+	e.header(cbg.MajUnsignedInt, ask.MinPieceSize)
+	e.str("MaxPieceSize")
+	e.header(cbg.MajUnsignedInt, ask.MaxPieceSize)
+	e.str("Miner")
+	e.marshal(&ask.Miner)
+	e.str("Timestamp")
+	e.marshal(cbg.CborInt(ask.Timestamp))
+	e.str("Expiry")
+	e.marshal(cbg.CborInt(ask.Expiry))
+	e.str("SeqNo")
+	e.header(cbg.MajUnsignedInt, ask.SeqNo)
+}
+
+// askResponse returns a storage ask response holding ask, or a null ask if
+// ask is nil, with unknown fields at each level.
+func askResponse(t *testing.T, ask *spidresolver.StorageAsk) []byte {
+	t.Helper()
+	var e cborEncoder
+	e.header(cbg.MajMap, 2)
+	e.unknownField()
+	e.str("Ask")
+	e.header(cbg.MajMap, 2)
+	e.str("Ask")
+	if ask == nil {
+		e.null()
+	} else {
+		e.storageAsk(ask)
+	}
+	e.str("Signature")
+	e.header(cbg.MajByteString, 3)
+	e.buf.Write([]byte{1, 2, 3})
+	if e.err != nil {
+		t.Fatal(e.err)
+	}
+	return e.buf.Bytes()
+}
+
+func testStorageAsk(t *testing.T) *spidresolver.StorageAsk {
+	t.Helper()
+	miner, err := address.NewIDAddress(1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &spidresolver.StorageAsk{
+		Price:         big.NewInt(500000000),
+		VerifiedPrice: big.NewInt(0),
+		MinPieceSize:  256,
+		MaxPieceSize:  34359738368,
+		Miner:         miner,
+		Timestamp:     -42,
+		Expiry:        -9223372036854775808,
+		SeqNo:         7,
+	}
+}
+
+func TestReadAskResponse(t *testing.T) {
+	want := testStorageAsk(t)
+	ask, err := readAskResponse(bufio.NewReader(bytes.NewReader(askResponse(t, want))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ask.Price.Equals(want.Price) || !ask.VerifiedPrice.Equals(want.VerifiedPrice) {
+		t.Errorf("got prices %s and %s, want %s and %s", ask.Price, ask.VerifiedPrice, want.Price, want.VerifiedPrice)
+	}
+	if ask.MinPieceSize != want.MinPieceSize || ask.MaxPieceSize != want.MaxPieceSize {
+		t.Errorf("got piece sizes %d to %d, want %d to %d", ask.MinPieceSize, ask.MaxPieceSize, want.MinPieceSize, want.MaxPieceSize)
+	}
+	if ask.Miner != want.Miner {
+		t.Errorf("got miner %s, want %s", ask.Miner, want.Miner)
+	}
+	if ask.Timestamp != want.Timestamp || ask.Expiry != want.Expiry {
+		t.Errorf("got timestamp %d and expiry %d, want %d and %d", ask.Timestamp, ask.Expiry, want.Timestamp, want.Expiry)
+	}
+	if ask.SeqNo != want.SeqNo {
+		t.Errorf("got seq no %d, want %d", ask.SeqNo, want.SeqNo)
+	}
+}
+
+func TestReadAskResponseNoAsk(t *testing.T) {
+	_, err := readAskResponse(bufio.NewReader(bytes.NewReader(askResponse(t, nil))))
+	if !errors.Is(err, errNoAsk) {
+		t.Errorf("err = %v, want errNoAsk", err)
+	}
+
+	// A null signed ask has no ask.
+	var e cborEncoder
+	e.header(cbg.MajMap, 1)
+	e.str("Ask")
+	e.null()
+	_, err = readAskResponse(bufio.NewReader(bytes.NewReader(e.buf.Bytes())))
+	if !errors.Is(err, errNoAsk) {
+		t.Errorf("err = %v, want errNoAsk", err)
+	}
+}
+
+func TestReadAskResponseTruncated(t *testing.T) {
+	resp := askResponse(t, testStorageAsk(t))
+	for n := 0; n < len(resp); n++ {
+		_, err := readAskResponse(bufio.NewReader(bytes.NewReader(resp[:n])))
+		if err == nil {
+			t.Fatalf("no error for response truncated to %d of %d bytes", n, len(resp))
+		}
+		if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("truncated to %d bytes: err = %v, want EOF", n, err)
+		}
+	}
+}
+
+func TestReadAskResponseInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		encode  func(e *cborEncoder)
+		errText string
+	}{
+		{
+			name:    "not a map",
+			encode:  func(e *cborEncoder) { e.header(cbg.MajArray, 0) },
+			errText: "expected cbor map",
+		},
+		{
+			name: "negative piece size",
+			encode: func(e *cborEncoder) {
+				e.header(cbg.MajMap, 1)
+				e.str("Ask")
+				e.header(cbg.MajMap, 1)
+				e.str("Ask")
+				e.header(cbg.MajMap, 1)
+				e.str("MinPieceSize")
+				e.marshal(cbg.CborInt(-1))
+			},
+			errText: "field MinPieceSize: wrong type for uint64 field",
+		},
+		{
+			name: "string timestamp",
+			encode: func(e *cborEncoder) {
+				e.header(cbg.MajMap, 1)
+				e.str("Ask")
+				e.header(cbg.MajMap, 1)
+				e.str("Ask")
+				e.header(cbg.MajMap, 1)
+				e.str("Timestamp")
+				e.str("now")
+			},
+			errText: "field Timestamp: wrong type for int64 field",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e cborEncoder
+			tt.encode(&e)
+			if e.err != nil {
+				t.Fatal(e.err)
+			}
+			_, err := readAskResponse(bufio.NewReader(bytes.NewReader(e.buf.Bytes())))
+			if err == nil || !strings.Contains(err.Error(), tt.errText) {
+				t.Errorf("err = %v, want error containing %q", err, tt.errText)
+			}
+		})
+	}
+}
+
+func TestWriteAskRequest(t *testing.T) {
+	miner, err := address.NewIDAddress(1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = writeAskRequest(&buf, miner); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(&buf)
+	var got address.Address
+	err = readCborMap(r, func(name string) error {
+		if name != "Miner" {
+			t.Errorf("unexpected field %q", name)
+			return skipCbor(r)
+		}
+		return got.UnmarshalCBOR(r)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != miner {
+		t.Errorf("got miner %s, want %s", got, miner)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%d bytes left after the request", buf.Len())
+	}
+}
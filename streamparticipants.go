@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+)
+
+// maxQueuedIDs is the most participant IDs held while the workers are busy.
+// Reading the participants waits once this many are queued.
+const maxQueuedIDs = 10000
+
+// errEnoughParticipants stops reading the market participants once the limit
+// is reached.
+var errEnoughParticipants = errors.New("participant limit reached")
+
+// streamParticipants sends the ID of each storage market participant to ids
+// as it is read from the gateway, and then closes ids. If limit is greater
+// than zero, no more than limit IDs are sent. Up to maxQueuedIDs of the IDs
+// not yet taken from ids are queued, so that reading the response does not
+// wait for the workers, and is not abandoned by the call timeout, unless they
+// fall that far behind. Only the queued IDs, and not their balances, are held
+// in memory. The participants for which skip returns true
+// are not sent, and do not count toward the limit. It returns the number of IDs
+// sent, and stops reading when ctx is done.
+func streamParticipants(ctx context.Context, caller *rpcCaller, limit int, skip func(minerID string) bool, ids chan<- string) (int, error) {
+	queue := make(chan string)
+	queueDone := make(chan struct{})
+	go func() {
+		defer close(queueDone)
+		queueIDs(ctx, queue, ids, maxQueuedIDs)
+	}()
+
+	var n, read int
+	err := spidresolver.StreamMarketParticipants(ctx, caller, func(minerID string, _ spidresolver.MarketBalance) error {
+		read++
+		if skip(minerID) {
+			return nil
+		}
+		select {
+		case queue <- minerID:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		n++
+		if limit > 0 && n == limit {
+			return errEnoughParticipants
+		}
+		return nil
+	})
+	close(queue)
+	<-queueDone
+	if errors.Is(err, errEnoughParticipants) || (err != nil && ctx.Err() != nil) {
+		err = nil
+	}
+	if err != nil {
+		return n, fmt.Errorf("cannot read market participants: %w", err)
+	}
+	if read == 0 && ctx.Err() == nil {
+		fmt.Fprintln(os.Stderr, "warning: the gateway returned no market participants. It may be overloaded")
+	}
+	return n, nil
+}
+
+// queueIDs forwards each ID received from in to out, holding up to size IDs
+// that out is not ready for, so that sending to in only waits while size IDs
+// are held. out is closed once in is closed and every ID has been forwarded, or
+// when ctx is done.
+func queueIDs(ctx context.Context, in <-chan string, out chan<- string, size int) {
+	defer close(out)
+	if size < 1 {
+		size = 1
+	}
+	var pending []string
+	for in != nil || len(pending) != 0 {
+		// Sending is disabled, by a nil channel, while nothing is pending,
+		// and receiving while the queue is full.
+		var send chan<- string
+		var next string
+		if len(pending) != 0 {
+			send = out
+			next = pending[0]
+		}
+		recv := in
+		if len(pending) >= size {
+			recv = nil
+		}
+		select {
+		case id, ok := <-recv:
+			if !ok {
+				in = nil
+				continue
+			}
+			pending = append(pending, id)
+		case send <- next:
+			pending = pending[1:]
+		case <-ctx.Done():
+			// Let the sender finish without waiting. in is nil once it is
+			// closed.
+			if in != nil {
+				for range in {
+				}
+			}
+			return
+		}
+	}
+}
+
+// batchIDs sends the IDs received from ids to batchChan, in batches of up to
+// size IDs, and then closes batchChan. Each ID is sent in its own batch if size
+// is less than 2. A batch that is not full is sent once ids is closed. No more
+// batches are sent after ctx is cancelled.
+func batchIDs(ctx context.Context, ids <-chan string, size int, batchChan chan<- []string) {
+	defer close(batchChan)
+	if size < 1 {
+		size = 1
+	}
+	batch := make([]string, 0, size)
+	for id := range ids {
+		batch = append(batch, id)
+		if len(batch) < size {
+			continue
+		}
+		select {
+		case batchChan <- batch:
+		case <-ctx.Done():
+			return
+		}
+		batch = make([]string, 0, size)
+	}
+	if len(batch) != 0 {
+		select {
+		case batchChan <- batch:
+		case <-ctx.Done():
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestQueueIDs(t *testing.T) {
+	const size = 3
+	in := make(chan string)
+	out := make(chan string)
+	go queueIDs(context.Background(), in, out, size)
+
+	// With nothing taken from out, only size IDs are accepted.
+	for i := 0; i < size; i++ {
+		in <- fmt.Sprint(i)
+	}
+	select {
+	case in <- "full":
+		t.Fatal("queue accepted more than its size")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Taking an ID makes room for another.
+	if id := <-out; id != "0" {
+		t.Fatalf("got %q, want 0", id)
+	}
+	in <- fmt.Sprint(size)
+	close(in)
+
+	var got []string
+	for id := range out {
+		got = append(got, id)
+	}
+	want := []string{"1", "2", "3"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestQueueIDsCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan string)
+	out := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		queueIDs(ctx, in, out, 1)
+		close(done)
+	}()
+
+	// The queue is full and in is closed, with nothing taken from out.
+	in <- "f01000"
+	close(in)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("queueIDs did not return after ctx was cancelled")
+	}
+}
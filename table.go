@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+)
+
+// tablePeerIDLen is the longest peer ID shown in a table. Longer peer IDs are
+// shortened to their start and end, so that every row has the same width.
+const tablePeerIDLen = 19
+
+// newTableWriter returns a tabwriter that aligns the tab-separated columns
+// written to it, and writes them to w when flushed.
+func newTableWriter(w io.Writer) *tabwriter.Writer {
+	return tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+}
+
+// truncatePeerID shortens a formatted peer ID longer than tablePeerIDLen to
+// its first and last characters, separated by "...".
+func truncatePeerID(s string) string {
+	if len(s) <= tablePeerIDLen {
+		return s
+	}
+	keep := (tablePeerIDLen - 3) / 2
+	return s[:keep] + "..." + s[len(s)-keep:]
+}
+
+// tableWriter writes each peer ID lookup result as a row of a table, with the
+// miner ID, peer ID, and number of addresses. The table is written when
+// flushed.
+type tableWriter struct {
+	tw           *tabwriter.Writer
+	formatPeerID peerIDFormat
+}
+
+func newPeerIDTableWriter(w io.Writer, formatPeerID peerIDFormat) *tableWriter {
+	tw := newTableWriter(w)
+	fmt.Fprintln(tw, "MINER ID\tPEER ID\tADDRS")
+	return &tableWriter{
+		tw:           tw,
+		formatPeerID: formatPeerID,
+	}
+}
+
+func (t *tableWriter) write(result peerIDResult) error {
+	var err error
+	switch {
+	case errors.Is(result.err, spidresolver.ErrNoPeerID):
+		_, err = fmt.Fprintf(t.tw, "%s\t-\t0\n", result.minerID)
+	case result.err != nil:
+		// Counted by populateCollector.
+	default:
+		_, err = fmt.Fprintf(t.tw, "%s\t%s\t%d\n", result.minerID, truncatePeerID(t.formatPeerID(result.addrInfo.ID)), len(result.addrInfo.Addrs))
+	}
+	return err
+}
+
+func (t *tableWriter) flush() error {
+	return t.tw.Flush()
+}
+
+// tableAskWriter writes each ask as a row of a table, with prices in FIL.
+// The table is written when flushed. Failed queries are reported on stderr.
+type tableAskWriter struct {
+	tw     *tabwriter.Writer
+	timing bool
+}
+
+func newTableAskWriter(w io.Writer, timing bool) *tableAskWriter {
+	tw := newTableWriter(w)
+	header := "MINER ID\tPEER ID\tPRICE\tVERIFIED PRICE\tMIN PIECE SIZE\tMAX PIECE SIZE"
+	if timing {
+		header += "\tQUERY MS"
+	}
+	fmt.Fprintln(tw, header)
+	return &tableAskWriter{
+		tw:     tw,
+		timing: timing,
+	}
+}
+
+func (t *tableAskWriter) write(result queryAskResult) error {
+	if result.err != nil {
+		fmt.Fprintln(os.Stderr, result.minerID, result.err)
+		return nil
+	}
+	if result.ask == nil {
+		fmt.Fprintln(os.Stderr, result.minerID, "has no query ask result")
+		return nil
+	}
+	ask := result.ask
+	row := fmt.Sprintf("%s\t%s\t%s\t%s\t%d\t%d", result.minerID, truncatePeerID(result.peerID.String()),
+		spidresolver.FormatFIL(ask.Price), spidresolver.FormatFIL(ask.VerifiedPrice), ask.MinPieceSize, ask.MaxPieceSize)
+	if t.timing {
+		row += "\t" + durationMillis(result.duration)
+	}
+	_, err := fmt.Fprintln(t.tw, row)
+	return err
+}
+
+func (t *tableAskWriter) flush() error {
+	return t.tw.Flush()
+}
+
+// writeFindTableHeader writes the header of the table of find results.
+func writeFindTableHeader(tw *tabwriter.Writer) {
+	fmt.Fprintln(tw, "STORAGE PROVIDER\tPEER ID\tADDRS")
+}
+
+// writeFindTableRow writes the result of looking up one storage provider as
+// a row of the table of find results.
+func writeFindTableRow(tw *tabwriter.Writer, result findResult, formatPeerID peerIDFormat) {
+	fmt.Fprintf(tw, "%s\t%s\t%d\n", result.spid, truncatePeerID(formatPeerID(result.addrInfo.ID)), len(result.addrInfo.Addrs))
+}
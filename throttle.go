@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRetryAfter is the longest that calls are paused for a Retry-After header,
+// so that a gateway cannot stop the calls for an unbounded time.
+const maxRetryAfter = 5 * time.Minute
+
+// throttle pauses all calls to a gateway after the gateway responds with 429
+// Too Many Requests, so that the workers back off together instead of each
+// retrying on its own. A nil throttle never pauses.
+type throttle struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// pause stops calls from starting for the duration d, unless they are already
+// stopped for longer.
+func (t *throttle) pause(d time.Duration) {
+	t.mu.Lock()
+	if until := time.Now().Add(d); until.After(t.until) {
+		t.until = until
+	}
+	t.mu.Unlock()
+}
+
+// wait blocks until calls are no longer paused, or until ctx is cancelled.
+func (t *throttle) wait(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	delay := time.Until(t.until)
+	t.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryAfterTransport is an http.RoundTripper that pauses its throttle when a
+// response has status 429, for the time given by the Retry-After header up to
+// maxRetryAfter, or for defaultDelay if there is no valid Retry-After header.
+type retryAfterTransport struct {
+	base         http.RoundTripper
+	throttle     *throttle
+	defaultDelay time.Duration
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			delay = t.defaultDelay
+		}
+		t.throttle.pause(delay)
+	}
+	return resp, nil
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or an HTTP date, into the delay from now. The delay is at
+// most maxRetryAfter.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		if secs > int64(maxRetryAfter/time.Second) {
+			return maxRetryAfter, true
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	delay := date.Sub(now)
+	if delay <= 0 {
+		return 0, true
+	}
+	return min(delay, maxRetryAfter), true
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"empty", "", 0, false},
+		{"seconds", "120", 2 * time.Minute, true},
+		{"zero seconds", "0", 0, true},
+		{"negative seconds", "-5", 0, false},
+		{"seconds over cap", "3600", maxRetryAfter, true},
+		{"seconds overflow", "99999999999999999", maxRetryAfter, true},
+		{"http date", now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{"http date over cap", now.Add(24 * time.Hour).Format(http.TimeFormat), maxRetryAfter, true},
+		{"past http date", now.Add(-time.Hour).Format(http.TimeFormat), 0, true},
+		{"garbage", "soon", 0, false},
+		{"fractional seconds", "1.5", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.value, now)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("parseRetryAfter(%q) = (%s, %t), want (%s, %t)", tt.value, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+type statusTransport struct {
+	status     int
+	retryAfter string
+}
+
+func (t statusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp := &http.Response{
+		StatusCode: t.status,
+		Header:     make(http.Header),
+		Request:    req,
+	}
+	if t.retryAfter != "" {
+		resp.Header.Set("Retry-After", t.retryAfter)
+	}
+	return resp, nil
+}
+
+func TestRetryAfterTransport(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		want       time.Duration
+	}{
+		{"ok", http.StatusOK, "30", 0},
+		{"retry after", http.StatusTooManyRequests, "30", 30 * time.Second},
+		{"default delay", http.StatusTooManyRequests, "garbage", 10 * time.Second},
+		{"capped", http.StatusTooManyRequests, "86400", maxRetryAfter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			thr := &throttle{}
+			transport := &retryAfterTransport{
+				base:         statusTransport{status: tt.status, retryAfter: tt.retryAfter},
+				throttle:     thr,
+				defaultDelay: 10 * time.Second,
+			}
+			req, err := http.NewRequest(http.MethodPost, "http://gateway.example.com/rpc/v1", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			if _, err = transport.RoundTrip(req); err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == 0 {
+				if !thr.until.IsZero() {
+					t.Errorf("throttle paused until %s, want no pause", thr.until)
+				}
+				return
+			}
+			paused := thr.until.Sub(start)
+			if paused < tt.want || paused > tt.want+time.Second {
+				t.Errorf("throttle paused for %s, want %s", paused, tt.want)
+			}
+		})
+	}
+}
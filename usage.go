@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// programName is the name of the command shown in usage messages.
+const programName = "spidtoaddrinfo"
+
+// commandHelp describes a subcommand in the usage messages.
+type commandHelp struct {
+	name string
+	// summary is the one line description shown in the list of subcommands.
+	summary string
+	// description explains what the subcommand does, before its flags.
+	description string
+	// examples are command lines showing how the subcommand is used.
+	examples []string
+	// footer, if not empty, is written after the flags.
+	footer string
+}
+
+// commands are the subcommands, in the order they are listed in the usage
+// message.
+var commands = []commandHelp{
+	{
+		name:    "find",
+		summary: "Look up the peer ID and addresses of storage providers",
+		description: `Looks up the peer ID and multiaddrs of each storage provider given as an
+argument, with --storage_provider_id, or in --from-file, and prints them.`,
+		examples: []string{
+			programName + " find f01234",
+			programName + " find --gateway https://api.node.glif.io/rpc/v1 --token $TOKEN --output json f01234 f05678",
+			programName + " find --summary --agent f01234,f05678,f09012",
+			programName + " find --watch --watch-interval 1m f01234",
+		},
+		footer: findExitCodes,
+	},
+	{
+		name:    "populate",
+		summary: "Look up the peer ID of every storage market participant",
+		description: `Looks up the peer ID and multiaddrs of every storage market participant,
+saves them in the local datastore, and writes them to stdout or --out.`,
+		examples: []string{
+			programName + " populate --out miners.txt",
+			programName + " populate --gateway lotus.example.com:1234 --token $TOKEN --format ndjson --limit 100",
+		},
+	},
+	{
+		name:    "query-asks",
+		summary: "Query the storage ask of storage market participants",
+		description: `Queries the storage ask, with its prices and piece sizes, of every storage
+market participant, or of the miners in a file written by populate --out.`,
+		examples: []string{
+			programName + " query-asks --from-populate miners.txt --connect-and-identify",
+			programName + " query-asks --gateway https://lotus.example.com/rpc/v0 --token $TOKEN --format csv --max-price 0",
+		},
+	},
+	{
+		name:    "scan",
+		summary: "Look up peer IDs, and optionally asks, in one pass",
+		description: `Looks up the peer ID and multiaddrs of every storage market participant,
+and with --ask queries its storage ask directly, writing a JSON record for
+each miner. This makes half the RPC calls of running populate and query-asks.`,
+		examples: []string{
+			programName + " scan --ask --limit 50",
+			programName + " scan --gateway lotus.example.com:1234 --token $TOKEN > scan.ndjson",
+		},
+	},
+	{
+		name:        "count",
+		summary:     "Print the number of storage market participants",
+		description: `Prints only the number of storage market participants, for monitoring.`,
+		examples: []string{
+			programName + " count",
+			programName + " count --gateway https://api.node.glif.io/rpc/v1 --token $TOKEN",
+		},
+	},
+	{
+		name:        "chain-head",
+		summary:     "Print the gateway's chain head",
+		description: `Prints the height and tipset CIDs of the gateway's chain head.`,
+		examples: []string{
+			programName + " chain-head",
+			programName + " chain-head --gateway lotus.example.com:1234 --token $TOKEN --output json",
+		},
+	},
+	{
+		name:    "dial",
+		summary: "Connect to a storage provider with libp2p",
+		description: `Looks up a storage provider and connects to it with libp2p, reporting the
+address connected to, and the agent version and protocols the peer sent.`,
+		examples: []string{
+			programName + " dial f01234",
+			programName + " dial --gateway https://api.node.glif.io/rpc/v1 --token $TOKEN --dial-timeout 10s f01234",
+		},
+	},
+	{
+		name:    "check",
+		summary: "Check that the gateways are reachable and in sync",
+		description: `Checks that each gateway responds with a valid chain head, at most
+--max-lag epochs behind the height expected from the genesis time.`,
+		examples: []string{
+			programName + " check",
+			programName + " check --gateway api.node.glif.io --gateway lotus.example.com:1234 --token $TOKEN",
+		},
+	},
+}
+
+// errUsage is returned by a subcommand that is missing a required argument,
+// so that its usage message is written instead of an error.
+var errUsage = errors.New("missing required argument")
+
+// newFlagSet returns a flag set for the named subcommand, with its usage
+// message set.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	setUsage(fs)
+	return fs
+}
+
+// setUsage sets the usage message of the subcommand's flag set to its
+// description, flags, and examples.
+func setUsage(fs *flag.FlagSet) {
+	help, ok := commandHelpFor(fs.Name())
+	if !ok {
+		return
+	}
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: %s %s [flags]\n\n", programName, help.name)
+		fmt.Fprintln(out, help.description)
+		fmt.Fprintln(out)
+		fmt.Fprintln(out, "Flags:")
+		fs.PrintDefaults()
+		if len(help.examples) != 0 {
+			fmt.Fprintln(out)
+			fmt.Fprintln(out, "Examples:")
+			for _, example := range help.examples {
+				fmt.Fprintln(out, " ", example)
+			}
+		}
+		if help.footer != "" {
+			fmt.Fprintln(out)
+			fmt.Fprint(out, help.footer)
+		}
+	}
+}
+
+func commandHelpFor(name string) (commandHelp, bool) {
+	for _, help := range commands {
+		if help.name == name {
+			return help, true
+		}
+	}
+	return commandHelp{}, false
+}
+
+// writeUsage writes the list of subcommands.
+func writeUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <subcommand> [flags]\n\n", programName)
+	fmt.Fprintln(w, "Subcommands:")
+	for _, help := range commands {
+		fmt.Fprintf(w, "  %-12s %s\n", help.name, help.summary)
+	}
+	fmt.Fprintf(w, "  %-12s %s\n", "help", "Show this message, or the usage of a subcommand")
+	fmt.Fprintf(w, "\nRun \"%s help <subcommand>\" for the flags and examples of a subcommand.\n", programName)
+}
+
+// printHelp writes the usage message of the subcommand named by args to
+// stdout, or the list of subcommands if args is empty. Returns false if the
+// subcommand is not known.
+func printHelp(args []string) bool {
+	if len(args) == 0 {
+		writeUsage(os.Stdout)
+		return true
+	}
+	sub, ok := subcommands[args[0]]
+	if !ok {
+		return false
+	}
+	fs := newFlagSet(args[0])
+	sub(fs)
+	addConfigFlag(fs)
+	fs.SetOutput(os.Stdout)
+	fs.Usage()
+	return true
+}
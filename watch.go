@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/gammazero/spidtoaddrinfo/spidresolver"
+)
+
+// defaultWatchInterval is the time between polls of the chain head with find
+// --watch, which is the time between epochs.
+const defaultWatchInterval = 30 * time.Second
+
+// minerInfoField is a field of the miner info written as a string, so that
+// values can be compared and printed.
+type minerInfoField struct {
+	name  string
+	value string
+}
+
+// minerInfoFields returns the fields of the miner info in the order they are
+// defined. Multiaddrs are decoded, and the peer ID is formatted with
+// formatPeerID.
+func minerInfoFields(minerInfo spidresolver.MinerInfo, formatPeerID peerIDFormat) []minerInfoField {
+	peerID := "none"
+	if minerInfo.PeerId != nil {
+		peerID = formatPeerID(*minerInfo.PeerId)
+	}
+	return []minerInfoField{
+		{"Owner", minerInfo.Owner.String()},
+		{"Worker", minerInfo.Worker.String()},
+		{"NewWorker", minerInfo.NewWorker.String()},
+		{"ControlAddresses", joinAddresses(minerInfo.ControlAddresses)},
+		{"WorkerChangeEpoch", strconv.FormatInt(minerInfo.WorkerChangeEpoch, 10)},
+		{"PeerId", peerID},
+		{"Multiaddrs", "[" + strings.Join(newRawMinerInfo(minerInfo).Multiaddrs, " ") + "]"},
+		{"WindowPoStProofType", strconv.FormatInt(minerInfo.WindowPoStProofType, 10)},
+		{"SectorSize", strconv.FormatUint(minerInfo.SectorSize, 10)},
+		{"WindowPoStPartitionSectors", strconv.FormatUint(minerInfo.WindowPoStPartitionSectors, 10)},
+		{"ConsensusFaultElapsed", strconv.FormatInt(minerInfo.ConsensusFaultElapsed, 10)},
+	}
+}
+
+func joinAddresses(addrs []address.Address) string {
+	s := make([]string, len(addrs))
+	for i, a := range addrs {
+		s[i] = a.String()
+	}
+	return "[" + strings.Join(s, " ") + "]"
+}
+
+// minerInfoChange is a field of the miner info whose value changed.
+type minerInfoChange struct {
+	field string
+	from  string
+	to    string
+}
+
+// diffMinerInfo returns the fields that are different in cur than in prev,
+// in the order they are defined.
+func diffMinerInfo(prev, cur spidresolver.MinerInfo, formatPeerID peerIDFormat) []minerInfoChange {
+	prevFields := minerInfoFields(prev, formatPeerID)
+	curFields := minerInfoFields(cur, formatPeerID)
+	var changes []minerInfoChange
+	for i, f := range curFields {
+		if f.value != prevFields[i].value {
+			changes = append(changes, minerInfoChange{
+				field: f.name,
+				from:  prevFields[i].value,
+				to:    f.value,
+			})
+		}
+	}
+	return changes
+}
+
+// watchProvider looks up the storage provider at the chain head, and then
+// polls the chain head every interval. When the chain head has moved, the
+// miner info is looked up again, and a timestamped line is printed for each
+// field that changed. Failed polls are reported on stderr and retried at the
+// next interval. Watching stops without error when ctx is cancelled.
+func watchProvider(ctx context.Context, caller *rpcCaller, spid string, interval time.Duration, formatPeerID peerIDFormat) error {
+	ets, err := spidresolver.ChainHead(ctx, caller)
+	if err != nil {
+		return err
+	}
+	// The cache is not used, since the miner info must be current.
+	prev, err := spidresolver.StateMinerInfo(ctx, caller, spid, ets.Cids)
+	if err != nil {
+		return err
+	}
+	peerID := "none"
+	if prev.PeerId != nil {
+		peerID = formatPeerID(*prev.PeerId)
+	}
+	fmt.Printf("%s height %d: watching %s, peer ID %s, %d addresses\n",
+		time.Now().Format(time.RFC3339), ets.Height, spid, peerID, len(prev.Multiaddrs))
+
+	height := ets.Height
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+
+		ets, err = spidresolver.ChainHead(ctx, caller)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			fmt.Fprintln(os.Stderr, "cannot get chain head:", err)
+			continue
+		}
+		if ets.Height == height {
+			continue
+		}
+		cur, err := spidresolver.StateMinerInfo(ctx, caller, spid, ets.Cids)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			fmt.Fprintf(os.Stderr, "cannot get miner info at height %d: %s\n", ets.Height, err)
+			continue
+		}
+		height = ets.Height
+		now := time.Now().Format(time.RFC3339)
+		for _, c := range diffMinerInfo(prev, cur, formatPeerID) {
+			fmt.Printf("%s height %d: %s changed from %s to %s\n", now, height, c.field, c.from, c.to)
+		}
+		prev = cur
+	}
+}